@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// InvalidAnnotationError is returned for architecture override annotations
+// whose value can't be parsed. Retrying does not help, as the pod won't
+// resolve until the annotation is changed.
+type InvalidAnnotationError struct {
+	Annotation string
+	Value      string
+	Err        error
+}
+
+func (e *InvalidAnnotationError) Error() string {
+	return fmt.Sprintf("annotation %s has invalid value %q: %v", e.Annotation, e.Value, e.Err)
+}
+
+func (e *InvalidAnnotationError) Unwrap() error {
+	return e.Err
+}
+
+// isArchAnnotation determines if the given annotation key is
+// one of the architecture override annotations.
+func isArchAnnotation(key string) bool {
+	return key == ARCH_ANNOTATION ||
+		key == ARCH_MODE_ANNOTATION ||
+		strings.HasPrefix(key, CONTAINER_ARCH_PREFIX)
+}
+
+// getControllerRef returns the owner reference which manages the object, if any.
+func getControllerRef(owners []metav1.OwnerReference) *metav1.OwnerReference {
+	for i := range owners {
+		if owners[i].Controller != nil && *owners[i].Controller {
+			return &owners[i]
+		}
+	}
+	return nil
+}
+
+// getOwnerMeta gets the metadata of the given owner of an object within the given namespace.
+// Returns nil if the owner is not a supported workload kind.
+func getOwnerMeta(ctx *context.Context, clientset kubernetes.Interface, namespace string, owner *metav1.OwnerReference) (*metav1.ObjectMeta, error) {
+	getOptions := metav1.GetOptions{}
+	switch owner.Kind {
+	case "ReplicaSet":
+		result, err := clientset.AppsV1().ReplicaSets(namespace).Get(*ctx, owner.Name, getOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &result.ObjectMeta, nil
+	case "Deployment":
+		result, err := clientset.AppsV1().Deployments(namespace).Get(*ctx, owner.Name, getOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &result.ObjectMeta, nil
+	case "StatefulSet":
+		result, err := clientset.AppsV1().StatefulSets(namespace).Get(*ctx, owner.Name, getOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &result.ObjectMeta, nil
+	case "DaemonSet":
+		result, err := clientset.AppsV1().DaemonSets(namespace).Get(*ctx, owner.Name, getOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &result.ObjectMeta, nil
+	case "Job":
+		result, err := clientset.BatchV1().Jobs(namespace).Get(*ctx, owner.Name, getOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &result.ObjectMeta, nil
+	case "CronJob":
+		result, err := clientset.BatchV1().CronJobs(namespace).Get(*ctx, owner.Name, getOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &result.ObjectMeta, nil
+	}
+	return nil, nil
+}
+
+// archAnnotations returns the architecture annotations within the given annotations.
+func archAnnotations(annotations map[string]string) map[string]string {
+	result := make(map[string]string)
+	for key, value := range annotations {
+		if isArchAnnotation(key) {
+			result[key] = value
+		}
+	}
+	return result
+}
+
+// getWorkloadAnnotations walks up the owners of the given pod (i.e.
+// ReplicaSet, then Deployment), returning the architecture annotations
+// of each owner found along the way, nearest owner first.
+func getWorkloadAnnotations(ctx *context.Context, clientset kubernetes.Interface, pod *v1.Pod) ([]map[string]string, error) {
+	metas := make([]*metav1.ObjectMeta, 0)
+	owner := getControllerRef(pod.OwnerReferences)
+	for depth := 0; owner != nil && depth < MAX_OWNER_DEPTH; depth++ {
+		meta, err := getOwnerMeta(ctx, clientset, pod.Namespace, owner)
+		if k8serrors.IsNotFound(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if meta == nil {
+			break
+		}
+		metas = append(metas, meta)
+		owner = getControllerRef(meta.OwnerReferences)
+	}
+
+	annotations := make([]map[string]string, 0, len(metas))
+	for _, meta := range metas {
+		annotations = append(annotations, archAnnotations(meta.Annotations))
+	}
+	return annotations, nil
+}
+
+// annotationResolver answers using architecture override annotations on
+// the image's pod, or on the pod's owning workloads:
+//
+//   - architectures.archaware.io/<container name> applies to a single container.
+//   - archaware.io/architectures applies to every container without the above.
+//   - archaware.io/architectures-mode determines how the annotations are used:
+//     "override" (the default) answers with the annotation's platforms,
+//     bypassing other resolvers, while "narrow" passes the image along to the
+//     next resolver, narrowing down its answer to the annotation's platforms.
+//
+// Annotations on the pod take precedence over annotations on its workloads,
+// and annotations on nearer workloads over those on farther ones: the
+// annotations of the nearest object naming the container's architectures
+// are used, along with that object's mode.
+// Declines images without an annotation.
+type annotationResolver struct {
+	workloads *lruCache[[]map[string]string]
+	nodes     *lruCache[map[string]bool]
+}
+
+func newAnnotationResolver() *annotationResolver {
+	return &annotationResolver{
+		workloads: newLRUCache[[]map[string]string](1000),
+		nodes:     newLRUCache[map[string]bool](1),
+	}
+}
+
+func (r *annotationResolver) Name() string {
+	return "annotation"
+}
+
+// getAnnotations returns the architecture annotations which apply to the
+// given pod: those of the pod, followed by those of each of its workloads.
+func (r *annotationResolver) getAnnotations(ctx *context.Context, pod *v1.Pod) ([]map[string]string, error) {
+	annotations := []map[string]string{archAnnotations(pod.Annotations)}
+
+	if owner := getControllerRef(pod.OwnerReferences); owner != nil {
+		key := string(owner.UID)
+		workloadAnnotations, ok := r.workloads.Get(key)
+		if !ok {
+			var err error
+			workloadAnnotations, err = getWorkloadAnnotations(ctx, GetK8sInterface(ctx), pod)
+			if err != nil {
+				return nil, err
+			}
+			r.workloads.Add(key, workloadAnnotations, ANNOTATION_CACHE_TTL)
+		}
+		annotations = append(annotations, workloadAnnotations...)
+	}
+	return annotations, nil
+}
+
+// lookupAnnotation returns the annotations of the nearest object naming the
+// architectures of the given container, along with the key naming them.
+// The container's own annotation takes precedence over the pod-wide one.
+func lookupAnnotation(levels []map[string]string, container string) (map[string]string, string, bool) {
+	for _, annotations := range levels {
+		for _, key := range []string{CONTAINER_ARCH_PREFIX + container, ARCH_ANNOTATION} {
+			if _, ok := annotations[key]; ok {
+				return annotations, key, true
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// getNodeArchitectures returns the normalized architectures of every node in the cluster.
+func (r *annotationResolver) getNodeArchitectures(ctx *context.Context) (map[string]bool, error) {
+	if architectures, ok := r.nodes.Get("nodes"); ok {
+		return architectures, nil
+	}
+	nodeList, err := GetK8sInterface(ctx).CoreV1().Nodes().List(*ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	architectures := make(map[string]bool)
+	for _, node := range nodeList.Items {
+		arch, _ := normalizeVariant(node.Status.NodeInfo.Architecture, "")
+		architectures[arch] = true
+	}
+	r.nodes.Add("nodes", architectures, ANNOTATION_CACHE_TTL)
+	return architectures, nil
+}
+
+func (r *annotationResolver) Resolve(ctx *context.Context, request *ImageRequest) ([]ocispec.Platform, error) {
+	pod := request.Pod
+	if pod == nil {
+		return nil, ErrResolverDeclined
+	}
+
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("pod-name", pod.Name).
+			Str("container-name", request.Container)
+	}
+	recordEvent := func(reason string, messageFmt string, args ...interface{}) {
+		if recorder := GetEventRecorder(ctx); recorder != nil {
+			recorder.Eventf(pod, v1.EventTypeWarning, reason, messageFmt, args...)
+		}
+	}
+
+	levels, err := r.getAnnotations(ctx, pod)
+	if err != nil {
+		getLog(zerolog.WarnLevel).
+			AnErr("err", err).
+			Msg("Unable to get architecture annotations of pod's workload")
+		return nil, err
+	}
+
+	annotations, key, ok := lookupAnnotation(levels, request.Container)
+	if !ok {
+		return nil, ErrResolverDeclined
+	}
+	value := annotations[key]
+
+	allowed, err := parsePlatformList(value)
+	if err != nil {
+		getLog(zerolog.WarnLevel).
+			AnErr("err", err).
+			Str("annotation", key).
+			Msg("Invalid architecture annotation")
+		return nil, &InvalidAnnotationError{Annotation: key, Value: value, Err: err}
+	}
+
+	nodeArchitectures, err := r.getNodeArchitectures(ctx)
+	if err != nil {
+		getLog(zerolog.WarnLevel).
+			AnErr("err", err).
+			Msg("Unable to list nodes, skipping validation of architecture annotation")
+	} else {
+		for _, platform := range allowed {
+			if nodeArchitectures[platform.Architecture] {
+				continue
+			}
+			getLog(zerolog.WarnLevel).
+				Str("annotation", key).
+				Str("arch", platform.Architecture).
+				Msg("Architecture annotation names an architecture no node has")
+			recordEvent(
+				"UnknownArchitectureAnnotation",
+				"Annotation %s names architecture %s, which no node in the cluster has",
+				key, platform.Architecture,
+			)
+		}
+	}
+
+	switch mode := annotations[ARCH_MODE_ANNOTATION]; mode {
+	case "", "override":
+		// Platforms without an operating system are assumed to
+		// use the pod's operating system
+		platforms := make([]ocispec.Platform, 0, len(allowed))
+		for _, platform := range allowed {
+			if platform.OS == "" {
+				platform.OS = getPodOS(pod)
+			}
+			platforms = append(platforms, normalizePlatform(platform))
+		}
+		return platforms, nil
+	case "narrow":
+		request.Allowed = allowed
+		return nil, ErrResolverDeclined
+	default:
+		getLog(zerolog.WarnLevel).
+			Str("annotation", ARCH_MODE_ANNOTATION).
+			Msg("Invalid architecture annotation mode")
+		return nil, &InvalidAnnotationError{
+			Annotation: ARCH_MODE_ANNOTATION,
+			Value:      mode,
+			Err:        fmt.Errorf("expected override or narrow"),
+		}
+	}
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func TestParsePlatformSpecifier(t *testing.T) {
+	tests := map[string]ocispec.Platform{
+		"arm64":         {Architecture: "arm64"},
+		"aarch64":       {Architecture: "arm64"},
+		"x86_64":        {Architecture: "amd64"},
+		"arm/v7":        {Architecture: "arm", Variant: "v7"},
+		"linux/arm":     {OS: "linux", Architecture: "arm"},
+		"windows/amd64": {OS: "windows", Architecture: "amd64"},
+		"linux/arm/v6":  {OS: "linux", Architecture: "arm", Variant: "v6"},
+		" s390x ":       {Architecture: "s390x"},
+	}
+	for specifier, expected := range tests {
+		platform, err := parsePlatformSpecifier(specifier)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", specifier, err)
+			continue
+		}
+		if !reflect.DeepEqual(platform, expected) {
+			t.Errorf("expected %q to be parsed as %+v, got %+v", specifier, expected, platform)
+		}
+	}
+
+	for _, specifier := range []string{"", "linux/", "/amd64", "a/b/c/d", "arm 64", "arm=64"} {
+		if _, err := parsePlatformSpecifier(specifier); err == nil {
+			t.Errorf("expected %q to be rejected", specifier)
+		}
+	}
+}
+
+func TestParsePlatformList(t *testing.T) {
+	platforms, err := parsePlatformList("linux/amd64, arm64,,arm/v7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ocispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{Architecture: "arm64"},
+		{Architecture: "arm", Variant: "v7"},
+	}
+	if !reflect.DeepEqual(platforms, expected) {
+		t.Errorf("unexpected platforms: %+v, expected %+v", platforms, expected)
+	}
+
+	for _, list := range []string{"", " , ", "amd64,a/b/c/d"} {
+		if _, err := parsePlatformList(list); err == nil {
+			t.Errorf("expected %q to be rejected", list)
+		}
+	}
+}
+
+// newAnnotationContext returns a context whose cluster holds the given objects
+// along with nodes of every architecture used within the tests.
+func newAnnotationContext(objects ...runtime.Object) context.Context {
+	for _, arch := range []string{"amd64", "arm64", "s390x"} {
+		objects = append(objects, &v1.Node{
+			ObjectMeta: metav1.ObjectMeta{Name: arch},
+			Status: v1.NodeStatus{
+				NodeInfo: v1.NodeSystemInfo{Architecture: arch, OperatingSystem: "linux"},
+			},
+		})
+	}
+	return context.WithValue(context.Background(), K8S_INTERFACE_KEY, fake.NewSimpleClientset(objects...))
+}
+
+func TestAnnotationResolverModes(t *testing.T) {
+	ctx := newAnnotationContext()
+	resolver := newAnnotationResolver()
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "default",
+			Annotations: map[string]string{
+				ARCH_ANNOTATION: "arm64,s390x",
+			},
+		},
+		Spec: v1.PodSpec{OS: &v1.PodOS{Name: v1.Linux}},
+	}
+
+	// Overriding answers with the annotation's platforms, using the pod's
+	// operating system for platforms without one
+	request := &ImageRequest{Pod: pod, Container: "app", Image: "example.com/app:1.0"}
+	platforms, err := resolver.Resolve(&ctx, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []ocispec.Platform{
+		{OS: "linux", Architecture: "arm64", Variant: "v8"},
+		{OS: "linux", Architecture: "s390x"},
+	}
+	if !reflect.DeepEqual(platforms, expected) {
+		t.Errorf("unexpected platforms: %s, expected %s", formatPlatforms(platforms), formatPlatforms(expected))
+	}
+
+	// Narrowing passes the image on, narrowing down the next resolver's answer
+	pod.Annotations[ARCH_MODE_ANNOTATION] = "narrow"
+	request = &ImageRequest{Pod: pod, Container: "app", Image: "example.com/app:1.0"}
+	if _, err := resolver.Resolve(&ctx, request); !errors.Is(err, ErrResolverDeclined) {
+		t.Fatalf("expected narrowing annotation to decline, got %v", err)
+	}
+	if expected := []ocispec.Platform{{Architecture: "arm64"}, {Architecture: "s390x"}}; !reflect.DeepEqual(request.Allowed, expected) {
+		t.Errorf("unexpected allowed platforms: %+v, expected %+v", request.Allowed, expected)
+	}
+
+	pod.Annotations[ARCH_MODE_ANNOTATION] = "sometimes"
+	request = &ImageRequest{Pod: pod, Container: "app", Image: "example.com/app:1.0"}
+	var annotationErr *InvalidAnnotationError
+	if _, err := resolver.Resolve(&ctx, request); !errors.As(err, &annotationErr) || annotationErr.Annotation != ARCH_MODE_ANNOTATION {
+		t.Errorf("expected unknown mode to be invalid, got %v", err)
+	}
+
+	// Pods without annotations are left to the other resolvers
+	request = &ImageRequest{Pod: &v1.Pod{ObjectMeta: metav1.ObjectMeta{Name: "plain"}}, Container: "app", Image: "example.com/app:1.0"}
+	if _, err := resolver.Resolve(&ctx, request); !errors.Is(err, ErrResolverDeclined) {
+		t.Errorf("expected pod without annotations to be declined, got %v", err)
+	}
+}
+
+func TestAnnotationResolverPrecedence(t *testing.T) {
+	controller := true
+	replicaSet := &appsv1.ReplicaSet{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "app",
+			Namespace: "default",
+			UID:       "replicaset",
+			Annotations: map[string]string{
+				CONTAINER_ARCH_PREFIX + "app":     "arm64",
+				CONTAINER_ARCH_PREFIX + "sidecar": "amd64,arm64",
+				ARCH_MODE_ANNOTATION:              "narrow",
+				"unrelated":                       "annotation",
+			},
+		},
+	}
+	ctx := newAnnotationContext(replicaSet)
+
+	newPod := func(annotations map[string]string) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "app-1234",
+				Namespace:   "default",
+				Annotations: annotations,
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "apps/v1", Kind: "ReplicaSet", Name: "app", UID: "replicaset", Controller: &controller},
+				},
+			},
+		}
+	}
+
+	tests := []struct {
+		name      string
+		pod       *v1.Pod
+		container string
+		// expected is the architectures answered, or nil if
+		// the request is expected to be narrowed instead
+		expected []string
+		allowed  []string
+	}{
+		{
+			name:      "workload container annotation and mode",
+			pod:       newPod(nil),
+			container: "app",
+			allowed:   []string{"arm64"},
+		},
+		{
+			name:      "pod-wide annotation beats workload container annotation",
+			pod:       newPod(map[string]string{ARCH_ANNOTATION: "s390x"}),
+			container: "app",
+			expected:  []string{"s390x"},
+		},
+		{
+			name: "pod container annotation beats pod-wide annotation",
+			pod: newPod(map[string]string{
+				ARCH_ANNOTATION:                   "s390x",
+				CONTAINER_ARCH_PREFIX + "sidecar": "amd64",
+			}),
+			container: "sidecar",
+			expected:  []string{"amd64"},
+		},
+		{
+			name:      "pod mode applies to pod annotations only",
+			pod:       newPod(map[string]string{ARCH_MODE_ANNOTATION: "override"}),
+			container: "sidecar",
+			allowed:   []string{"amd64", "arm64"},
+		},
+	}
+	for _, test := range tests {
+		resolver := newAnnotationResolver()
+		request := &ImageRequest{Pod: test.pod, Container: test.container, Image: "example.com/app:1.0"}
+		platforms, err := resolver.Resolve(&ctx, request)
+
+		if test.expected == nil {
+			if !errors.Is(err, ErrResolverDeclined) {
+				t.Errorf("%s: expected request to be narrowed, got %v", test.name, err)
+				continue
+			}
+			allowed := make([]string, 0, len(request.Allowed))
+			for _, platform := range request.Allowed {
+				allowed = append(allowed, platform.Architecture)
+			}
+			if !reflect.DeepEqual(allowed, test.allowed) {
+				t.Errorf("%s: expected request to be narrowed to %v, got %v", test.name, test.allowed, allowed)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+			continue
+		}
+		architectures := make([]string, 0, len(platforms))
+		for _, platform := range platforms {
+			architectures = append(architectures, platform.Architecture)
+		}
+		if !reflect.DeepEqual(architectures, test.expected) {
+			t.Errorf("%s: expected architectures %v, got %v", test.name, test.expected, architectures)
+		}
+	}
+}
+
+func TestAnnotationResolverInvalid(t *testing.T) {
+	ctx := newAnnotationContext()
+	ctx = context.WithValue(ctx, RESOLVER_CHAIN_KEY, ResolverChain{newAnnotationResolver()})
+	for _, annotations := range []map[string]string{
+		{CONTAINER_ARCH_PREFIX + "app": "a/b/c/d"},
+		{ARCH_ANNOTATION: "arm64", ARCH_MODE_ANNOTATION: "sometimes"},
+	} {
+		recorder := record.NewFakeRecorder(10)
+		ctx := context.WithValue(ctx, K8S_EVENT_RECORDER_KEY, recorder)
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default", Annotations: annotations},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{{Name: "app", Image: "example.com/app:1.0"}},
+			},
+		}
+
+		// Invalid annotations never resolve, so the pod is
+		// reported once and skipped rather than retried
+		if err := handlePod(&ctx, pod, fake.NewSimpleClientset(pod)); err != nil {
+			t.Errorf("expected pod with annotations %v to be skipped, got %v", annotations, err)
+		}
+		if len(recorder.Events) != 1 {
+			t.Fatalf("expected a single event for annotations %v, got %d", annotations, len(recorder.Events))
+		}
+		if event := <-recorder.Events; !strings.Contains(event, "InvalidArchitectureAnnotation") {
+			t.Errorf("unexpected event: %s", event)
+		}
+	}
+}
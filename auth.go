@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// registryAuth holds the credentials for a single registry, using
+// the same fields as an entry within a docker config file.
+type registryAuth struct {
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	Auth          string `json:"auth,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// dockerConfigJSON is the format of the .dockerconfigjson key within
+// a kubernetes.io/dockerconfigjson secret.
+type dockerConfigJSON struct {
+	Auths map[string]registryAuth `json:"auths"`
+}
+
+// Credentials returns the username and secret stored within the registryAuth.
+// If only an identity token is present, the username will be blank,
+// which containerd interprets as a refresh token.
+func (a registryAuth) Credentials() (string, string, error) {
+	if a.IdentityToken != "" {
+		return "", a.IdentityToken, nil
+	}
+	if a.Username != "" || a.Password != "" {
+		return a.Username, a.Password, nil
+	}
+	if a.Auth == "" {
+		return "", "", nil
+	}
+	decoded, err := base64.StdEncoding.DecodeString(a.Auth)
+	if err != nil {
+		return "", "", fmt.Errorf("unable to decode auth field: %w", err)
+	}
+	username, password, ok := strings.Cut(string(decoded), ":")
+	if !ok {
+		return "", "", fmt.Errorf("auth field is not in the form of username:password")
+	}
+	return username, password, nil
+}
+
+// cacheKey returns an identifier for the credentials, used to keep the
+// cached results of lookups made with different credentials apart.
+// Returns an empty string for anonymous access.
+func (a *registryAuth) cacheKey() string {
+	if a == nil {
+		return ""
+	}
+	encoded, _ := json.Marshal(a)
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// RegistryKeyring maps registry locations to the credentials that
+// can be used for images within said location.
+// Locations are a registry host, optionally followed by a path prefix,
+// in the same form the kubelet accepts within a docker config.
+type RegistryKeyring struct {
+	entries map[string][]registryAuth
+}
+
+// NewRegistryKeyring creates an empty RegistryKeyring.
+func NewRegistryKeyring() *RegistryKeyring {
+	return &RegistryKeyring{
+		entries: make(map[string][]registryAuth),
+	}
+}
+
+// normalizeRegistryLocation strips schemes and trailing slashes from
+// the given docker config key, and maps docker hub aliases onto docker.io.
+func normalizeRegistryLocation(location string) string {
+	if strings.Contains(location, "://") {
+		if parsed, err := url.Parse(location); err == nil {
+			location = parsed.Host + parsed.Path
+		}
+	}
+	location = strings.TrimSuffix(location, "/")
+
+	host, rest, _ := strings.Cut(location, "/")
+	switch host {
+	case "index.docker.io", "registry-1.docker.io", "registry.hub.docker.com":
+		host = "docker.io"
+		// The legacy docker hub location is https://index.docker.io/v1/
+		if rest == "v1" {
+			rest = ""
+		}
+	}
+	if rest == "" {
+		return host
+	}
+	return host + "/" + rest
+}
+
+// Add adds the given credentials for the given location.
+func (k *RegistryKeyring) Add(location string, auth registryAuth) {
+	location = normalizeRegistryLocation(location)
+	k.entries[location] = append(k.entries[location], auth)
+}
+
+// AddDockerConfigJSON adds each entry in the given dockerconfigjson
+// into the keyring.
+func (k *RegistryKeyring) AddDockerConfigJSON(data []byte) error {
+	var config dockerConfigJSON
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	for location, auth := range config.Auths {
+		k.Add(location, auth)
+	}
+	return nil
+}
+
+// AddDockerCfg adds each entry in the given legacy dockercfg
+// into the keyring.
+func (k *RegistryKeyring) AddDockerCfg(data []byte) error {
+	var config map[string]registryAuth
+	if err := json.Unmarshal(data, &config); err != nil {
+		return err
+	}
+	for location, auth := range config {
+		k.Add(location, auth)
+	}
+	return nil
+}
+
+// locationMatches determines if the given keyring location applies to the
+// given image host and path.
+// Hosts within the location can contain globs, such as *.registry.io,
+// following the kubelet's behavior.
+func locationMatches(location string, host string, repoPath string) bool {
+	locationHost, locationPath, _ := strings.Cut(location, "/")
+	if locationHost != host {
+		matched, err := path.Match(locationHost, host)
+		if err != nil || !matched {
+			return false
+		}
+	}
+	if locationPath == "" {
+		return true
+	}
+	return repoPath == locationPath || strings.HasPrefix(repoPath, locationPath+"/")
+}
+
+// Lookup returns the credentials that apply to the given image reference,
+// most specific location first.
+func (k *RegistryKeyring) Lookup(image string) []registryAuth {
+	if k == nil || len(k.entries) == 0 {
+		return nil
+	}
+	named, err := dockerref.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil
+	}
+	host := dockerref.Domain(named)
+	repoPath := dockerref.Path(named)
+
+	matches := make([]string, 0)
+	for location := range k.entries {
+		if locationMatches(location, host, repoPath) {
+			matches = append(matches, location)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if len(matches[i]) == len(matches[j]) {
+			return matches[i] < matches[j]
+		}
+		return len(matches[i]) > len(matches[j])
+	})
+
+	auths := make([]registryAuth, 0)
+	for _, location := range matches {
+		auths = append(auths, k.entries[location]...)
+	}
+	return auths
+}
+
+// getPodKeyring builds a RegistryKeyring from the pull secrets that
+// the kubelet would use for the given pod: the pod's own imagePullSecrets,
+// followed by the imagePullSecrets of the pod's service account.
+// Missing secrets are logged and skipped, same as the kubelet.
+func getPodKeyring(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface) (*RegistryKeyring, error) {
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("pod-name", pod.Name).
+			Str("namespace", pod.Namespace)
+	}
+
+	secretNames := make([]string, 0)
+	for _, ref := range pod.Spec.ImagePullSecrets {
+		secretNames = append(secretNames, ref.Name)
+	}
+
+	serviceAccountName := pod.Spec.ServiceAccountName
+	if serviceAccountName == "" {
+		serviceAccountName = "default"
+	}
+	serviceAccount, err := clientset.CoreV1().ServiceAccounts(pod.Namespace).Get(
+		*ctx,
+		serviceAccountName,
+		metav1.GetOptions{},
+	)
+	if err != nil {
+		if !k8serrors.IsNotFound(err) {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Str("service-account", serviceAccountName).
+				Msg("Unable to get service account for pod")
+			return nil, err
+		}
+		getLog(zerolog.DebugLevel).
+			Str("service-account", serviceAccountName).
+			Msg("Service account for pod not found, skipping its pull secrets")
+	} else {
+		for _, ref := range serviceAccount.ImagePullSecrets {
+			secretNames = append(secretNames, ref.Name)
+		}
+	}
+
+	keyring := NewRegistryKeyring()
+	secretClient := clientset.CoreV1().Secrets(pod.Namespace)
+	for _, secretName := range secretNames {
+		secret, err := secretClient.Get(*ctx, secretName, metav1.GetOptions{})
+		if err != nil {
+			if !k8serrors.IsNotFound(err) {
+				getLog(zerolog.WarnLevel).
+					AnErr("err", err).
+					Str("secret", secretName).
+					Msg("Unable to get pull secret for pod")
+				return nil, err
+			}
+			getLog(zerolog.WarnLevel).
+				Str("secret", secretName).
+				Msg("Pull secret for pod not found, skipping")
+			continue
+		}
+
+		switch secret.Type {
+		case v1.SecretTypeDockerConfigJson:
+			err = keyring.AddDockerConfigJSON(secret.Data[v1.DockerConfigJsonKey])
+		case v1.SecretTypeDockercfg:
+			err = keyring.AddDockerCfg(secret.Data[v1.DockerConfigKey])
+		default:
+			getLog(zerolog.WarnLevel).
+				Str("secret", secretName).
+				Str("type", string(secret.Type)).
+				Msg("Pull secret has unsupported type, skipping")
+			continue
+		}
+		if err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Str("secret", secretName).
+				Msg("Unable to decode pull secret, skipping")
+		}
+	}
+
+	return keyring, nil
+}
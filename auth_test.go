@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestRegistryAuthCredentials(t *testing.T) {
+	auth := registryAuth{
+		Auth: base64.StdEncoding.EncodeToString([]byte("user:pass:word")),
+	}
+	username, password, err := auth.Credentials()
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+	if username != "user" || password != "pass:word" {
+		t.Errorf("unexpected credentials %s, %s", username, password)
+	}
+
+	auth = registryAuth{IdentityToken: "token", Username: "user"}
+	username, password, err = auth.Credentials()
+	if err != nil || username != "" || password != "token" {
+		t.Errorf("expected identity token to be used as a refresh token")
+	}
+}
+
+func TestRegistryKeyringLookup(t *testing.T) {
+	keyring := NewRegistryKeyring()
+	err := keyring.AddDockerConfigJSON([]byte(`{
+		"auths": {
+			"https://index.docker.io/v1/": {"username": "hub"},
+			"registry.example.com": {"username": "registry"},
+			"registry.example.com/team": {"username": "team"},
+			"*.mirror.example.com": {"username": "mirror"}
+		}
+	}`))
+	if err != nil {
+		t.Error(err)
+		t.FailNow()
+	}
+
+	tests := map[string][]string{
+		"nginx":                                {"hub"},
+		"docker.io/library/nginx:latest":       {"hub"},
+		"registry.example.com/team/app:v1":     {"team", "registry"},
+		"registry.example.com/teammate/app:v1": {"registry"},
+		"eu.mirror.example.com/app":            {"mirror"},
+		"quay.io/team/app":                     {},
+	}
+	for image, expected := range tests {
+		auths := keyring.Lookup(image)
+		if len(auths) != len(expected) {
+			t.Errorf("expected %d credentials for %s, got %d", len(expected), image, len(auths))
+			continue
+		}
+		for i, auth := range auths {
+			if auth.Username != expected[i] {
+				t.Errorf("expected credential %d for %s to be %s, got %s", i, image, expected[i], auth.Username)
+			}
+		}
+	}
+}
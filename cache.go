@@ -0,0 +1,229 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"flag"
+	"sync"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// lruEntry is a single entry within an lruCache.
+type lruEntry[V any] struct {
+	key     string
+	value   V
+	expires time.Time
+}
+
+// lruCache is a size-bounded, thread-safe cache which evicts the least
+// recently used entry when full. Entries can optionally expire.
+type lruCache[V any] struct {
+	mu      sync.Mutex
+	size    int
+	entries *list.List
+	items   map[string]*list.Element
+	now     func() time.Time
+}
+
+// newLRUCache creates an lruCache holding at most size entries.
+func newLRUCache[V any](size int) *lruCache[V] {
+	return &lruCache[V]{
+		size:    size,
+		entries: list.New(),
+		items:   make(map[string]*list.Element),
+		now:     time.Now,
+	}
+}
+
+// Get returns the value stored under the given key, if it is present
+// and has not expired.
+func (c *lruCache[V]) Get(key string) (value V, ok bool) {
+	value, fresh, ok := c.GetStale(key)
+	if !ok || !fresh {
+		var empty V
+		return empty, false
+	}
+	return value, true
+}
+
+// GetStale returns the value stored under the given key, if it is present,
+// along with whether it has not expired. Expired entries are kept until
+// they are evicted or replaced, so they can be revalidated.
+func (c *lruCache[V]) GetStale(key string) (value V, fresh bool, ok bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	element, ok := c.items[key]
+	if !ok {
+		return value, false, false
+	}
+	entry := element.Value.(*lruEntry[V])
+	c.entries.MoveToFront(element)
+	fresh = entry.expires.IsZero() || !c.now().After(entry.expires)
+	return entry.value, fresh, true
+}
+
+// Add stores the given value under the given key, evicting the least
+// recently used entry if the cache is full.
+// A ttl of zero means the entry never expires.
+func (c *lruCache[V]) Add(key string, value V, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.size <= 0 {
+		return
+	}
+
+	var expires time.Time
+	if ttl > 0 {
+		expires = c.now().Add(ttl)
+	}
+
+	if element, ok := c.items[key]; ok {
+		entry := element.Value.(*lruEntry[V])
+		entry.value = value
+		entry.expires = expires
+		c.entries.MoveToFront(element)
+		return
+	}
+
+	c.items[key] = c.entries.PushFront(
+		&lruEntry[V]{key: key, value: value, expires: expires},
+	)
+	for c.entries.Len() > c.size {
+		oldest := c.entries.Back()
+		c.entries.Remove(oldest)
+		delete(c.items, oldest.Value.(*lruEntry[V]).key)
+	}
+}
+
+// Remove deletes the entry stored under the given key, if any.
+func (c *lruCache[V]) Remove(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if element, ok := c.items[key]; ok {
+		c.entries.Remove(element)
+		delete(c.items, key)
+	}
+}
+
+// ImageCache caches the platforms of images.
+// Platforms are cached by the image's digest for as long as the cache
+// has room, as digests are immutable. Tags are mapped onto digests for
+// a configurable TTL, since tags can be moved, after which the tag's
+// digest is kept so that the tag can be revalidated. Failed lookups are cached
+// for a shorter TTL, to avoid hammering registries for broken images.
+type ImageCache struct {
+	digests    *lruCache[[]ocispec.Platform]
+	tags       *lruCache[digest.Digest]
+	failures   *lruCache[error]
+	tagTTL     time.Duration
+	failureTTL time.Duration
+}
+
+// NewImageCache creates an ImageCache, where each layer holds at most size entries.
+func NewImageCache(size int, tagTTL time.Duration, failureTTL time.Duration) *ImageCache {
+	return &ImageCache{
+		digests:    newLRUCache[[]ocispec.Platform](size),
+		tags:       newLRUCache[digest.Digest](size),
+		failures:   newLRUCache[error](size),
+		tagTTL:     tagTTL,
+		failureTTL: failureTTL,
+	}
+}
+
+// GetDigest returns the cached platforms of the given image digest.
+func (c *ImageCache) GetDigest(dgst digest.Digest) ([]ocispec.Platform, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.digests.Get(dgst.String())
+}
+
+// AddDigest caches the platforms of the given image digest.
+func (c *ImageCache) AddDigest(dgst digest.Digest, platforms []ocispec.Platform) {
+	if c == nil {
+		return
+	}
+	c.digests.Add(dgst.String(), platforms, 0)
+}
+
+// GetTag returns the cached digest the given reference resolved to.
+func (c *ImageCache) GetTag(ref string) (digest.Digest, bool) {
+	if c == nil {
+		return "", false
+	}
+	return c.tags.Get(ref)
+}
+
+// GetStaleTag returns the digest the given reference last resolved to,
+// even if the tag is due to be resolved again, along with whether it is not.
+func (c *ImageCache) GetStaleTag(ref string) (dgst digest.Digest, fresh bool, ok bool) {
+	if c == nil {
+		return "", false, false
+	}
+	return c.tags.GetStale(ref)
+}
+
+// AddTag caches the digest the given reference resolved to.
+func (c *ImageCache) AddTag(ref string, dgst digest.Digest) {
+	if c == nil || c.tagTTL <= 0 {
+		return
+	}
+	c.tags.Add(ref, dgst, c.tagTTL)
+}
+
+// Get returns the cached platforms for the given reference, by first
+// resolving the reference to a digest through the tag cache.
+func (c *ImageCache) Get(ref string) ([]ocispec.Platform, bool) {
+	dgst, ok := c.GetTag(ref)
+	if !ok {
+		return nil, false
+	}
+	return c.GetDigest(dgst)
+}
+
+// GetFailure returns the cached error for a failed lookup of the given key.
+func (c *ImageCache) GetFailure(key string) (error, bool) {
+	if c == nil {
+		return nil, false
+	}
+	return c.failures.Get(key)
+}
+
+// AddFailure caches the error of a failed lookup for the given key.
+func (c *ImageCache) AddFailure(key string, err error) {
+	if c == nil || c.failureTTL <= 0 {
+		return
+	}
+	c.failures.Add(key, err, c.failureTTL)
+}
+
+// setupImageCache creates an ImageCache from the CLI
+// and stores it in the given context.
+func setupImageCache(ctx *context.Context) {
+	size := flag.Lookup("cache-size").Value.(flag.Getter).Get().(int)
+	tagTTL := flag.Lookup("cache-ttl").Value.(flag.Getter).Get().(time.Duration)
+	failureTTL := flag.Lookup("cache-failure-ttl").Value.(flag.Getter).Get().(time.Duration)
+
+	*ctx = context.WithValue(
+		*ctx,
+		IMAGE_CACHE_KEY,
+		NewImageCache(size, tagTTL, failureTTL),
+	)
+}
+
+// GetImageCache pulls the set ImageCache from the given context.
+// Returns nil if caching has not been setup, which ImageCache handles
+// as a cache which is always empty.
+func GetImageCache(ctx *context.Context) *ImageCache {
+	result := (*ctx).Value(IMAGE_CACHE_KEY)
+	if result == nil {
+		return nil
+	}
+	return result.(*ImageCache)
+}
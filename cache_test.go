@@ -0,0 +1,74 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+)
+
+func TestLRUCacheEviction(t *testing.T) {
+	cache := newLRUCache[int](2)
+	cache.Add("a", 1, 0)
+	cache.Add("b", 2, 0)
+	// Mark a as recently used, so b is evicted
+	if _, ok := cache.Get("a"); !ok {
+		t.Errorf("expected a to be cached")
+	}
+	cache.Add("c", 3, 0)
+
+	if _, ok := cache.Get("b"); ok {
+		t.Errorf("expected b to be evicted")
+	}
+	if value, ok := cache.Get("a"); !ok || value != 1 {
+		t.Errorf("expected a to still be cached")
+	}
+	if value, ok := cache.Get("c"); !ok || value != 3 {
+		t.Errorf("expected c to be cached")
+	}
+}
+
+func TestLRUCacheExpiration(t *testing.T) {
+	now := time.Now()
+	cache := newLRUCache[int](2)
+	cache.now = func() time.Time { return now }
+
+	cache.Add("a", 1, time.Minute)
+	cache.Add("b", 2, 0)
+
+	now = now.Add(time.Minute * time.Duration(2))
+	if _, ok := cache.Get("a"); ok {
+		t.Errorf("expected a to be expired")
+	}
+	if _, ok := cache.Get("b"); !ok {
+		t.Errorf("expected b to never expire")
+	}
+}
+
+func TestLRUCacheDisabled(t *testing.T) {
+	cache := newLRUCache[int](0)
+	cache.Add("a", 1, 0)
+	if _, ok := cache.Get("a"); ok {
+		t.Errorf("expected cache with size 0 to store nothing")
+	}
+}
+
+func TestImageCacheStaleTag(t *testing.T) {
+	now := time.Now()
+	cache := NewImageCache(2, time.Minute, 0)
+	cache.tags.now = func() time.Time { return now }
+
+	dgst := digest.FromString("image")
+	cache.AddTag("nginx:latest", dgst)
+	if _, fresh, ok := cache.GetStaleTag("nginx:latest"); !ok || !fresh {
+		t.Errorf("expected tag to be fresh")
+	}
+
+	now = now.Add(time.Minute * time.Duration(2))
+	if _, ok := cache.GetTag("nginx:latest"); ok {
+		t.Errorf("expected tag to be expired")
+	}
+	if stale, fresh, ok := cache.GetStaleTag("nginx:latest"); !ok || fresh || stale != dgst {
+		t.Errorf("expected expired tag to be kept for revalidation")
+	}
+}
@@ -0,0 +1,373 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+	"sigs.k8s.io/yaml"
+)
+
+// catalogFile is the format of an image catalog, which maps
+// image patterns onto the platforms they support.
+type catalogFile struct {
+	Images []struct {
+		// Match is either an image digest (sha256:...), an exact image
+		// reference, or a glob matched against fully-qualified image
+		// references (quay.io/myteam/*).
+		Match string `json:"match"`
+		// Platforms are specifiers in the form of arch, arch/variant,
+		// os/arch or os/arch/variant.
+		Platforms []string `json:"platforms"`
+	} `json:"images"`
+}
+
+// catalogEntry is a single parsed entry within an image catalog.
+type catalogEntry struct {
+	match     string
+	digest    digest.Digest
+	glob      bool
+	platforms []ocispec.Platform
+}
+
+// parseCatalog parses the given catalog file contents into catalog entries.
+func parseCatalog(data []byte) ([]catalogEntry, error) {
+	var file catalogFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	entries := make([]catalogEntry, 0, len(file.Images))
+	for i, image := range file.Images {
+		if image.Match == "" {
+			return nil, fmt.Errorf("catalog entry %d has no match", i)
+		}
+		platforms, err := parsePlatformList(strings.Join(image.Platforms, ","))
+		if err != nil {
+			return nil, fmt.Errorf("catalog entry %s: %w", image.Match, err)
+		}
+		entry := catalogEntry{
+			match:     image.Match,
+			platforms: platforms,
+		}
+
+		if dgst, err := digest.Parse(image.Match); err == nil {
+			entry.digest = dgst
+		} else if strings.ContainsAny(image.Match, "*?[") {
+			if _, err := path.Match(image.Match, ""); err != nil {
+				return nil, fmt.Errorf("catalog entry %s has an invalid glob: %w", image.Match, err)
+			}
+			entry.glob = true
+		} else {
+			named, err := dockerref.ParseNormalizedNamed(image.Match)
+			if err != nil {
+				return nil, fmt.Errorf("catalog entry %s has an invalid image reference: %w", image.Match, err)
+			}
+			entry.match = dockerref.TagNameOnly(named).String()
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// Catalog holds image catalogs loaded from each configured source,
+// which can be reloaded at any time.
+type Catalog struct {
+	mu      sync.RWMutex
+	sources []string
+	entries map[string][]catalogEntry
+}
+
+// NewCatalog creates an empty Catalog.
+func NewCatalog() *Catalog {
+	return &Catalog{
+		sources: make([]string, 0),
+		entries: make(map[string][]catalogEntry),
+	}
+}
+
+// Load replaces the entries of the given source with the parsed contents of data.
+func (c *Catalog) Load(source string, data []byte) error {
+	entries, err := parseCatalog(data)
+	if err != nil {
+		return err
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[source]; !ok {
+		c.sources = append(c.sources, source)
+	}
+	c.entries[source] = entries
+	return nil
+}
+
+// Remove drops the entries of the given source, if any.
+func (c *Catalog) Remove(source string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.entries[source]; !ok {
+		return
+	}
+	delete(c.entries, source)
+	for i, existing := range c.sources {
+		if existing == source {
+			// Sources are kept in order, as earlier sources take precedence
+			c.sources = append(c.sources[:i], c.sources[i+1:]...)
+			break
+		}
+	}
+}
+
+// Lookup finds the platforms of the given image reference.
+// The image's digest (given within the reference or already known) is matched
+// first, then exact references, then globs, each in the order of their sources.
+func (c *Catalog) Lookup(ref string, dgst digest.Digest) ([]ocispec.Platform, string, bool) {
+	name := ref
+	repository := ref
+	if named, err := dockerref.ParseNormalizedNamed(ref); err == nil {
+		if canonical, ok := named.(dockerref.Canonical); ok && dgst == "" {
+			dgst = canonical.Digest()
+		}
+		name = dockerref.TagNameOnly(named).String()
+		repository = named.Name()
+	}
+
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	matchers := []func(entry catalogEntry) bool{
+		func(entry catalogEntry) bool {
+			return dgst != "" && entry.digest == dgst
+		},
+		func(entry catalogEntry) bool {
+			return !entry.glob && entry.digest == "" && (entry.match == name || entry.match == ref)
+		},
+		func(entry catalogEntry) bool {
+			if !entry.glob {
+				return false
+			}
+			for _, candidate := range []string{ref, name, repository} {
+				if matched, _ := path.Match(entry.match, candidate); matched {
+					return true
+				}
+			}
+			return false
+		},
+	}
+	for _, matcher := range matchers {
+		for _, source := range c.sources {
+			for _, entry := range c.entries[source] {
+				if matcher(entry) {
+					return entry.platforms, entry.match, true
+				}
+			}
+		}
+	}
+	return nil, "", false
+}
+
+// watchCatalogFile loads the catalog at the given path, polling it for
+// changes until the context is done. ConfigMaps mounted as volumes are
+// updated by swapping symlinks, which polling handles transparently.
+func watchCatalogFile(ctx *context.Context, catalog *Catalog, filePath string) error {
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("catalog-file", filePath)
+	}
+
+	var loaded []byte
+	load := func() error {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if loaded != nil && bytes.Equal(data, loaded) {
+			return nil
+		}
+		if err := catalog.Load("file:"+filePath, data); err != nil {
+			return err
+		}
+		loaded = data
+		getLog(zerolog.InfoLevel).
+			Msg("Loaded image catalog")
+		return nil
+	}
+
+	if err := load(); err != nil {
+		getLog(zerolog.ErrorLevel).
+			AnErr("err", err).
+			Msg("Unable to load image catalog")
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(CATALOG_RELOAD_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-(*ctx).Done():
+				return
+			case <-ticker.C:
+				if err := load(); err != nil {
+					getLog(zerolog.WarnLevel).
+						AnErr("err", err).
+						Msg("Unable to reload image catalog, keeping previous catalog")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// watchCatalogConfigMap loads the catalog within the given ConfigMap,
+// given as namespace/name, watching it for changes until the context is done.
+func watchCatalogConfigMap(ctx *context.Context, catalog *Catalog, configMap string) error {
+	namespace, name, ok := strings.Cut(configMap, "/")
+	if !ok || namespace == "" || name == "" {
+		return fmt.Errorf("catalog configmap must be given as namespace/name: %s", configMap)
+	}
+
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("catalog-configmap", configMap)
+	}
+
+	load := func(cm *v1.ConfigMap) {
+		data, ok := cm.Data[CATALOG_CONFIGMAP_KEY]
+		if !ok {
+			getLog(zerolog.WarnLevel).
+				Str("key", CATALOG_CONFIGMAP_KEY).
+				Msg("Image catalog ConfigMap is missing catalog key, keeping previous catalog")
+			return
+		}
+		if err := catalog.Load("configmap:"+configMap, []byte(data)); err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to load image catalog, keeping previous catalog")
+			return
+		}
+		getLog(zerolog.InfoLevel).
+			Msg("Loaded image catalog")
+	}
+
+	configMapClient := GetK8sInterface(ctx).CoreV1().ConfigMaps(namespace)
+	listOptions := metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	}
+
+	go func() {
+		for {
+			cmWatch, err := configMapClient.Watch(*ctx, listOptions)
+			if err != nil {
+				getLog(zerolog.WarnLevel).
+					AnErr("err", err).
+					Msg("Unable to watch image catalog ConfigMap, retrying")
+			} else {
+			watchLoop:
+				for {
+					select {
+					case <-(*ctx).Done():
+						cmWatch.Stop()
+						return
+					case event, ok := <-cmWatch.ResultChan():
+						if !ok {
+							break watchLoop
+						}
+						cm, isConfigMap := event.Object.(*v1.ConfigMap)
+						if !isConfigMap {
+							continue
+						}
+						if event.Type == watch.Deleted {
+							catalog.Remove("configmap:" + configMap)
+							getLog(zerolog.WarnLevel).
+								Msg("Image catalog ConfigMap deleted, dropping its catalog")
+							continue
+						}
+						load(cm)
+					}
+				}
+			}
+
+			select {
+			case <-(*ctx).Done():
+				return
+			case <-time.After(CATALOG_RELOAD_INTERVAL):
+			}
+		}
+	}()
+	return nil
+}
+
+// catalogResolver answers using an image catalog loaded from a file or
+// ConfigMap, without contacting any registry. Declines unknown images.
+type catalogResolver struct {
+	catalog *Catalog
+}
+
+// newCatalogResolver creates a catalogResolver from the CLI, starting
+// to watch the configured catalog sources for changes.
+func newCatalogResolver(ctx *context.Context) (*catalogResolver, error) {
+	catalog := NewCatalog()
+
+	if filePath := flag.Lookup("catalog-file").Value.String(); filePath != "" {
+		if err := watchCatalogFile(ctx, catalog, filePath); err != nil {
+			return nil, err
+		}
+	}
+	if configMap := flag.Lookup("catalog-configmap").Value.String(); configMap != "" {
+		if err := watchCatalogConfigMap(ctx, catalog, configMap); err != nil {
+			return nil, err
+		}
+	}
+	return &catalogResolver{catalog: catalog}, nil
+}
+
+func (r *catalogResolver) Name() string {
+	return "catalog"
+}
+
+func (r *catalogResolver) Resolve(ctx *context.Context, request *ImageRequest) ([]ocispec.Platform, error) {
+	var allowed []ocispec.Platform
+	var match string
+	var ok bool
+	for _, ref := range request.references() {
+		// Tags the cache already knows the digest of can match digest entries
+		dgst, _ := GetImageCache(ctx).GetTag(ref)
+		if allowed, match, ok = r.catalog.Lookup(ref, dgst); ok {
+			break
+		}
+	}
+	if !ok {
+		return nil, ErrResolverDeclined
+	}
+
+	log.Debug().
+		Str("container-image", request.Image).
+		Str("catalog-match", match).
+		Msg("Found image within catalog")
+
+	platforms := make([]ocispec.Platform, 0, len(allowed))
+	for _, platform := range allowed {
+		if platform.OS == "" {
+			platform.OS = getPodOS(request.Pod)
+		}
+		platforms = append(platforms, normalizePlatform(platform))
+	}
+	return platforms, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const catalogTestDigest = "sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac"
+
+// expectLookup looks the given reference up within the given
+// catalog, expecting it to match the given catalog entry.
+func expectLookup(t *testing.T, catalog *Catalog, ref string, expected string) {
+	t.Helper()
+	_, match, ok := catalog.Lookup(ref, "")
+	if expected == "" {
+		if ok {
+			t.Errorf("expected %s not to be found, matched %s", ref, match)
+		}
+		return
+	}
+	if !ok || match != expected {
+		t.Errorf("expected %s to match %s, got %q", ref, expected, match)
+	}
+}
+
+func TestCatalogLookup(t *testing.T) {
+	catalog := NewCatalog()
+	if err := catalog.Load("test", []byte(`
+images:
+- match: quay.io/team/*
+  platforms: [amd64]
+- match: quay.io/team/app:1.0
+  platforms: [arm64]
+- match: `+catalogTestDigest+`
+  platforms: [s390x]
+- match: nginx
+  platforms: [ppc64le]
+`)); err != nil {
+		t.Fatal(err)
+	}
+
+	// Digests match first, then exact references, then globs,
+	// regardless of their order within the catalog
+	expectLookup(t, catalog, "quay.io/team/app:1.0@"+catalogTestDigest, catalogTestDigest)
+	expectLookup(t, catalog, "quay.io/team/app:1.0", "quay.io/team/app:1.0")
+	expectLookup(t, catalog, "quay.io/team/app:2.0", "quay.io/team/*")
+	expectLookup(t, catalog, "quay.io/other/app:1.0", "")
+
+	// Exact references are normalized
+	expectLookup(t, catalog, "docker.io/library/nginx:latest", "docker.io/library/nginx:latest")
+
+	// An already known digest of a tag matches digest entries
+	if _, match, ok := catalog.Lookup("quay.io/team/app:1.0", catalogTestDigest); !ok || match != catalogTestDigest {
+		t.Errorf("expected known digest to match %s, got %q", catalogTestDigest, match)
+	}
+
+	// Reloading a source replaces its entries
+	if err := catalog.Load("test", []byte(`
+images:
+- match: quay.io/team/app:2.0
+  platforms: [arm64]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	expectLookup(t, catalog, "quay.io/team/app:1.0", "")
+	expectLookup(t, catalog, "quay.io/team/app:2.0", "quay.io/team/app:2.0")
+
+	// Invalid catalogs are rejected, keeping the previous entries
+	if err := catalog.Load("test", []byte(`
+images:
+- match: quay.io/team/app:3.0
+  platforms: [a/b/c/d]
+`)); err == nil {
+		t.Errorf("expected invalid catalog to be rejected")
+	}
+	expectLookup(t, catalog, "quay.io/team/app:2.0", "quay.io/team/app:2.0")
+}
+
+func TestCatalogSources(t *testing.T) {
+	filePath := filepath.Join(t.TempDir(), "catalog.yaml")
+	if err := os.WriteFile(filePath, []byte(`
+images:
+- match: example.com/*
+  platforms: [amd64]
+- match: example.com/app:1.0
+  platforms: [amd64]
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "catalog", Namespace: "kube-system"},
+		Data: map[string]string{
+			CATALOG_CONFIGMAP_KEY: `
+images:
+- match: example.com/app:1.0
+  platforms: [arm64]
+- match: example.com/other:1.0
+  platforms: [arm64]
+- match: ` + catalogTestDigest + `
+  platforms: [arm64]
+`,
+		},
+	}
+
+	clientset := fake.NewSimpleClientset()
+	watcher := watch.NewFake()
+	clientset.PrependWatchReactor("configmaps", k8stesting.DefaultWatchReactor(watcher, nil))
+	ctx, cancel := context.WithCancel(context.WithValue(context.Background(), K8S_INTERFACE_KEY, clientset))
+	defer cancel()
+
+	catalog := NewCatalog()
+	if err := watchCatalogFile(&ctx, catalog, filePath); err != nil {
+		t.Fatal(err)
+	}
+	if err := watchCatalogConfigMap(&ctx, catalog, "kube-system/catalog"); err != nil {
+		t.Fatal(err)
+	}
+	// The fake watcher blocks until the event is received
+	watcher.Add(configMap)
+
+	waitFor := func(ref string, expected string) {
+		t.Helper()
+		deadline := time.Now().Add(time.Second)
+		for time.Now().Before(deadline) {
+			if _, match, ok := catalog.Lookup(ref, ""); ok == (expected != "") && match == expected {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		expectLookup(t, catalog, ref, expected)
+	}
+
+	// The file comes first, so its exact entries take precedence over the
+	// ConfigMap's, while the ConfigMap's exact entries still beat its globs
+	waitFor("example.com/other:1.0", "example.com/other:1.0")
+	expectLookup(t, catalog, "example.com/app:1.0", "example.com/app:1.0")
+	if platforms, _, _ := catalog.Lookup("example.com/app:1.0", ""); len(platforms) != 1 || platforms[0].Architecture != "amd64" {
+		t.Errorf("expected file entry to take precedence, got %s", formatPlatforms(platforms))
+	}
+	expectLookup(t, catalog, "example.com/app:1.0@"+catalogTestDigest, catalogTestDigest)
+	expectLookup(t, catalog, "example.com/unknown:1.0", "example.com/*")
+
+	// Deleting the ConfigMap drops its entries, leaving the file's
+	watcher.Delete(configMap)
+	waitFor("example.com/other:1.0", "example.com/*")
+	expectLookup(t, catalog, "example.com/app:1.0@"+catalogTestDigest, "example.com/*")
+}
@@ -47,7 +47,7 @@ func Clean(ctx *context.Context, stop context.CancelFunc) {
 			for {
 				done := true
 				for i, toleration := range result.Spec.Tolerations {
-					if toleration.Key == ARCH_TAINT_KEY_NAME {
+					if toleration.Key == ARCH_TAINT_KEY_NAME || toleration.Key == OS_TAINT_KEY_NAME {
 						done = false
 						RemoveFromSlice(&result.Spec.Tolerations, i)
 						break
@@ -97,7 +97,7 @@ func Clean(ctx *context.Context, stop context.CancelFunc) {
 			for {
 				done := true
 				for i, taint := range result.Spec.Taints {
-					if taint.Key == ARCH_TAINT_KEY_NAME {
+					if taint.Key == ARCH_TAINT_KEY_NAME || taint.Key == OS_TAINT_KEY_NAME {
 						done = false
 						RemoveFromSlice(&result.Spec.Taints, i)
 						break
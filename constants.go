@@ -7,12 +7,53 @@ import (
 type ContextKey string
 
 const (
-	OPERATOR_NAME           string        = "archaware"
-	VERSION                 string        = "v0.1.0"
-	RECONCILIATION_INTERVAL time.Duration = time.Minute * time.Duration(5)
-	ARCH_TAINT_KEY_NAME     string        = "supported-arch"
-	K8S_KUBECONFIG_PATH_KEY ContextKey    = "kubeconfig"
-	K8S_CONFIG_KEY          ContextKey    = "k8sconfig"
-	K8S_INTERFACE_KEY       ContextKey    = "k8sclientset"
-	MAX_RETRY_ATTEMPTS      int           = 5
+	OPERATOR_NAME                    string        = "archaware"
+	VERSION                          string        = "v0.1.0"
+	RECONCILIATION_INTERVAL          time.Duration = time.Minute * time.Duration(5)
+	ARCH_TAINT_KEY_NAME              string        = "supported-arch"
+	OS_TAINT_KEY_NAME                string        = "supported-os"
+	K8S_KUBECONFIG_PATH_KEY          ContextKey    = "kubeconfig"
+	K8S_CONFIG_KEY                   ContextKey    = "k8sconfig"
+	K8S_INTERFACE_KEY                ContextKey    = "k8sclientset"
+	K8S_EVENT_RECORDER_KEY           ContextKey    = "k8seventrecorder"
+	PLATFORM_CONFIG_KEY              ContextKey    = "platformconfig"
+	IMAGE_CACHE_KEY                  ContextKey    = "imagecache"
+	REGISTRY_CLIENT_KEY              ContextKey    = "registryclient"
+	RESOLVER_CHAIN_KEY               ContextKey    = "resolverchain"
+	REGISTRIES_CONFIG_KEY            ContextKey    = "registriesconfig"
+	CREDENTIAL_PROVIDERS_KEY         ContextKey    = "credentialproviders"
+	CONTROLLER_CREDENTIALS_KEY       ContextKey    = "controllercredentials"
+	REGISTRY_POLICY_KEY              ContextKey    = "registrypolicy"
+	PLACEMENT_MODE_KEY               ContextKey    = "placementmode"
+	SCHEDULING_GATE_POLICY_KEY       ContextKey    = "schedulinggatepolicy"
+	ADMISSION_WEBHOOK_KEY            ContextKey    = "admissionwebhook"
+	MAX_RETRY_ATTEMPTS               int           = 5
+	REGISTRY_RESOLVER_CACHE_SIZE     int           = 1000
+	ARCH_ANNOTATION                  string        = "archaware.io/architectures"
+	ARCH_MODE_ANNOTATION             string        = "archaware.io/architectures-mode"
+	CONTAINER_ARCH_PREFIX            string        = "architectures.archaware.io/"
+	ANNOTATION_CACHE_TTL             time.Duration = time.Minute
+	MAX_OWNER_DEPTH                  int           = 5
+	CATALOG_RELOAD_INTERVAL          time.Duration = time.Second * time.Duration(10)
+	CATALOG_CONFIGMAP_KEY            string        = "catalog.yaml"
+	RATE_LIMIT_PAUSE                 time.Duration = time.Minute
+	MAX_INDEX_DEPTH                  int           = 3
+	CREDENTIAL_PROVIDER_TIMEOUT      time.Duration = time.Minute
+	CREDENTIAL_PROVIDER_CACHE_SIZE   int           = 1000
+	CREDENTIAL_HELPER_CACHE_TTL      time.Duration = time.Minute * time.Duration(5)
+	CREDENTIALS_RELOAD_INTERVAL      time.Duration = time.Second * time.Duration(10)
+	DEFAULT_MAX_MANIFEST_SIZE        int64         = 4 * 1024 * 1024
+	DEFAULT_MAX_CONFIG_SIZE          int64         = 8 * 1024 * 1024
+	DEFAULT_REGISTRY_REQUEST_TIMEOUT time.Duration = time.Second * time.Duration(30)
+	MAX_REGISTRY_REDIRECTS           int           = 10
+	MAX_ADMISSION_REVIEW_SIZE        int64         = 3 * 1024 * 1024
+	WEBHOOK_CA_VALIDITY              time.Duration = time.Hour * time.Duration(24*365*2)
+	WEBHOOK_CERT_VALIDITY            time.Duration = time.Hour * time.Duration(24*90)
+	WEBHOOK_CERT_BACKDATE            time.Duration = time.Minute * time.Duration(5)
+	WEBHOOK_CERT_CHECK_INTERVAL      time.Duration = time.Hour
+	SCHEDULING_GATE_NAME             string        = "archaware.io/resolving"
+	DEFAULT_SCHEDULING_GATE_TIMEOUT  time.Duration = time.Minute * time.Duration(5)
+	WORKLOAD_DIGESTS_ANNOTATION      string        = "archaware.io/image-digests"
+	WORKLOAD_AFFINITY_ANNOTATION     string        = "archaware.io/node-affinity"
+	WORKLOAD_WATCH_RETRY_INTERVAL    time.Duration = time.Second * time.Duration(10)
 )
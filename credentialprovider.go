@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// credentialProviderConfig is the kubelet's CredentialProviderConfig
+// (kubelet.config.k8s.io), which configures credential provider plugins.
+type credentialProviderConfig struct {
+	metav1.TypeMeta `json:",inline"`
+	Providers       []credentialProviderSpec `json:"providers"`
+}
+
+// credentialProviderSpec configures a single credential provider plugin.
+type credentialProviderSpec struct {
+	// Name is the name of the plugin's binary within the plugin directory.
+	Name string `json:"name"`
+	// MatchImages are matched against images to determine if the
+	// plugin provides credentials for them, such as *.registry.io.
+	MatchImages []string `json:"matchImages"`
+	// DefaultCacheDuration is how long credentials are cached for
+	// when the plugin's response does not say.
+	DefaultCacheDuration *metav1.Duration `json:"defaultCacheDuration,omitempty"`
+	// APIVersion is the version of CredentialProviderRequest and
+	// CredentialProviderResponse the plugin speaks.
+	APIVersion string                     `json:"apiVersion"`
+	Args       []string                   `json:"args,omitempty"`
+	Env        []credentialProviderEnvVar `json:"env,omitempty"`
+}
+
+type credentialProviderEnvVar struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// credentialProviderRequest is written to a plugin's stdin.
+type credentialProviderRequest struct {
+	metav1.TypeMeta `json:",inline"`
+	Image           string `json:"image"`
+}
+
+// credentialProviderResponse is read from a plugin's stdout.
+type credentialProviderResponse struct {
+	metav1.TypeMeta `json:",inline"`
+	// CacheKeyType is one of Image, Registry or Global, determining
+	// which images the returned credentials are cached for.
+	CacheKeyType  string                                  `json:"cacheKeyType"`
+	CacheDuration *metav1.Duration                        `json:"cacheDuration,omitempty"`
+	Auth          map[string]credentialProviderAuthConfig `json:"auth,omitempty"`
+}
+
+type credentialProviderAuthConfig struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// supportedCredentialProviderAPIVersions are the versions of the credential
+// provider exec protocol, all of which share the same format.
+var supportedCredentialProviderAPIVersions = []string{
+	"credentialprovider.kubelet.k8s.io/v1",
+	"credentialprovider.kubelet.k8s.io/v1beta1",
+	"credentialprovider.kubelet.k8s.io/v1alpha1",
+}
+
+// credentialProvider executes a kubelet credential provider plugin,
+// caching the credentials it returns.
+type credentialProvider struct {
+	spec     credentialProviderSpec
+	path     string
+	cache    *lruCache[*RegistryKeyring]
+	requests singleflight.Group
+}
+
+// cacheKeys returns the keys credentials for the given image may be
+// cached under, for each of the plugin's cache key types.
+func cacheKeys(image string) map[string]string {
+	keys := map[string]string{
+		"Image":  "image:" + image,
+		"Global": "global",
+	}
+	if named, err := dockerref.ParseNormalizedNamed(image); err == nil {
+		keys["Registry"] = "registry:" + dockerref.Domain(named)
+	}
+	return keys
+}
+
+// splitHostLabels splits the given host into its domain labels and port.
+func splitHostLabels(host string) ([]string, string) {
+	hostname, port, err := net.SplitHostPort(host)
+	if err != nil {
+		hostname, port = host, ""
+	}
+	return strings.Split(hostname, "."), port
+}
+
+// imageMatches determines if the given matchImages entry applies to the given
+// image host and path, the same way as the kubelet. Globs within the entry's
+// host match a single domain label each, so *.registry.io matches
+// eu.registry.io, but neither registry.io nor a.b.registry.io. Ports must be
+// equal, and the entry's path, if any, must be a prefix of the image's path.
+func imageMatches(match string, host string, repoPath string) bool {
+	matchHost, matchPath, _ := strings.Cut(match, "/")
+	matchLabels, matchPort := splitHostLabels(matchHost)
+	labels, port := splitHostLabels(host)
+	if matchPort != port || len(matchLabels) != len(labels) {
+		return false
+	}
+	if !strings.HasPrefix(repoPath, matchPath) {
+		return false
+	}
+	for i, matchLabel := range matchLabels {
+		matched, err := path.Match(matchLabel, labels[i])
+		if err != nil || !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matches determines if the plugin provides credentials for the given image.
+func (p *credentialProvider) matches(image string) bool {
+	named, err := dockerref.ParseNormalizedNamed(image)
+	if err != nil {
+		return false
+	}
+	for _, match := range p.spec.MatchImages {
+		if imageMatches(normalizeRegistryLocation(match), dockerref.Domain(named), dockerref.Path(named)) {
+			return true
+		}
+	}
+	return false
+}
+
+// exec runs the plugin for the given image, returning its parsed response.
+func (p *credentialProvider) exec(ctx *context.Context, image string) (*credentialProviderResponse, error) {
+	request, err := json.Marshal(
+		credentialProviderRequest{
+			TypeMeta: metav1.TypeMeta{
+				APIVersion: p.spec.APIVersion,
+				Kind:       "CredentialProviderRequest",
+			},
+			Image: image,
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	execCtx, cancel := context.WithTimeout(*ctx, CREDENTIAL_PROVIDER_TIMEOUT)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(execCtx, p.path, p.spec.Args...)
+	cmd.Env = os.Environ()
+	for _, env := range p.spec.Env {
+		cmd.Env = append(cmd.Env, env.Name+"="+env.Value)
+	}
+	cmd.Stdin = bytes.NewReader(request)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("credential provider %s failed: %w: %s", p.spec.Name, err, strings.TrimSpace(stderr.String()))
+	}
+
+	var response credentialProviderResponse
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("unable to parse response of credential provider %s: %w", p.spec.Name, err)
+	}
+	if response.Kind != "CredentialProviderResponse" || response.APIVersion != p.spec.APIVersion {
+		return nil, fmt.Errorf(
+			"credential provider %s responded with %s %s, expected %s CredentialProviderResponse",
+			p.spec.Name, response.APIVersion, response.Kind, p.spec.APIVersion,
+		)
+	}
+	return &response, nil
+}
+
+// Lookup returns the credentials the plugin provides for the given image.
+func (p *credentialProvider) Lookup(ctx *context.Context, image string) ([]registryAuth, error) {
+	keys := cacheKeys(image)
+	for _, keyType := range []string{"Image", "Registry", "Global"} {
+		if keyring, ok := p.cache.Get(keys[keyType]); ok {
+			return keyring.Lookup(image), nil
+		}
+	}
+
+	result, err, _ := DoShared(ctx, &p.requests, image, func(ctx *context.Context) (interface{}, error) {
+		response, err := p.exec(ctx, image)
+		if err != nil {
+			return nil, err
+		}
+
+		keyring := NewRegistryKeyring()
+		for location, auth := range response.Auth {
+			keyring.Add(location, registryAuth{Username: auth.Username, Password: auth.Password})
+		}
+
+		cacheDuration := time.Duration(0)
+		if p.spec.DefaultCacheDuration != nil {
+			cacheDuration = p.spec.DefaultCacheDuration.Duration
+		}
+		if response.CacheDuration != nil {
+			cacheDuration = response.CacheDuration.Duration
+		}
+		if key, ok := keys[response.CacheKeyType]; ok && cacheDuration > 0 {
+			p.cache.Add(key, keyring, cacheDuration)
+		}
+		return keyring, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return result.(*RegistryKeyring).Lookup(image), nil
+}
+
+// CredentialProviders provides registry credentials through kubelet credential
+// provider plugins, so the controller authenticates the same way as nodes.
+type CredentialProviders []*credentialProvider
+
+// parseCredentialProviderConfig parses the given CredentialProviderConfig,
+// whose plugins are found within the given directory.
+func parseCredentialProviderConfig(data []byte, binDir string) (CredentialProviders, error) {
+	var config credentialProviderConfig
+	if err := yaml.UnmarshalStrict(data, &config); err != nil {
+		return nil, err
+	}
+	if config.Kind != "CredentialProviderConfig" || !strings.HasPrefix(config.APIVersion, "kubelet.config.k8s.io/") {
+		return nil, fmt.Errorf("expected a kubelet.config.k8s.io CredentialProviderConfig, got %s %s", config.APIVersion, config.Kind)
+	}
+
+	providers := make(CredentialProviders, 0, len(config.Providers))
+	for _, spec := range config.Providers {
+		if spec.Name == "" || strings.ContainsAny(spec.Name, "/\\") || spec.Name == "." || spec.Name == ".." {
+			return nil, fmt.Errorf("invalid credential provider name: %q", spec.Name)
+		}
+		if len(spec.MatchImages) == 0 {
+			return nil, fmt.Errorf("credential provider %s has no matchImages", spec.Name)
+		}
+		supported := false
+		for _, apiVersion := range supportedCredentialProviderAPIVersions {
+			supported = supported || spec.APIVersion == apiVersion
+		}
+		if !supported {
+			return nil, fmt.Errorf("credential provider %s has unsupported apiVersion %q", spec.Name, spec.APIVersion)
+		}
+		providers = append(
+			providers,
+			&credentialProvider{
+				spec:  spec,
+				path:  filepath.Join(binDir, spec.Name),
+				cache: newLRUCache[*RegistryKeyring](CREDENTIAL_PROVIDER_CACHE_SIZE),
+			},
+		)
+	}
+	return providers, nil
+}
+
+// Lookup returns the credentials provided by each plugin matching the given image.
+// Plugins which fail are logged and skipped, same as the kubelet.
+func (c CredentialProviders) Lookup(ctx *context.Context, image string) []registryAuth {
+	auths := make([]registryAuth, 0)
+	for _, provider := range c {
+		if !provider.matches(image) {
+			continue
+		}
+		providerAuths, err := provider.Lookup(ctx, image)
+		if err != nil {
+			log.WithLevel(zerolog.WarnLevel).
+				Str("credential-provider", provider.spec.Name).
+				Str("ref", image).
+				AnErr("err", err).
+				Msg("Unable to get credentials from credential provider")
+			continue
+		}
+		auths = append(auths, providerAuths...)
+	}
+	return auths
+}
+
+// setupCredentialProviders loads the credential provider config given
+// on the CLI, if any, and stores the configured plugins in the given context.
+func setupCredentialProviders(ctx *context.Context) error {
+	configPath := flag.Lookup("image-credential-provider-config").Value.String()
+	if configPath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+	providers, err := parseCredentialProviderConfig(
+		data,
+		flag.Lookup("image-credential-provider-bin-dir").Value.String(),
+	)
+	if err != nil {
+		return fmt.Errorf("unable to parse credential provider config %s: %w", configPath, err)
+	}
+	*ctx = context.WithValue(*ctx, CREDENTIAL_PROVIDERS_KEY, providers)
+	return nil
+}
+
+// GetCredentialProviders pulls the set CredentialProviders from the given context.
+// Returns nil if none have been set, which provides no credentials.
+func GetCredentialProviders(ctx *context.Context) CredentialProviders {
+	result := (*ctx).Value(CREDENTIAL_PROVIDERS_KEY)
+	if result == nil {
+		return nil
+	}
+	return result.(CredentialProviders)
+}
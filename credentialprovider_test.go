@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// writeCredentialProvider writes a stub credential provider plugin which
+// records each request it receives and responds with the given response.
+func writeCredentialProvider(t *testing.T, dir string, name string, response string) string {
+	requests := filepath.Join(dir, name+".requests")
+	script := "#!/bin/sh\ncat >> " + requests + "\necho >> " + requests + "\ncat <<'EOF'\n" + response + "\nEOF\n"
+	if err := os.WriteFile(filepath.Join(dir, name), []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	return requests
+}
+
+func TestCredentialProviders(t *testing.T) {
+	dir := t.TempDir()
+	requests := writeCredentialProvider(t, dir, "registry-login", `{
+  "apiVersion": "credentialprovider.kubelet.k8s.io/v1",
+  "kind": "CredentialProviderResponse",
+  "cacheKeyType": "Registry",
+  "cacheDuration": "1h",
+  "auth": {"*.registry.internal": {"username": "user", "password": "token"}}
+}`)
+	writeCredentialProvider(t, dir, "broken", `{"kind": "Unexpected"}`)
+
+	providers, err := parseCredentialProviderConfig([]byte(`
+apiVersion: kubelet.config.k8s.io/v1
+kind: CredentialProviderConfig
+providers:
+- name: registry-login
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["*.registry.internal"]
+  defaultCacheDuration: 10m
+- name: broken
+  apiVersion: credentialprovider.kubelet.k8s.io/v1
+  matchImages: ["eu.registry.internal"]
+`), dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx := context.Background()
+	expected := []registryAuth{{Username: "user", Password: "token"}}
+	for _, image := range []string{"eu.registry.internal/app:1.0", "eu.registry.internal/other:2.0"} {
+		if auths := providers.Lookup(&ctx, image); !reflect.DeepEqual(auths, expected) {
+			t.Errorf("unexpected credentials for %s: %v, expected %v", image, auths, expected)
+		}
+	}
+	if auths := providers.Lookup(&ctx, "docker.io/library/nginx:latest"); len(auths) != 0 {
+		t.Errorf("expected no credentials for unmatched image, got %v", auths)
+	}
+
+	// Credentials are cached for the whole registry, so the plugin only runs once
+	data, err := os.ReadFile(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(string(data)), "\n"); len(lines) != 1 ||
+		!strings.Contains(lines[0], `"image":"eu.registry.internal/app:1.0"`) ||
+		!strings.Contains(lines[0], `"kind":"CredentialProviderRequest"`) {
+		t.Errorf("unexpected requests to credential provider: %s", data)
+	}
+}
+
+func TestCredentialProviderMatches(t *testing.T) {
+	tests := []struct {
+		match    string
+		image    string
+		expected bool
+	}{
+		{"*.registry.io", "eu.registry.io/app:1.0", true},
+		{"*.registry.io", "a.b.registry.io/app:1.0", false},
+		{"*.registry.io", "registry.io/app:1.0", false},
+		{"*.*.registry.io", "a.b.registry.io/app:1.0", true},
+		{"registry.io:5000", "registry.io:5000/app:1.0", true},
+		{"registry.io:5000", "registry.io/app:1.0", false},
+		{"registry.io", "registry.io:5000/app:1.0", false},
+		{"registry.io/team", "registry.io/team/app:1.0", true},
+		{"registry.io/team", "registry.io/other/app:1.0", false},
+		{"https://registry.io/team/", "registry.io/team/app:1.0", true},
+		{"docker.io", "nginx", true},
+	}
+	for _, test := range tests {
+		provider := &credentialProvider{spec: credentialProviderSpec{MatchImages: []string{test.match}}}
+		if matched := provider.matches(test.image); matched != test.expected {
+			t.Errorf("expected %s matching %s to be %t", test.match, test.image, test.expected)
+		}
+	}
+}
+
+func TestParseCredentialProviderConfig(t *testing.T) {
+	invalid := []string{
+		`{"apiVersion": "v1", "kind": "ConfigMap"}`,
+		`{"apiVersion": "kubelet.config.k8s.io/v1", "kind": "CredentialProviderConfig",
+		  "providers": [{"name": "../plugin", "apiVersion": "credentialprovider.kubelet.k8s.io/v1", "matchImages": ["*"]}]}`,
+		`{"apiVersion": "kubelet.config.k8s.io/v1", "kind": "CredentialProviderConfig",
+		  "providers": [{"name": "plugin", "apiVersion": "credentialprovider.kubelet.k8s.io/v1"}]}`,
+		`{"apiVersion": "kubelet.config.k8s.io/v1", "kind": "CredentialProviderConfig",
+		  "providers": [{"name": "plugin", "apiVersion": "v1", "matchImages": ["*"]}]}`,
+	}
+	for _, config := range invalid {
+		if _, err := parseCredentialProviderConfig([]byte(config), "/plugins"); err == nil {
+			t.Errorf("expected config to be invalid: %s", config)
+		}
+	}
+}
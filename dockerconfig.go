@@ -0,0 +1,377 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+// dockerConfigFile is the format of a docker config.json, as written by
+// `docker login` and `podman login`. Fields besides credentials are ignored.
+type dockerConfigFile struct {
+	Auths map[string]registryAuth `json:"auths"`
+	// CredHelpers maps registry hosts onto the credential helper
+	// (docker-credential-<name>) holding their credentials.
+	CredHelpers map[string]string `json:"credHelpers,omitempty"`
+	// CredsStore is the credential helper used for registries
+	// without an entry in CredHelpers.
+	CredsStore string `json:"credsStore,omitempty"`
+}
+
+// credentialHelperNotFound is output by credential helpers when
+// they hold no credentials for the requested registry.
+const credentialHelperNotFound = "credentials not found in native keychain"
+
+// dockerCredentials are the credentials loaded from a single docker config.
+type dockerCredentials struct {
+	keyring     *RegistryKeyring
+	credHelpers map[string]string
+	credsStore  string
+}
+
+// parseDockerConfig parses the given docker config.json.
+func parseDockerConfig(data []byte) (*dockerCredentials, error) {
+	var config dockerConfigFile
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, err
+	}
+
+	credentials := &dockerCredentials{
+		keyring:     NewRegistryKeyring(),
+		credHelpers: make(map[string]string),
+		credsStore:  config.CredsStore,
+	}
+	for location, auth := range config.Auths {
+		// Registries whose credentials are within a helper are
+		// listed with an empty entry
+		if auth == (registryAuth{}) {
+			continue
+		}
+		credentials.keyring.Add(location, auth)
+	}
+	for location, helper := range config.CredHelpers {
+		host, _, _ := strings.Cut(normalizeRegistryLocation(location), "/")
+		credentials.credHelpers[host] = helper
+	}
+	return credentials, nil
+}
+
+// parseDockerConfigSecret parses the docker config held by the given
+// image pull secret.
+func parseDockerConfigSecret(secret *v1.Secret) (*dockerCredentials, error) {
+	switch secret.Type {
+	case v1.SecretTypeDockerConfigJson:
+		return parseDockerConfig(secret.Data[v1.DockerConfigJsonKey])
+	case v1.SecretTypeDockercfg:
+		keyring := NewRegistryKeyring()
+		if err := keyring.AddDockerCfg(secret.Data[v1.DockerConfigKey]); err != nil {
+			return nil, err
+		}
+		return &dockerCredentials{keyring: keyring}, nil
+	default:
+		return nil, fmt.Errorf("unsupported secret type: %s", secret.Type)
+	}
+}
+
+// ControllerCredentials holds the registry credentials given to the
+// controller itself, loaded from each configured source, which are used
+// for every pod on top of the pod's own pull secrets.
+type ControllerCredentials struct {
+	mu      sync.RWMutex
+	sources []string
+	configs map[string]*dockerCredentials
+
+	helperCache *lruCache[*registryAuth]
+}
+
+// NewControllerCredentials creates an empty ControllerCredentials.
+func NewControllerCredentials() *ControllerCredentials {
+	return &ControllerCredentials{
+		sources:     make([]string, 0),
+		configs:     make(map[string]*dockerCredentials),
+		helperCache: newLRUCache[*registryAuth](CREDENTIAL_PROVIDER_CACHE_SIZE),
+	}
+}
+
+// Load replaces the credentials of the given source.
+func (c *ControllerCredentials) Load(source string, credentials *dockerCredentials) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.configs[source]; !ok {
+		c.sources = append(c.sources, source)
+	}
+	c.configs[source] = credentials
+}
+
+// runCredentialHelper gets the credentials held by the given credential
+// helper for the given registry host. Returns nil if the helper holds none.
+// Results are cached for a short while, so helpers aren't run on every lookup.
+func (c *ControllerCredentials) runCredentialHelper(ctx *context.Context, helper string, host string) (*registryAuth, error) {
+	// Same as docker, docker hub credentials are stored under its legacy URL
+	serverURL := host
+	if host == "docker.io" {
+		serverURL = "https://index.docker.io/v1/"
+	}
+	cacheKey := helper + " " + serverURL
+	if auth, ok := c.helperCache.Get(cacheKey); ok {
+		return auth, nil
+	}
+
+	execCtx, cancel := context.WithTimeout(*ctx, CREDENTIAL_PROVIDER_TIMEOUT)
+	defer cancel()
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(execCtx, "docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(serverURL)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if strings.Contains(stdout.String(), credentialHelperNotFound) {
+			c.helperCache.Add(cacheKey, nil, CREDENTIAL_HELPER_CACHE_TTL)
+			return nil, nil
+		}
+		return nil, fmt.Errorf(
+			"credential helper %s failed: %w: %s",
+			helper, err, strings.TrimSpace(stdout.String()+" "+stderr.String()),
+		)
+	}
+
+	var response struct {
+		Username string `json:"Username"`
+		Secret   string `json:"Secret"`
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &response); err != nil {
+		return nil, fmt.Errorf("unable to parse response of credential helper %s: %w", helper, err)
+	}
+	auth := &registryAuth{Username: response.Username, Password: response.Secret}
+	if response.Username == "<token>" {
+		auth = &registryAuth{IdentityToken: response.Secret}
+	}
+	c.helperCache.Add(cacheKey, auth, CREDENTIAL_HELPER_CACHE_TTL)
+	return auth, nil
+}
+
+// Lookup returns the credentials that apply to the given image reference,
+// in the order of their sources. Within each source, same as docker, the
+// credential helper configured for the image's registry is preferred over
+// credentials stored within the config. Failing helpers are logged and skipped.
+func (c *ControllerCredentials) Lookup(ctx *context.Context, image string) []registryAuth {
+	if c == nil {
+		return nil
+	}
+	named, err := dockerref.ParseNormalizedNamed(image)
+	if err != nil {
+		return nil
+	}
+	host := dockerref.Domain(named)
+
+	c.mu.RLock()
+	configs := make([]*dockerCredentials, 0, len(c.sources))
+	for _, source := range c.sources {
+		configs = append(configs, c.configs[source])
+	}
+	c.mu.RUnlock()
+
+	auths := make([]registryAuth, 0)
+	for _, config := range configs {
+		helper, ok := config.credHelpers[host]
+		if !ok {
+			helper = config.credsStore
+		}
+		if helper != "" {
+			auth, err := c.runCredentialHelper(ctx, helper, host)
+			if err != nil {
+				log.WithLevel(zerolog.WarnLevel).
+					Str("credential-helper", helper).
+					Str("ref", image).
+					AnErr("err", err).
+					Msg("Unable to get credentials from credential helper")
+			} else if auth != nil {
+				auths = append(auths, *auth)
+			}
+		}
+		auths = append(auths, config.keyring.Lookup(image)...)
+	}
+	return auths
+}
+
+// watchDockerConfigFile loads the docker config at the given path, polling it
+// for changes until the context is done, so that rotated credentials are picked
+// up. Secrets mounted as volumes are updated by swapping symlinks, which
+// polling handles transparently.
+func watchDockerConfigFile(ctx *context.Context, credentials *ControllerCredentials, filePath string) error {
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("docker-config", filePath)
+	}
+
+	var loaded []byte
+	load := func() error {
+		data, err := os.ReadFile(filePath)
+		if err != nil {
+			return err
+		}
+		if loaded != nil && bytes.Equal(data, loaded) {
+			return nil
+		}
+		config, err := parseDockerConfig(data)
+		if err != nil {
+			return err
+		}
+		credentials.Load("file:"+filePath, config)
+		loaded = data
+		getLog(zerolog.InfoLevel).
+			Msg("Loaded registry credentials")
+		return nil
+	}
+
+	if err := load(); err != nil {
+		getLog(zerolog.ErrorLevel).
+			AnErr("err", err).
+			Msg("Unable to load registry credentials")
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(CREDENTIALS_RELOAD_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-(*ctx).Done():
+				return
+			case <-ticker.C:
+				if err := load(); err != nil {
+					getLog(zerolog.WarnLevel).
+						AnErr("err", err).
+						Msg("Unable to reload registry credentials, keeping previous credentials")
+				}
+			}
+		}
+	}()
+	return nil
+}
+
+// watchDockerConfigSecret loads the docker config within the given image
+// pull secret, given as namespace/name, watching it for changes until the
+// context is done. Credentials are dropped if the secret is deleted.
+func watchDockerConfigSecret(ctx *context.Context, credentials *ControllerCredentials, secretName string) error {
+	namespace, name, ok := strings.Cut(secretName, "/")
+	if !ok || namespace == "" || name == "" {
+		return fmt.Errorf("docker config secret must be given as namespace/name: %s", secretName)
+	}
+
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("docker-config-secret", secretName)
+	}
+
+	load := func(secret *v1.Secret) {
+		config, err := parseDockerConfigSecret(secret)
+		if err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to load registry credentials, keeping previous credentials")
+			return
+		}
+		credentials.Load("secret:"+secretName, config)
+		getLog(zerolog.InfoLevel).
+			Msg("Loaded registry credentials")
+	}
+
+	secretClient := GetK8sInterface(ctx).CoreV1().Secrets(namespace)
+	listOptions := metav1.ListOptions{
+		FieldSelector: fields.OneTermEqualSelector("metadata.name", name).String(),
+	}
+
+	go func() {
+		for {
+			secretWatch, err := secretClient.Watch(*ctx, listOptions)
+			if err != nil {
+				getLog(zerolog.WarnLevel).
+					AnErr("err", err).
+					Msg("Unable to watch registry credentials secret, retrying")
+			} else {
+			watchLoop:
+				for {
+					select {
+					case <-(*ctx).Done():
+						secretWatch.Stop()
+						return
+					case event, ok := <-secretWatch.ResultChan():
+						if !ok {
+							break watchLoop
+						}
+						secret, isSecret := event.Object.(*v1.Secret)
+						if !isSecret {
+							continue
+						}
+						if event.Type == watch.Deleted {
+							credentials.Load("secret:"+secretName, &dockerCredentials{keyring: NewRegistryKeyring()})
+							getLog(zerolog.WarnLevel).
+								Msg("Registry credentials secret deleted, dropping its credentials")
+							continue
+						}
+						load(secret)
+					}
+				}
+			}
+
+			select {
+			case <-(*ctx).Done():
+				return
+			case <-time.After(CREDENTIALS_RELOAD_INTERVAL):
+			}
+		}
+	}()
+	return nil
+}
+
+// setupControllerCredentials loads the controller's own registry credentials
+// from the docker config file and secret given on the CLI, if any, and stores
+// them in the given context.
+func setupControllerCredentials(ctx *context.Context) error {
+	filePath := flag.Lookup("docker-config").Value.String()
+	secretName := flag.Lookup("docker-config-secret").Value.String()
+	if filePath == "" && secretName == "" {
+		return nil
+	}
+
+	credentials := NewControllerCredentials()
+	if filePath != "" {
+		if err := watchDockerConfigFile(ctx, credentials, filePath); err != nil {
+			return err
+		}
+	}
+	if secretName != "" {
+		if err := watchDockerConfigSecret(ctx, credentials, secretName); err != nil {
+			return err
+		}
+	}
+	*ctx = context.WithValue(*ctx, CONTROLLER_CREDENTIALS_KEY, credentials)
+	return nil
+}
+
+// GetControllerCredentials pulls the set ControllerCredentials from the given context.
+// Returns nil if none have been set, which provides no credentials.
+func GetControllerCredentials(ctx *context.Context) *ControllerCredentials {
+	result := (*ctx).Value(CONTROLLER_CREDENTIALS_KEY)
+	if result == nil {
+		return nil
+	}
+	return result.(*ControllerCredentials)
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestControllerCredentials(t *testing.T) {
+	// Stub credential helper, holding credentials for registry.internal only
+	dir := t.TempDir()
+	helper := `#!/bin/sh
+read server
+if [ "$server" = "registry.internal" ]; then
+  echo '{"ServerURL": "registry.internal", "Username": "<token>", "Secret": "refresh-token"}'
+else
+  echo "credentials not found in native keychain"
+  exit 1
+fi
+`
+	if err := os.WriteFile(filepath.Join(dir, "docker-credential-stub"), []byte(helper), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", dir+string(os.PathListSeparator)+os.Getenv("PATH"))
+
+	config, err := parseDockerConfig([]byte(`{
+  "auths": {
+    "https://index.docker.io/v1/": {"auth": "dXNlcjpwYXNzd29yZA=="},
+    "registry.internal": {},
+    "other.internal": {}
+  },
+  "credHelpers": {"registry.internal": "stub", "other.internal": "stub"},
+  "currentContext": "default"
+}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials := NewControllerCredentials()
+	credentials.Load("file:config.json", config)
+
+	ctx := context.Background()
+	cases := map[string][]registryAuth{
+		"nginx":                      {{Auth: "dXNlcjpwYXNzd29yZA=="}},
+		"registry.internal/app":      {{IdentityToken: "refresh-token"}},
+		"other.internal/app":         {},
+		"unlisted.internal/app":      {},
+		"registry.internal:5000/app": {},
+	}
+	for image, expected := range cases {
+		if auths := credentials.Lookup(&ctx, image); !reflect.DeepEqual(auths, expected) {
+			t.Errorf("unexpected credentials for %s: %v, expected %v", image, auths, expected)
+		}
+	}
+
+	// Rotated credentials replace those previously loaded from the same source
+	rotated, err := parseDockerConfig([]byte(`{"auths": {"docker.io": {"username": "user", "password": "rotated"}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	credentials.Load("file:config.json", rotated)
+	expected := []registryAuth{{Username: "user", Password: "rotated"}}
+	if auths := credentials.Lookup(&ctx, "nginx"); !reflect.DeepEqual(auths, expected) {
+		t.Errorf("unexpected credentials after rotation: %v, expected %v", auths, expected)
+	}
+
+	var unset *ControllerCredentials
+	if auths := unset.Lookup(&ctx, "nginx"); auths != nil {
+		t.Errorf("expected no credentials from unset credentials, got %v", auths)
+	}
+}
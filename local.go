@@ -0,0 +1,361 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/images"
+	"github.com/containerd/containerd/namespaces"
+	dockerref "github.com/containerd/containerd/reference/docker"
+	"github.com/containerd/containerd/remotes"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// localSource is a store of images on local storage.
+type localSource interface {
+	// Name identifies the source within logs.
+	Name() string
+	// Get returns the descriptor of the given image, along with a fetcher
+	// for the image's content. Returns an errdefs.ErrNotFound error if
+	// the image is not within the source.
+	Get(ctx *context.Context, ref dockerref.Named) (ocispec.Descriptor, remotes.Fetcher, error)
+}
+
+// containerdSource finds images within the image and content
+// stores of a containerd instance, such as the one on the node.
+type containerdSource struct {
+	address   string
+	namespace string
+
+	mu     sync.Mutex
+	client *containerd.Client
+}
+
+func (s *containerdSource) Name() string {
+	return "containerd:" + s.address
+}
+
+// getClient returns the client connected to containerd, connecting
+// on first use so that containerd does not need to be up on startup.
+func (s *containerdSource) getClient() (*containerd.Client, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.client != nil {
+		return s.client, nil
+	}
+	client, err := containerd.New(
+		s.address,
+		containerd.WithDefaultNamespace(s.namespace),
+	)
+	if err != nil {
+		return nil, err
+	}
+	s.client = client
+	return client, nil
+}
+
+func (s *containerdSource) Get(ctx *context.Context, ref dockerref.Named) (ocispec.Descriptor, remotes.Fetcher, error) {
+	client, err := s.getClient()
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+
+	// containerd names images by their fully-qualified reference
+	nsCtx := namespaces.WithNamespace(*ctx, s.namespace)
+	image, err := client.ImageService().Get(nsCtx, ref.String())
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+
+	store := client.ContentStore()
+	fetcher := remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+		readerAt, err := store.ReaderAt(namespaces.WithNamespace(ctx, s.namespace), desc)
+		if err != nil {
+			return nil, err
+		}
+		return struct {
+			io.Reader
+			io.Closer
+		}{content.NewReader(readerAt), readerAt}, nil
+	})
+	return image.Target, fetcher, nil
+}
+
+// ociLayoutSource finds images within an OCI image layout, either
+// as a directory or as a tarball (such as from `docker save`).
+type ociLayoutSource struct {
+	// repository is used to name images which are only named by their
+	// tag within the layout, as is done by `skopeo copy ... oci:dir:tag`.
+	repository string
+	path       string
+
+	mu          sync.Mutex
+	tarModTime  time.Time
+	tarSize     int64
+	tarContents map[string]tarEntry
+}
+
+// tarEntry locates the contents of a file within a tarball.
+type tarEntry struct {
+	offset int64
+	size   int64
+}
+
+// parseOCILayoutSource parses a layout given as either path,
+// or repository=path.
+func parseOCILayoutSource(specifier string) (*ociLayoutSource, error) {
+	source := &ociLayoutSource{path: specifier}
+	if repository, layoutPath, ok := strings.Cut(specifier, "="); ok {
+		named, err := dockerref.ParseNormalizedNamed(repository)
+		if err != nil || !dockerref.IsNameOnly(named) {
+			return nil, fmt.Errorf("invalid repository for oci layout %s: %s", layoutPath, repository)
+		}
+		source.repository = named.Name()
+		source.path = layoutPath
+	}
+	if source.path == "" {
+		return nil, fmt.Errorf("oci layout has no path: %s", specifier)
+	}
+	return source, nil
+}
+
+func (s *ociLayoutSource) Name() string {
+	return "oci-layout:" + s.path
+}
+
+// indexTarball finds the location of each file within the layout's tarball,
+// so that blobs can be read without scanning the tarball each time.
+// The tarball is only indexed again if it has changed.
+func (s *ociLayoutSource) indexTarball(file *os.File) (map[string]tarEntry, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tarContents != nil && info.ModTime().Equal(s.tarModTime) && info.Size() == s.tarSize {
+		return s.tarContents, nil
+	}
+
+	contents := make(map[string]tarEntry)
+	reader := tar.NewReader(file)
+	for {
+		header, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+		// The tar reader seeks past the contents of each file, so
+		// the current offset is where the file's contents start
+		offset, err := file.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return nil, err
+		}
+		contents[path.Clean(header.Name)] = tarEntry{offset: offset, size: header.Size}
+	}
+
+	s.tarContents = contents
+	s.tarModTime = info.ModTime()
+	s.tarSize = info.Size()
+	return contents, nil
+}
+
+// open opens the file at the given path within the layout.
+func (s *ociLayoutSource) open(name string) (io.ReadCloser, error) {
+	info, err := os.Stat(s.path)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		file, err := os.Open(filepath.Join(s.path, filepath.FromSlash(name)))
+		if os.IsNotExist(err) {
+			return nil, fmt.Errorf("%s not found within %s: %w", name, s.path, errdefs.ErrNotFound)
+		}
+		return file, err
+	}
+
+	file, err := os.Open(s.path)
+	if err != nil {
+		return nil, err
+	}
+	contents, err := s.indexTarball(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	entry, ok := contents[name]
+	if !ok {
+		file.Close()
+		return nil, fmt.Errorf("%s not found within %s: %w", name, s.path, errdefs.ErrNotFound)
+	}
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.NewSectionReader(file, entry.offset, entry.size), file}, nil
+}
+
+// nameOf returns the normalized image reference of the given index entry,
+// or an empty string if the entry is not named.
+func (s *ociLayoutSource) nameOf(desc ocispec.Descriptor) string {
+	name := desc.Annotations[images.AnnotationImageName]
+	if name == "" {
+		name = desc.Annotations[ocispec.AnnotationRefName]
+		if name != "" && s.repository != "" && !strings.ContainsAny(name, "/:@") {
+			name = s.repository + ":" + name
+		}
+	}
+	if name == "" {
+		return ""
+	}
+	named, err := dockerref.ParseNormalizedNamed(name)
+	if err != nil {
+		return ""
+	}
+	return dockerref.TagNameOnly(named).String()
+}
+
+func (s *ociLayoutSource) Get(ctx *context.Context, ref dockerref.Named) (ocispec.Descriptor, remotes.Fetcher, error) {
+	indexReader, err := s.open("index.json")
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer indexReader.Close()
+
+	var index ocispec.Index
+	if err := json.NewDecoder(indexReader).Decode(&index); err != nil {
+		return ocispec.Descriptor{}, nil, fmt.Errorf("unable to decode index of %s: %w", s.path, err)
+	}
+
+	canonical, isCanonical := ref.(dockerref.Canonical)
+	for _, desc := range index.Manifests {
+		if (isCanonical && desc.Digest == canonical.Digest()) || s.nameOf(desc) == ref.String() {
+			fetcher := remotes.FetcherFunc(func(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+				return s.open(path.Join("blobs", desc.Digest.Algorithm().String(), desc.Digest.Encoded()))
+			})
+			return desc, fetcher, nil
+		}
+	}
+	return ocispec.Descriptor{}, nil, fmt.Errorf("%s not found within %s: %w", ref.String(), s.path, errdefs.ErrNotFound)
+}
+
+// localResolver answers by inspecting images within local storage,
+// such as a containerd content store or OCI image layouts, without
+// contacting any registry. Declines images not found locally.
+type localResolver struct {
+	sources []localSource
+}
+
+// newLocalResolver creates a localResolver from the CLI.
+func newLocalResolver() (*localResolver, error) {
+	sources := make([]localSource, 0)
+
+	if address := flag.Lookup("containerd-address").Value.String(); address != "" {
+		sources = append(
+			sources,
+			&containerdSource{
+				address:   address,
+				namespace: flag.Lookup("containerd-namespace").Value.String(),
+			},
+		)
+	}
+	for _, specifier := range strings.Split(flag.Lookup("oci-layouts").Value.String(), ",") {
+		specifier = strings.TrimSpace(specifier)
+		if specifier == "" {
+			continue
+		}
+		source, err := parseOCILayoutSource(specifier)
+		if err != nil {
+			return nil, err
+		}
+		sources = append(sources, source)
+	}
+
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("local resolver requires -containerd-address or -oci-layouts")
+	}
+	return &localResolver{sources: sources}, nil
+}
+
+func (r *localResolver) Name() string {
+	return "local"
+}
+
+func (r *localResolver) Resolve(ctx *context.Context, request *ImageRequest) ([]ocispec.Platform, error) {
+	for _, ref := range request.references() {
+		named, err := dockerref.ParseNormalizedNamed(ref)
+		if err != nil {
+			return nil, err
+		}
+		platforms, err := r.resolveReference(ctx, request, dockerref.TagNameOnly(named))
+		if err != ErrResolverDeclined {
+			return platforms, err
+		}
+	}
+	return nil, ErrResolverDeclined
+}
+
+// resolveReference looks up the given normalized reference within each local source.
+func (r *localResolver) resolveReference(ctx *context.Context, request *ImageRequest, named dockerref.Named) ([]ocispec.Platform, error) {
+	for _, source := range r.sources {
+		getLog := func(level zerolog.Level) *zerolog.Event {
+			return log.WithLevel(level).
+				Str("container-image", request.Image).
+				Str("reference", named.String()).
+				Str("local-source", source.Name())
+		}
+
+		desc, fetcher, err := source.Get(ctx, named)
+		if errdefs.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			// An unavailable source shouldn't stop other sources from answering
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to look up image within local source")
+			continue
+		}
+
+		cache := GetImageCache(ctx)
+		if platforms, ok := cache.GetDigest(desc.Digest); ok {
+			return platforms, nil
+		}
+		platforms, err := fetchArchitectures(ctx, fetcher, named.String(), desc)
+		if err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to read image within local source")
+			continue
+		}
+		cache.AddDigest(desc.Digest, platforms)
+
+		getLog(zerolog.DebugLevel).
+			Str("digest", desc.Digest.String()).
+			Msg("Found image within local source")
+		return platforms, nil
+	}
+	return nil, ErrResolverDeclined
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"archive/tar"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// writeOCILayout writes an OCI layout holding a multi-platform image tagged 1.0
+// and a single-platform image named docker.io/library/single:latest,
+// returning the layout's files keyed by their path.
+func writeOCILayout(t *testing.T) map[string][]byte {
+	files := make(map[string][]byte)
+	addBlob := func(mediaType string, value interface{}) ocispec.Descriptor {
+		data, err := json.Marshal(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dgst := digest.FromBytes(data)
+		files["blobs/sha256/"+dgst.Encoded()] = data
+		return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+	}
+
+	multi := addBlob(ocispec.MediaTypeImageIndex, ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("a"), Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("b"), Platform: &ocispec.Platform{OS: "linux", Architecture: "arm64"}},
+		},
+	})
+	multi.Annotations = map[string]string{ocispec.AnnotationRefName: "1.0"}
+
+	config := addBlob(ocispec.MediaTypeImageConfig, architectureContainer{OS: "linux", Architecture: "arm", Variant: "v7"})
+	single := addBlob(ocispec.MediaTypeImageManifest, ocispec.Manifest{Config: config})
+	single.Annotations = map[string]string{"io.containerd.image.name": "docker.io/library/single:latest"}
+
+	index, err := json.Marshal(ocispec.Index{Manifests: []ocispec.Descriptor{multi, single}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	files["index.json"] = index
+	return files
+}
+
+func testLocalResolver(t *testing.T, layout string) {
+	ctx := context.Background()
+	source, err := parseOCILayoutSource("example.com/team/multi=" + layout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resolver := &localResolver{sources: []localSource{source}}
+
+	platforms, err := resolver.Resolve(&ctx, &ImageRequest{Image: "example.com/team/multi:1.0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(platforms) != 2 || !contains(platforms, "amd64") || !contains(platforms, "arm64") {
+		t.Errorf("unexpected platforms for multi-platform image: %s", formatPlatforms(platforms))
+	}
+
+	platforms, err = resolver.Resolve(&ctx, &ImageRequest{Image: "single"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(platforms) != 1 || platforms[0].Architecture != "arm" || platforms[0].Variant != "v7" {
+		t.Errorf("unexpected platforms for single-platform image: %s", formatPlatforms(platforms))
+	}
+
+	if _, err := resolver.Resolve(&ctx, &ImageRequest{Image: "example.com/team/multi:2.0"}); err != ErrResolverDeclined {
+		t.Errorf("expected unknown image to be declined, got %v", err)
+	}
+}
+
+func TestLocalResolverOCILayoutDirectory(t *testing.T) {
+	dir := t.TempDir()
+	for name, data := range writeOCILayout(t) {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(filePath), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filePath, data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	testLocalResolver(t, dir)
+}
+
+func TestLocalResolverOCILayoutTarball(t *testing.T) {
+	tarPath := filepath.Join(t.TempDir(), "layout.tar")
+	file, err := os.Create(tarPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	writer := tar.NewWriter(file)
+	for name, data := range writeOCILayout(t) {
+		header := &tar.Header{Name: "./" + name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}
+		if err := writer.WriteHeader(header); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := writer.Write(data); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	testLocalResolver(t, tarPath)
+}
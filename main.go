@@ -2,19 +2,205 @@ package main
 
 import (
 	"flag"
+	"time"
 )
 
 func main() {
 	clean := flag.Bool(
 		"clean",
 		false,
-		"If given, will remove supported-arch taints from nodes and delete all pods so their tolerations can be reset",
+		"If given, will remove supported-arch and supported-os taints from nodes and delete all pods so their tolerations can be reset",
 	)
 	flag.String(
 		"kubeconfig",
 		"",
 		"absolute path to the kubeconfig file. Precedence: given kubeconfig > $KUBECONFIG > ~/.config/kube",
 	)
+	flag.String(
+		"node-variant-label",
+		"archaware.io/arch-variant",
+		"node label holding the variant of the node's architecture (i.e. v7 for arm), used within supported-arch taints",
+	)
+	flag.String(
+		"node-variants",
+		"",
+		"comma-separated arch=variant pairs giving the variant of nodes without the variant label (i.e. arm=v7,amd64=v3). Nodes whose variant is unknown only take pods whose images run on every variant of their architecture, so arm/v6 or arm/v7 images need the variant of their nodes to be given",
+	)
+	flag.Int(
+		"cache-size",
+		1000,
+		"maximum number of entries within each layer of the image cache, 0 disables caching",
+	)
+	flag.Duration(
+		"cache-ttl",
+		time.Minute*time.Duration(10),
+		"how long an image tag is assumed to point to the same digest, 0 disables caching tags",
+	)
+	flag.Duration(
+		"cache-failure-ttl",
+		time.Minute,
+		"how long a failed image lookup is cached before being retried, 0 disables caching failures",
+	)
+	flag.String(
+		"resolvers",
+		"annotation,catalog,cache,registry",
+		"comma-separated, ordered list of sources consulted for an image's architectures. Available: annotation, catalog, local, cache, registry",
+	)
+	flag.String(
+		"catalog-file",
+		"",
+		"path to an image catalog mapping image patterns to platforms, reloaded on change",
+	)
+	flag.String(
+		"catalog-configmap",
+		"",
+		"namespace/name of a ConfigMap holding an image catalog under the catalog.yaml key, reloaded on change",
+	)
+	flag.String(
+		"containerd-address",
+		"",
+		"path to a containerd socket whose content store is used by the local resolver (i.e. /run/containerd/containerd.sock)",
+	)
+	flag.String(
+		"containerd-namespace",
+		"k8s.io",
+		"containerd namespace holding images, used by the local resolver",
+	)
+	flag.String(
+		"oci-layouts",
+		"",
+		"comma-separated OCI image layout directories or tarballs used by the local resolver, each optionally given as repository=path to name images tagged only by tag",
+	)
+	flag.String(
+		"registries-config",
+		"",
+		"path to a registries configuration giving mirrors and rewrites of image references, matching the nodes' container runtime",
+	)
+	flag.String(
+		"docker-config",
+		"",
+		"path to a docker config.json holding registry credentials for all pods, such as a mounted Secret, which is reloaded on change. Credential helpers (credHelpers and credsStore) are run from the PATH",
+	)
+	flag.String(
+		"docker-config-secret",
+		"",
+		"image pull secret holding registry credentials for all pods given as namespace/name, such as kube-system/registry-credentials, which is watched for changes",
+	)
+	flag.String(
+		"image-credential-provider-config",
+		"",
+		"path to a kubelet CredentialProviderConfig, whose credential provider plugins are used to authenticate to registries",
+	)
+	flag.String(
+		"image-credential-provider-bin-dir",
+		"/usr/libexec/kubernetes/kubelet-plugins/credential-provider/exec",
+		"directory holding the credential provider plugin binaries named within -image-credential-provider-config",
+	)
+	flag.String(
+		"registry-allowlist",
+		"",
+		"comma-separated registry hosts the controller may contact, which can contain globs (i.e. docker.io,*.internal). Include hosts registries redirect to or issue tokens from, such as auth.docker.io",
+	)
+	flag.String(
+		"registry-denylist",
+		"",
+		"comma-separated registry hosts the controller may never contact, taking precedence over -registry-allowlist",
+	)
+	flag.String(
+		"registry-unlisted-policy",
+		"allow",
+		"whether registry hosts within neither -registry-allowlist nor -registry-denylist may be contacted: allow or deny",
+	)
+	flag.Int64(
+		"max-manifest-size",
+		DEFAULT_MAX_MANIFEST_SIZE,
+		"maximum size in bytes of image manifests and indexes fetched, 0 disables the limit",
+	)
+	flag.Int64(
+		"max-config-size",
+		DEFAULT_MAX_CONFIG_SIZE,
+		"maximum size in bytes of image configs fetched, 0 disables the limit",
+	)
+	flag.Duration(
+		"registry-request-timeout",
+		DEFAULT_REGISTRY_REQUEST_TIMEOUT,
+		"timeout of each request made to a registry, including reading its response, 0 disables the timeout",
+	)
+	flag.Int(
+		"ratelimit-reserve",
+		10,
+		"number of remaining pulls within a registry's rate limit (i.e. Docker Hub's) below which manifest pulls are slowed down",
+	)
+	flag.String(
+		"metrics-address",
+		":8080",
+		"address Prometheus metrics are served on, empty disables metrics",
+	)
+	flag.String(
+		"placement-mode",
+		string(PlacementModeTaints),
+		"how pods are kept off nodes not supporting their images: taints taints nodes and adds tolerations onto pods, affinity adds a node affinity on the kubernetes.io/arch and kubernetes.io/os labels onto pods as they're admitted, which requires the admission webhook",
+	)
+	flag.String(
+		"webhook-address",
+		"",
+		"address the mutating admission webhook is served on over HTTPS (i.e. :8443), empty disables the webhook",
+	)
+	flag.String(
+		"webhook-cert-file",
+		"",
+		"path to the PEM-encoded serving certificate of the admission webhook",
+	)
+	flag.String(
+		"webhook-key-file",
+		"",
+		"path to the PEM-encoded private key of the admission webhook's serving certificate",
+	)
+	flag.String(
+		"webhook-cert-secret",
+		"",
+		"Secret given as namespace/name in which the controller manages its own CA and serving certificate for the admission webhook, used when -webhook-cert-file is not given",
+	)
+	flag.String(
+		"webhook-dns-names",
+		"archaware-controller.kube-system.svc",
+		"comma-separated DNS names the admission webhook is reached on, included within its self-managed serving certificate",
+	)
+	flag.String(
+		"webhook-configurations",
+		"archaware-controller",
+		"comma-separated names of the MutatingWebhookConfiguration and ValidatingWebhookConfiguration objects the self-managed CA bundle is injected into",
+	)
+	flag.Duration(
+		"webhook-timeout",
+		time.Second*time.Duration(8),
+		"time the admission webhook spends resolving a pod's images, which should be less than the webhook's timeoutSeconds",
+	)
+	flag.String(
+		"webhook-failure-policy",
+		"Ignore",
+		"what the admission webhook does with pods whose images can't be resolved in time: Ignore admits them unchanged, leaving them to the pod watch, Fail rejects them",
+	)
+	flag.Bool(
+		"scheduling-gates",
+		false,
+		"If given, the admission webhook holds every pod back from scheduling with the archaware.io/resolving scheduling gate, rather than resolving its images, until the pod watch has added its tolerations or node affinity. Requires Kubernetes 1.27 or later",
+	)
+	flag.Duration(
+		"scheduling-gate-timeout",
+		DEFAULT_SCHEDULING_GATE_TIMEOUT,
+		"time after its creation a pod stays gated while its images can't be resolved, before -scheduling-gate-fallback applies",
+	)
+	flag.String(
+		"scheduling-gate-fallback",
+		string(SchedulingGateFallbackRelease),
+		"what happens to gated pods whose images are still unresolved once their gate times out: release removes the gate without adding tolerations or node affinity, keep leaves the pod gated",
+	)
+	workloadTemplates := flag.Bool(
+		"workload-templates",
+		false,
+		"If given, tolerations or node affinity are written into the pod templates of Deployments, StatefulSets, DaemonSets, ReplicaSets, suspended Jobs and CronJobs, resolving each template once per change of its images",
+	)
 	flag.Parse()
 
 	ctx, stop := Setup()
@@ -24,8 +210,15 @@ func main() {
 	if *clean {
 		go Clean(&ctx, stop)
 	} else {
-		go EnsureNodeTaints(&ctx)
+		// Nodes are left untouched when pods are placed through node affinity
+		if GetPlacementMode(&ctx) == PlacementModeTaints {
+			go EnsureNodeTaints(&ctx)
+		}
 		go EnsurePodTolerations(&ctx)
+		go ServeAdmissionWebhook(&ctx)
+		if *workloadTemplates {
+			go EnsureWorkloadTemplates(&ctx)
+		}
 	}
 
 	<-ctx.Done()
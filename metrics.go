@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	rateLimitLimitGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: OPERATOR_NAME,
+			Name:      "registry_ratelimit_limit",
+			Help:      "Number of manifest pulls allowed within the rate limit window of a registry, as last reported by the registry.",
+		},
+		[]string{"host"},
+	)
+	rateLimitRemainingGauge = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: OPERATOR_NAME,
+			Name:      "registry_ratelimit_remaining",
+			Help:      "Number of manifest pulls remaining within the rate limit window of a registry, as last reported by the registry.",
+		},
+		[]string{"host"},
+	)
+	rateLimitedCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: OPERATOR_NAME,
+			Name:      "registry_ratelimited_total",
+			Help:      "Number of requests rejected by a registry with HTTP 429.",
+		},
+		[]string{"host"},
+	)
+	rateLimitThrottledCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: OPERATOR_NAME,
+			Name:      "registry_ratelimit_throttled_total",
+			Help:      "Number of manifest pulls held back to stay within the rate limit of a registry.",
+		},
+		[]string{"host"},
+	)
+	tagRevalidationsCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: OPERATOR_NAME,
+			Name:      "image_cache_tag_revalidations_total",
+			Help:      "Number of expired image tags resolved again, by whether the tag's digest changed.",
+		},
+		[]string{"result"},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		rateLimitLimitGauge,
+		rateLimitRemainingGauge,
+		rateLimitedCounter,
+		rateLimitThrottledCounter,
+		tagRevalidationsCounter,
+	)
+}
+
+// setupMetrics serves Prometheus metrics on the address given on
+// the CLI, if any, until the given context is done.
+func setupMetrics(ctx *context.Context) {
+	address := flag.Lookup("metrics-address").Value.String()
+	if address == "" {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * time.Duration(10),
+	}
+
+	go func() {
+		log.Info().
+			Str("metrics-address", address).
+			Msg("Serving metrics")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error().
+				AnErr("err", err).
+				Str("metrics-address", address).
+				Msg("Unable to serve metrics")
+		}
+	}()
+	go func() {
+		<-(*ctx).Done()
+		server.Close()
+	}()
+}
@@ -16,17 +16,37 @@ import (
 
 func handleNode(ctx *context.Context, node *v1.Node, nodeClient typedv1.NodeInterface) error {
 	name := node.ObjectMeta.Name
-	arch := node.Status.NodeInfo.Architecture
+	arch := getNodeTaintValue(ctx, node)
+	os := node.Status.NodeInfo.OperatingSystem
 
 	getLog := func(level zerolog.Level) *zerolog.Event {
 		return log.WithLevel(level).
 			Str("name", name).
-			Str("arch", arch)
+			Str("arch", arch).
+			Str("os", os)
 	}
 
 	getLog(zerolog.InfoLevel).
 		Msg("Checking state of node")
 
+	desiredTaints := []v1.Taint{
+		{
+			Key:    ARCH_TAINT_KEY_NAME,
+			Value:  arch,
+			Effect: v1.TaintEffectNoSchedule,
+		},
+	}
+	if os != "" {
+		desiredTaints = append(
+			desiredTaints,
+			v1.Taint{
+				Key:    OS_TAINT_KEY_NAME,
+				Value:  os,
+				Effect: v1.TaintEffectNoSchedule,
+			},
+		)
+	}
+
 	attemptCounter := 0
 	retryErr := retry.RetryOnConflict(retry.DefaultRetry, func() error {
 		attemptCounter += 1
@@ -45,29 +65,38 @@ func handleNode(ctx *context.Context, node *v1.Node, nodeClient typedv1.NodeInte
 			Interface("node-taints", result.Spec.Taints).
 			Msg("node's current taints before update")
 
-		for i, taint := range result.Spec.Taints {
-			if taint.Key == ARCH_TAINT_KEY_NAME {
-				if taint.Value == arch {
-					getLog(zerolog.InfoLevel).
-						Msg("Taint with proper architecture was found, doing nothing")
-					return nil
-				} else {
-					getLog(zerolog.DebugLevel).
-						Msg("Taint with bad architecture was found, updating")
-					// Delete this taint as it needs to be updated
-					RemoveFromSlice(&result.Spec.Taints, i)
+		upToDate := true
+		for _, desired := range desiredTaints {
+			found := false
+			for i := 0; i < len(result.Spec.Taints); i++ {
+				taint := result.Spec.Taints[i]
+				if taint.Key != desired.Key {
+					continue
 				}
+				if taint.Value == desired.Value && !found {
+					found = true
+					continue
+				}
+				getLog(zerolog.DebugLevel).
+					Str("key", taint.Key).
+					Str("value", taint.Value).
+					Msg("Taint with bad value was found, updating")
+				// Delete this taint as it needs to be updated
+				RemoveFromSlice(&result.Spec.Taints, i)
+				i -= 1
+				upToDate = false
+			}
+			if !found {
+				result.Spec.Taints = append(result.Spec.Taints, desired)
+				upToDate = false
 			}
 		}
 
-		result.Spec.Taints = append(
-			result.Spec.Taints,
-			v1.Taint{
-				Key:    ARCH_TAINT_KEY_NAME,
-				Value:  arch,
-				Effect: v1.TaintEffectNoSchedule,
-			},
-		)
+		if upToDate {
+			getLog(zerolog.InfoLevel).
+				Msg("Taints with proper platform were found, doing nothing")
+			return nil
+		}
 
 		getLog(zerolog.DebugLevel).
 			Interface("node-taints", result.Spec.Taints).
@@ -86,7 +115,7 @@ func handleNode(ctx *context.Context, node *v1.Node, nodeClient typedv1.NodeInte
 
 		getLog(zerolog.InfoLevel).
 			Int("attempts", attemptCounter).
-			Msg("Added architecture taint on node")
+			Msg("Added platform taints on node")
 		return nil
 	})
 
@@ -94,7 +123,7 @@ func handleNode(ctx *context.Context, node *v1.Node, nodeClient typedv1.NodeInte
 		getLog(zerolog.WarnLevel).
 			Int("attempts", attemptCounter).
 			AnErr("err", retryErr).
-			Msg("Unable to update architecture taint on node")
+			Msg("Unable to update platform taints on node")
 		return retryErr
 	}
 	return nil
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHandleNodeTaints(t *testing.T) {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Spec: v1.NodeSpec{
+			Taints: []v1.Taint{
+				{Key: "dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule},
+				{Key: OS_TAINT_KEY_NAME, Value: "linux", Effect: v1.TaintEffectNoSchedule},
+			},
+		},
+		Status: v1.NodeStatus{
+			NodeInfo: v1.NodeSystemInfo{Architecture: "amd64", OperatingSystem: "windows"},
+		},
+	}
+	clientset := fake.NewSimpleClientset(node)
+	nodeClient := clientset.CoreV1().Nodes()
+
+	ctx := context.Background()
+	if err := handleNode(&ctx, node, nodeClient); err != nil {
+		t.Fatal(err)
+	}
+	result, err := nodeClient.Get(ctx, node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The stale operating system taint is replaced, leaving other taints be
+	expected := []v1.Taint{
+		{Key: "dedicated", Value: "gpu", Effect: v1.TaintEffectNoSchedule},
+		{Key: ARCH_TAINT_KEY_NAME, Value: "amd64", Effect: v1.TaintEffectNoSchedule},
+		{Key: OS_TAINT_KEY_NAME, Value: "windows", Effect: v1.TaintEffectNoSchedule},
+	}
+	if !reflect.DeepEqual(result.Spec.Taints, expected) {
+		t.Errorf("unexpected taints: %+v, expected %+v", result.Spec.Taints, expected)
+	}
+
+	// Nodes not reporting an operating system only get an architecture taint
+	node = &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "unknown-os"},
+		Status: v1.NodeStatus{
+			NodeInfo: v1.NodeSystemInfo{Architecture: "arm64"},
+		},
+	}
+	if _, err := nodeClient.Create(ctx, node, metav1.CreateOptions{}); err != nil {
+		t.Fatal(err)
+	}
+	if err := handleNode(&ctx, node, nodeClient); err != nil {
+		t.Fatal(err)
+	}
+	result, err = nodeClient.Get(ctx, node.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = []v1.Taint{{Key: ARCH_TAINT_KEY_NAME, Value: "arm64", Effect: v1.TaintEffectNoSchedule}}
+	if !reflect.DeepEqual(result.Spec.Taints, expected) {
+		t.Errorf("unexpected taints: %+v, expected %+v", result.Spec.Taints, expected)
+	}
+}
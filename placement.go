@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"sort"
+
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+)
+
+// PlacementMode determines how pods are kept off nodes whose
+// platform doesn't support their images.
+type PlacementMode string
+
+const (
+	// PlacementModeTaints taints every node with its supported platforms,
+	// adding matching tolerations onto pods.
+	PlacementModeTaints PlacementMode = "taints"
+	// PlacementModeAffinity leaves nodes untouched, adding a node affinity
+	// on the well-known architecture and OS labels onto pods as they're created.
+	PlacementModeAffinity PlacementMode = "affinity"
+)
+
+// podPlacement holds the platforms all of a pod's containers support.
+type podPlacement struct {
+	// taintValues are the supported-arch taint values the pod tolerates,
+	// including architecture variants.
+	taintValues []string
+	// architectures are the plain architectures, as found on nodes'
+	// kubernetes.io/arch label.
+	architectures    []string
+	operatingSystems []string
+}
+
+// tolerations returns the tolerations the pod needs to be scheduled
+// onto tainted nodes supporting its platforms.
+func (p *podPlacement) tolerations() []v1.Toleration {
+	tolerations := make([]v1.Toleration, 0, len(p.taintValues)+len(p.operatingSystems))
+	for _, arch := range p.taintValues {
+		tolerations = append(
+			tolerations,
+			v1.Toleration{
+				Key:    ARCH_TAINT_KEY_NAME,
+				Value:  arch,
+				Effect: v1.TaintEffectNoSchedule,
+			},
+		)
+	}
+	for _, os := range p.operatingSystems {
+		tolerations = append(
+			tolerations,
+			v1.Toleration{
+				Key:    OS_TAINT_KEY_NAME,
+				Value:  os,
+				Effect: v1.TaintEffectNoSchedule,
+			},
+		)
+	}
+	return tolerations
+}
+
+// nodeSelectorRequirements returns the requirements restricting the pod
+// onto nodes supporting its platforms. Node labels don't carry architecture
+// variants, so those aren't expressed.
+// An empty list of architectures or operating systems (containers without a
+// platform in common) can't be given to the In operator, so the label is
+// required not to exist instead, which no node satisfies as the kubelet sets
+// both labels. The pod then stays pending, just as it would without the
+// tolerations of any node.
+func (p *podPlacement) nodeSelectorRequirements() []v1.NodeSelectorRequirement {
+	requirements := make([]v1.NodeSelectorRequirement, 0, 2)
+	for _, label := range []struct {
+		key    string
+		values []string
+	}{
+		{v1.LabelArchStable, p.architectures},
+		{v1.LabelOSStable, p.operatingSystems},
+	} {
+		if len(label.values) == 0 {
+			requirements = append(
+				requirements,
+				v1.NodeSelectorRequirement{
+					Key:      label.key,
+					Operator: v1.NodeSelectorOpDoesNotExist,
+				},
+			)
+			continue
+		}
+		values := append([]string{}, label.values...)
+		sort.Strings(values)
+		requirements = append(
+			requirements,
+			v1.NodeSelectorRequirement{
+				Key:      label.key,
+				Operator: v1.NodeSelectorOpIn,
+				Values:   values,
+			},
+		)
+	}
+	return requirements
+}
+
+// mergeNodeAffinity returns a copy of the given affinity whose required node
+// affinity also includes the given requirements, and whether anything had to
+// be added. Required node selector terms are ORed while the requirements within
+// a term are ANDed, so the requirements are added onto every existing term.
+func mergeNodeAffinity(affinity *v1.Affinity, requirements []v1.NodeSelectorRequirement) (*v1.Affinity, bool) {
+	if len(requirements) == 0 {
+		return affinity, false
+	}
+
+	merged := &v1.Affinity{}
+	if affinity != nil {
+		merged = affinity.DeepCopy()
+	}
+	if merged.NodeAffinity == nil {
+		merged.NodeAffinity = &v1.NodeAffinity{}
+	}
+	nodeAffinity := merged.NodeAffinity
+	if nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution = &v1.NodeSelector{}
+	}
+	selector := nodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	if len(selector.NodeSelectorTerms) == 0 {
+		selector.NodeSelectorTerms = []v1.NodeSelectorTerm{{}}
+	}
+
+	changed := false
+	for i := range selector.NodeSelectorTerms {
+		term := &selector.NodeSelectorTerms[i]
+	requirementLoop:
+		for _, requirement := range requirements {
+			for _, existing := range term.MatchExpressions {
+				if equality.Semantic.DeepEqual(existing, requirement) {
+					continue requirementLoop
+				}
+			}
+			term.MatchExpressions = append(term.MatchExpressions, requirement)
+			changed = true
+		}
+	}
+	if !changed {
+		return affinity, false
+	}
+	return merged, true
+}
+
+// removeNodeSelectorRequirements returns a copy of the given affinity without
+// the given requirements within any of its required node selector terms.
+func removeNodeSelectorRequirements(affinity *v1.Affinity, requirements []v1.NodeSelectorRequirement) *v1.Affinity {
+	if affinity == nil || affinity.NodeAffinity == nil || affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution == nil {
+		return affinity
+	}
+	removed := affinity.DeepCopy()
+	selector := removed.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution
+	for i := range selector.NodeSelectorTerms {
+		term := &selector.NodeSelectorTerms[i]
+		kept := make([]v1.NodeSelectorRequirement, 0, len(term.MatchExpressions))
+	expressionLoop:
+		for _, existing := range term.MatchExpressions {
+			for _, requirement := range requirements {
+				if equality.Semantic.DeepEqual(existing, requirement) {
+					continue expressionLoop
+				}
+			}
+			kept = append(kept, existing)
+		}
+		term.MatchExpressions = kept
+	}
+	return removed
+}
+
+// placementPatch returns the fields of a strategic merge patch of the given
+// pod spec adding the tolerations or node affinity of the given placement,
+// depending on the placement mode. Returns nil if nothing needs adding.
+func placementPatch(ctx *context.Context, spec *v1.PodSpec, placement *podPlacement) map[string]interface{} {
+	if placement == nil {
+		return nil
+	}
+	if GetPlacementMode(ctx) == PlacementModeAffinity {
+		affinity, changed := mergeNodeAffinity(spec.Affinity, placement.nodeSelectorRequirements())
+		if !changed {
+			return nil
+		}
+		return map[string]interface{}{"affinity": affinity}
+	}
+	missing := missingTolerations(spec.Tolerations, placement.tolerations())
+	if len(missing) == 0 {
+		return nil
+	}
+	// Tolerations are replaced as a whole by strategic merge patches
+	tolerations := make([]v1.Toleration, 0, len(spec.Tolerations)+len(missing))
+	tolerations = append(tolerations, spec.Tolerations...)
+	return map[string]interface{}{"tolerations": append(tolerations, missing...)}
+}
+
+// podSpecPatch returns the strategic merge patch of the given pod setting
+// the given fields of its spec. The pod's resourceVersion is included, so the
+// patch fails on conflict. Pods are patched rather than updated, so that fields
+// unknown to the k8s.io/api in use, which an update would drop, are left be.
+func podSpecPatch(pod *v1.Pod, spec map[string]interface{}) ([]byte, error) {
+	return json.Marshal(map[string]interface{}{
+		"metadata": map[string]interface{}{
+			"resourceVersion": pod.ResourceVersion,
+		},
+		"spec": spec,
+	})
+}
+
+// setupPlacementMode parses the placement mode given on
+// the CLI and stores it in the given context.
+func setupPlacementMode(ctx *context.Context) error {
+	mode := PlacementMode(flag.Lookup("placement-mode").Value.String())
+	if mode != PlacementModeTaints && mode != PlacementModeAffinity {
+		return fmt.Errorf("unknown placement mode: %s, expected %s or %s", mode, PlacementModeTaints, PlacementModeAffinity)
+	}
+	*ctx = context.WithValue(*ctx, PLACEMENT_MODE_KEY, mode)
+	return nil
+}
+
+// GetPlacementMode pulls the set PlacementMode from the given context.
+// If no PlacementMode has been set, taints are used.
+func GetPlacementMode(ctx *context.Context) PlacementMode {
+	result := (*ctx).Value(PLACEMENT_MODE_KEY)
+	if result == nil {
+		return PlacementModeTaints
+	}
+	return result.(PlacementMode)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestNodeSelectorRequirements(t *testing.T) {
+	arch := v1.NodeSelectorRequirement{Key: v1.LabelArchStable, Operator: v1.NodeSelectorOpIn, Values: []string{"amd64", "arm64"}}
+	os := v1.NodeSelectorRequirement{Key: v1.LabelOSStable, Operator: v1.NodeSelectorOpIn, Values: []string{"linux"}}
+	// Containers without a platform in common can't be placed on any node
+	noArch := v1.NodeSelectorRequirement{Key: v1.LabelArchStable, Operator: v1.NodeSelectorOpDoesNotExist}
+	noOS := v1.NodeSelectorRequirement{Key: v1.LabelOSStable, Operator: v1.NodeSelectorOpDoesNotExist}
+
+	tests := []struct {
+		name      string
+		placement *podPlacement
+		expected  []v1.NodeSelectorRequirement
+	}{
+		{
+			name: "values are sorted",
+			placement: &podPlacement{
+				taintValues:      []string{"arm64", "arm64-v8", "amd64"},
+				architectures:    []string{"arm64", "amd64"},
+				operatingSystems: []string{"linux"},
+			},
+			expected: []v1.NodeSelectorRequirement{arch, os},
+		},
+		{
+			name: "no architecture in common",
+			placement: &podPlacement{
+				taintValues:      []string{},
+				architectures:    []string{},
+				operatingSystems: []string{"linux"},
+			},
+			expected: []v1.NodeSelectorRequirement{noArch, os},
+		},
+		{
+			name: "no operating system in common",
+			placement: &podPlacement{
+				taintValues:      []string{"arm64", "arm64-v8", "amd64"},
+				architectures:    []string{"arm64", "amd64"},
+				operatingSystems: []string{},
+			},
+			expected: []v1.NodeSelectorRequirement{arch, noOS},
+		},
+	}
+	for _, test := range tests {
+		if requirements := test.placement.nodeSelectorRequirements(); !reflect.DeepEqual(requirements, test.expected) {
+			t.Errorf("%s: unexpected requirements: %+v, expected %+v", test.name, requirements, test.expected)
+		}
+	}
+}
+
+func TestMergeNodeAffinity(t *testing.T) {
+	arch := v1.NodeSelectorRequirement{Key: v1.LabelArchStable, Operator: v1.NodeSelectorOpIn, Values: []string{"amd64", "arm64"}}
+	requirements := []v1.NodeSelectorRequirement{arch}
+
+	zoneA := v1.NodeSelectorRequirement{Key: v1.LabelTopologyZone, Operator: v1.NodeSelectorOpIn, Values: []string{"a"}}
+	zoneB := v1.NodeSelectorRequirement{Key: v1.LabelTopologyZone, Operator: v1.NodeSelectorOpIn, Values: []string{"b"}}
+	preferred := []v1.PreferredSchedulingTerm{{Weight: 1, Preference: v1.NodeSelectorTerm{MatchExpressions: []v1.NodeSelectorRequirement{zoneA}}}}
+	podAntiAffinity := &v1.PodAntiAffinity{
+		RequiredDuringSchedulingIgnoredDuringExecution: []v1.PodAffinityTerm{{TopologyKey: v1.LabelHostname}},
+	}
+
+	tests := []struct {
+		name     string
+		affinity *v1.Affinity
+		expected *v1.Affinity
+		changed  bool
+	}{
+		{
+			name:     "no affinity",
+			affinity: nil,
+			expected: &v1.Affinity{
+				NodeAffinity: &v1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{arch}}},
+					},
+				},
+			},
+			changed: true,
+		},
+		{
+			name: "other affinities are kept",
+			affinity: &v1.Affinity{
+				PodAntiAffinity: podAntiAffinity,
+				NodeAffinity:    &v1.NodeAffinity{PreferredDuringSchedulingIgnoredDuringExecution: preferred},
+			},
+			expected: &v1.Affinity{
+				PodAntiAffinity: podAntiAffinity,
+				NodeAffinity: &v1.NodeAffinity{
+					PreferredDuringSchedulingIgnoredDuringExecution: preferred,
+					RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{arch}}},
+					},
+				},
+			},
+			changed: true,
+		},
+		{
+			name: "requirements are added onto every term",
+			affinity: &v1.Affinity{
+				NodeAffinity: &v1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{
+							{MatchExpressions: []v1.NodeSelectorRequirement{zoneA}},
+							{MatchExpressions: []v1.NodeSelectorRequirement{zoneB, arch}},
+						},
+					},
+				},
+			},
+			expected: &v1.Affinity{
+				NodeAffinity: &v1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{
+							{MatchExpressions: []v1.NodeSelectorRequirement{zoneA, arch}},
+							{MatchExpressions: []v1.NodeSelectorRequirement{zoneB, arch}},
+						},
+					},
+				},
+			},
+			changed: true,
+		},
+		{
+			name: "requirements already present",
+			affinity: &v1.Affinity{
+				NodeAffinity: &v1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{arch, zoneA}}},
+					},
+				},
+			},
+			changed: false,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var original *v1.Affinity
+			if test.affinity != nil {
+				original = test.affinity.DeepCopy()
+			}
+			merged, changed := mergeNodeAffinity(test.affinity, requirements)
+			if changed != test.changed {
+				t.Fatalf("expected changed to be %v", test.changed)
+			}
+			if !reflect.DeepEqual(test.affinity, original) {
+				t.Errorf("given affinity was modified: %+v", test.affinity)
+			}
+			if changed && !reflect.DeepEqual(merged, test.expected) {
+				t.Errorf("unexpected affinity: %+v, expected %+v", merged, test.expected)
+			}
+		})
+	}
+}
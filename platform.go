@@ -0,0 +1,325 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"strings"
+
+	"github.com/containerd/containerd/platforms"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	v1 "k8s.io/api/core/v1"
+)
+
+// variantOrder lists the known variants of each architecture, oldest first.
+// Hardware implementing a variant can run images built for any earlier
+// variant of the same architecture, for instance a v7 arm board can run
+// v6 arm images, but not the other way around.
+// The first variant is used for images which do not specify one.
+var variantOrder = map[string][]string{
+	"amd64": {"v1", "v2", "v3", "v4"},
+	"arm":   {"v5", "v6", "v7", "v8"},
+	"arm64": {
+		"v8", "v8.1", "v8.2", "v8.3", "v8.4", "v8.5", "v8.6", "v8.7", "v8.8", "v8.9",
+		"v9", "v9.1", "v9.2", "v9.3", "v9.4", "v9.5",
+	},
+}
+
+// knownOperatingSystems lists the operating systems recognized as the
+// first component of a platform specifier, such as linux/arm64.
+var knownOperatingSystems = map[string]bool{
+	"aix": true, "android": true, "darwin": true, "dragonfly": true,
+	"freebsd": true, "illumos": true, "ios": true, "js": true, "linux": true,
+	"netbsd": true, "openbsd": true, "plan9": true, "solaris": true, "windows": true,
+}
+
+// PlatformConfig determines how the platform of a node is found.
+type PlatformConfig struct {
+	// VariantLabel is the node label holding the node's architecture variant.
+	VariantLabel string
+	// DefaultVariants maps architectures to the variant assumed for nodes
+	// which do not have the VariantLabel.
+	DefaultVariants map[string]string
+}
+
+// normalizeVariant normalizes the given architecture and variant,
+// filling in the default variant for the architecture if one isn't given.
+func normalizeVariant(arch string, variant string) (string, string) {
+	platform := platforms.Normalize(
+		ocispec.Platform{
+			OS:           "linux",
+			Architecture: arch,
+			Variant:      variant,
+		},
+	)
+	if order, ok := variantOrder[platform.Architecture]; ok && platform.Variant == "" {
+		platform.Variant = order[0]
+	}
+	return platform.Architecture, platform.Variant
+}
+
+// normalizePlatform normalizes the operating system, architecture and variant
+// of the given platform, such that platforms of images can be compared against
+// one another.
+func normalizePlatform(platform ocispec.Platform) ocispec.Platform {
+	if platform.OS != "" {
+		platform.OS = platforms.Normalize(platform).OS
+	}
+	platform.Architecture, platform.Variant = normalizeVariant(
+		platform.Architecture, platform.Variant,
+	)
+	return platform
+}
+
+// formatTaintValue formats the given architecture and variant into the value
+// used for architecture taints and tolerations.
+// Taint values cannot contain slashes, so the two are joined with a dash.
+func formatTaintValue(arch string, variant string) string {
+	if variant == "" {
+		return arch
+	}
+	return arch + "-" + variant
+}
+
+// formatPlatforms formats the given platforms into a human-readable list.
+func formatPlatforms(platformList []ocispec.Platform) string {
+	formatted := make([]string, 0, len(platformList))
+	for _, platform := range platformList {
+		formatted = append(formatted, platforms.Format(platform))
+	}
+	return strings.Join(formatted, ", ")
+}
+
+// getTaintValues returns the architecture taint values of every node able
+// to run at least one of the given image platforms.
+// Nodes whose variant is unknown are tainted with only their architecture, and
+// could be of any of its variants, so that value is only included for images
+// able to run on every variant, such as those built for the oldest variant.
+func getTaintValues(platformList []ocispec.Platform) []string {
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	addValue := func(value string) {
+		if !seen[value] {
+			seen[value] = true
+			values = append(values, value)
+		}
+	}
+
+	for _, platform := range platformList {
+		platform = normalizePlatform(platform)
+
+		order, ok := variantOrder[platform.Architecture]
+		if !ok {
+			// Without known variants, images without a
+			// variant are taken to run on every variant
+			addValue(formatTaintValue(platform.Architecture, platform.Variant))
+			continue
+		}
+
+		start := -1
+		for i, variant := range order {
+			if variant == platform.Variant {
+				start = i
+				break
+			}
+		}
+		if start == -1 {
+			// Unknown variant, only an exact match is compatible
+			addValue(formatTaintValue(platform.Architecture, platform.Variant))
+			continue
+		}
+		if start == 0 {
+			addValue(platform.Architecture)
+		}
+		for _, variant := range order[start:] {
+			addValue(formatTaintValue(platform.Architecture, variant))
+		}
+	}
+	return values
+}
+
+// getOperatingSystems returns the unique operating systems of the given platforms,
+// which are used as the values of operating system taints and tolerations.
+// Platforms without an operating system are taken to be of defaultOS.
+func getOperatingSystems(platformList []ocispec.Platform, defaultOS string) []string {
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, platform := range platformList {
+		os := platform.OS
+		if os == "" {
+			os = defaultOS
+		}
+		if seen[os] {
+			continue
+		}
+		seen[os] = true
+		values = append(values, os)
+	}
+	return values
+}
+
+// getArchitectureNames returns the unique architectures of the given
+// platforms, without their variants.
+func getArchitectureNames(platformList []ocispec.Platform) []string {
+	values := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, platform := range platformList {
+		arch := normalizePlatform(platform).Architecture
+		if arch == "" || seen[arch] {
+			continue
+		}
+		seen[arch] = true
+		values = append(values, arch)
+	}
+	return values
+}
+
+// parsePlatformSpecifier parses a platform specifier in the form of
+// arch, arch/variant, os/arch or os/arch/variant.
+// Only the architecture is normalized, as a blank operating system or
+// variant means that any operating system or variant is allowed.
+func parsePlatformSpecifier(specifier string) (ocispec.Platform, error) {
+	var platform ocispec.Platform
+	parts := strings.Split(strings.TrimSpace(specifier), "/")
+	switch len(parts) {
+	case 1:
+		platform.Architecture = parts[0]
+	case 2:
+		if knownOperatingSystems[strings.ToLower(parts[0])] {
+			platform.OS, platform.Architecture = parts[0], parts[1]
+		} else {
+			platform.Architecture, platform.Variant = parts[0], parts[1]
+		}
+	case 3:
+		platform.OS, platform.Architecture, platform.Variant = parts[0], parts[1], parts[2]
+	default:
+		return platform, fmt.Errorf("invalid platform: %s", specifier)
+	}
+
+	for _, part := range parts {
+		if part == "" || strings.ContainsAny(part, " ,=") {
+			return platform, fmt.Errorf("invalid platform: %s", specifier)
+		}
+	}
+
+	if platform.OS != "" {
+		platform.OS = platforms.Normalize(platform).OS
+	}
+	normalizedArch, normalizedVariant := normalizeVariant(platform.Architecture, platform.Variant)
+	platform.Architecture = normalizedArch
+	if platform.Variant != "" {
+		platform.Variant = normalizedVariant
+	}
+	return platform, nil
+}
+
+// parsePlatformList parses a comma-separated list of platform specifiers.
+func parsePlatformList(list string) ([]ocispec.Platform, error) {
+	result := make([]ocispec.Platform, 0)
+	for _, specifier := range strings.Split(list, ",") {
+		if strings.TrimSpace(specifier) == "" {
+			continue
+		}
+		platform, err := parsePlatformSpecifier(specifier)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, platform)
+	}
+	if len(result) == 0 {
+		return nil, fmt.Errorf("no platforms given")
+	}
+	return result, nil
+}
+
+// platformAllows determines if the given image platform is allowed by the
+// given platform specifier, where blank fields in the specifier match anything.
+func platformAllows(allowed ocispec.Platform, platform ocispec.Platform) bool {
+	if allowed.OS != "" && platform.OS != "" && allowed.OS != platform.OS {
+		return false
+	}
+	if allowed.Architecture != platform.Architecture {
+		return false
+	}
+	return allowed.Variant == "" || allowed.Variant == platform.Variant
+}
+
+// getPodOS returns the operating system declared by the given pod,
+// or linux if the pod does not declare one.
+func getPodOS(pod *v1.Pod) string {
+	if pod != nil && pod.Spec.OS != nil && pod.Spec.OS.Name != "" {
+		return string(pod.Spec.OS.Name)
+	}
+	return "linux"
+}
+
+// parseVariantMapping parses a comma-separated list of arch=variant pairs.
+func parseVariantMapping(mapping string) (map[string]string, error) {
+	result := make(map[string]string)
+	for _, pair := range strings.Split(mapping, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		arch, variant, ok := strings.Cut(pair, "=")
+		if !ok || arch == "" || variant == "" {
+			return nil, fmt.Errorf("invalid architecture variant mapping: %s", pair)
+		}
+		arch, variant = normalizeVariant(arch, variant)
+		result[arch] = variant
+	}
+	return result, nil
+}
+
+// setupPlatformConfig creates a PlatformConfig from the CLI
+// and stores it in the given context.
+func setupPlatformConfig(ctx *context.Context) error {
+	defaultVariants, err := parseVariantMapping(
+		flag.Lookup("node-variants").Value.String(),
+	)
+	if err != nil {
+		return err
+	}
+	*ctx = context.WithValue(
+		*ctx,
+		PLATFORM_CONFIG_KEY,
+		&PlatformConfig{
+			VariantLabel:    flag.Lookup("node-variant-label").Value.String(),
+			DefaultVariants: defaultVariants,
+		},
+	)
+	return nil
+}
+
+// GetPlatformConfig pulls the set PlatformConfig from the given context.
+func GetPlatformConfig(ctx *context.Context) *PlatformConfig {
+	result := (*ctx).Value(PLATFORM_CONFIG_KEY)
+	if result == nil {
+		return &PlatformConfig{}
+	}
+	return result.(*PlatformConfig)
+}
+
+// getNodeTaintValue returns the architecture taint value for the given node.
+// The node's variant is taken from its variant label if present, otherwise
+// from the configured default variant for its architecture.
+// If the variant cannot be determined, only the architecture is used.
+func getNodeTaintValue(ctx *context.Context, node *v1.Node) string {
+	config := GetPlatformConfig(ctx)
+	arch := node.Status.NodeInfo.Architecture
+
+	variant := ""
+	if config.VariantLabel != "" {
+		variant = node.Labels[config.VariantLabel]
+	}
+	if variant == "" {
+		normalizedArch, _ := normalizeVariant(arch, "")
+		variant = config.DefaultVariants[normalizedArch]
+	}
+	if variant == "" {
+		return arch
+	}
+
+	arch, variant = normalizeVariant(arch, variant)
+	return formatTaintValue(arch, variant)
+}
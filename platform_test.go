@@ -0,0 +1,84 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+func TestGetTaintValues(t *testing.T) {
+	tests := []struct {
+		platform ocispec.Platform
+		expected []string
+	}{
+		{
+			ocispec.Platform{Architecture: "arm", Variant: "v6"},
+			[]string{"arm-v6", "arm-v7", "arm-v8"},
+		},
+		{
+			ocispec.Platform{Architecture: "arm"},
+			[]string{"arm-v7", "arm-v8"},
+		},
+		{
+			ocispec.Platform{Architecture: "arm", Variant: "v5"},
+			[]string{"arm", "arm-v5", "arm-v6", "arm-v7", "arm-v8"},
+		},
+		{
+			ocispec.Platform{Architecture: "amd64"},
+			[]string{"amd64", "amd64-v1", "amd64-v2", "amd64-v3", "amd64-v4"},
+		},
+		{
+			ocispec.Platform{Architecture: "amd64", Variant: "v3"},
+			[]string{"amd64-v3", "amd64-v4"},
+		},
+		{
+			ocispec.Platform{Architecture: "ppc64le"},
+			[]string{"ppc64le"},
+		},
+		{
+			ocispec.Platform{Architecture: "riscv64", Variant: "rva22"},
+			[]string{"riscv64-rva22"},
+		},
+	}
+	for _, test := range tests {
+		result := getTaintValues([]ocispec.Platform{test.platform})
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("expected taint values for %v to be %v, got %v", test.platform, test.expected, result)
+		}
+	}
+
+	v7Only := getTaintValues([]ocispec.Platform{{Architecture: "arm", Variant: "v7"}})
+	v6Only := getTaintValues([]ocispec.Platform{{Architecture: "arm", Variant: "v6"}})
+	if len(Intersection(v7Only, []string{"arm-v6"})) != 0 {
+		t.Errorf("arm/v7 images should not tolerate arm-v6 nodes")
+	}
+	if len(Intersection(v6Only, []string{"arm-v7"})) != 1 {
+		t.Errorf("arm/v6 images should tolerate arm-v7 nodes")
+	}
+
+	// Nodes of unknown variant could be of any variant, so only
+	// images running on every variant tolerate them
+	if len(Intersection(v6Only, []string{"arm"})) != 0 {
+		t.Errorf("arm/v6 images should not tolerate arm nodes of unknown variant")
+	}
+	arm64 := getTaintValues([]ocispec.Platform{{Architecture: "arm64", Variant: "v8"}})
+	if len(Intersection(arm64, []string{"arm64"})) != 1 {
+		t.Errorf("arm64/v8 images should tolerate arm64 nodes of unknown variant")
+	}
+}
+
+func TestGetOperatingSystems(t *testing.T) {
+	platforms := []ocispec.Platform{
+		{Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "windows", Architecture: "amd64"},
+	}
+	// Platforms without an operating system are taken to be of the pod's
+	if result, expected := getOperatingSystems(platforms, "linux"), []string{"linux", "windows"}; !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected operating systems %v, got %v", expected, result)
+	}
+	if result, expected := getOperatingSystems(platforms, "windows"), []string{"windows", "linux"}; !reflect.DeepEqual(result, expected) {
+		t.Errorf("expected operating systems %v, got %v", expected, result)
+	}
+}
@@ -4,53 +4,264 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/containerd/containerd"
 	"github.com/containerd/containerd/images"
+	dockerref "github.com/containerd/containerd/reference/docker"
 	"github.com/containerd/containerd/remotes"
-	"github.com/containerd/containerd/remotes/docker"
 	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	v1 "k8s.io/api/core/v1"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/apimachinery/pkg/watch"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/util/retry"
 )
 
 type architectureContainer struct {
+	OS           string `json:"os"`
 	Architecture string `json:"architecture"`
+	Variant      string `json:"variant,omitempty"`
 }
 
-func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
-	fetchCtx := containerd.RemoteContext{
-		Resolver: docker.NewResolver(
-			docker.ResolverOptions{},
-		),
+// schema1Manifest is a legacy Docker schema1 manifest, which holds the
+// image's architecture itself, and its OS within the v1 compatibility
+// history of the image's top-most layer.
+type schema1Manifest struct {
+	Architecture string `json:"architecture"`
+	History      []struct {
+		V1Compatibility string `json:"v1Compatibility"`
+	} `json:"history"`
+}
+
+// Legacy Docker schema1 manifest media types, which containerd only
+// partially defines.
+const (
+	mediaTypeDockerSchema1Manifest       = "application/vnd.docker.distribution.manifest.v1+json"
+	mediaTypeDockerSchema1ManifestSigned = images.MediaTypeDockerSchema1Manifest
+)
+
+// UnsupportedMediaTypeError is returned for content which is not a
+// runnable container image, such as OCI artifacts holding Helm charts or
+// WASM modules. Retrying does not help, as the content will never change.
+type UnsupportedMediaTypeError struct {
+	Ref       string
+	MediaType string
+}
+
+func (e *UnsupportedMediaTypeError) Error() string {
+	return fmt.Sprintf("%s is not a container image, has unsupported media type %s", e.Ref, e.MediaType)
+}
+
+// getArchitecturesWithKeyring gets the architectures for the given image,
+// using the credentials within the keyring that match the image.
+// The image is looked up from each of its locations given by the context's
+// RegistriesConfig in turn, such as mirrors, until a lookup succeeds.
+// Locations on hosts not allowed by the context's RegistryPolicy are skipped.
+func getArchitecturesWithKeyring(ctx *context.Context, ref string, keyring *RegistryKeyring) ([]ocispec.Platform, error) {
+	var err error
+	var architectures []ocispec.Platform
+	for _, location := range GetRegistriesConfig(ctx).Candidates(ref) {
+		// Mirrors may be allowed even if the image's own registry isn't
+		if named, parseErr := dockerref.ParseNormalizedNamed(location); parseErr == nil {
+			if host := dockerref.Domain(named); !GetRegistryPolicy(ctx).Allows(host) {
+				if err == nil {
+					err = &HostNotAllowedError{Host: host}
+				}
+				continue
+			}
+		}
+		architectures, err = getArchitecturesFromLocation(ctx, ref, location, keyring)
+		if err == nil {
+			return architectures, nil
+		}
+		log.Debug().
+			Str("ref", ref).
+			Str("location", location).
+			AnErr("err", err).
+			Msg("Unable to get architectures from location, trying next")
 	}
+	return nil, err
+}
 
-	// desc determines the 'thing' that is fetched later on.
-	// if desc describes a manifest, a manifest will be fetched,
-	// if desc describes an index, an index will be fetched,
-	// if desc describes a blob, a blob will be fetched
-	// See https://github.com/containerd/containerd/blob/9b33526ef64d921375598e0d568e98468d1ab81b/remotes/docker/fetcher.go#L39=
-	// and https://github.com/containerd/containerd/blob/9b33526ef64d921375598e0d568e98468d1ab81b/remotes/docker/resolver.go
-	_, desc, err := fetchCtx.Resolver.Resolve(*ctx, ref)
+// getArchitecturesFromLocation gets the architectures for the given image
+// from the given location of the image, using the credentials within
+// the keyring, the controller's own credentials or credential provider
+// plugins that match the location.
+// Same as the kubelet, each matching credential is tried in turn,
+// and anonymous access is only used if no credentials match.
+func getArchitecturesFromLocation(ctx *context.Context, ref string, location string, keyring *RegistryKeyring) ([]ocispec.Platform, error) {
+	auths := keyring.Lookup(location)
+	// Same as the kubelet, the pod's pull secrets come first, followed
+	// by cluster-wide credentials and credential provider plugins
+	auths = append(auths, GetControllerCredentials(ctx).Lookup(ctx, location)...)
+	auths = append(auths, GetCredentialProviders(ctx).Lookup(ctx, location)...)
+	if len(auths) == 0 {
+		return getArchitecturesFrom(ctx, ref, location, nil)
+	}
 
-	if err != nil {
-		log.Error().
+	var err error
+	var architectures []ocispec.Platform
+	for i := range auths {
+		architectures, err = getArchitecturesFrom(ctx, ref, location, &auths[i])
+		if err == nil {
+			return architectures, nil
+		}
+		// Rate limits apply to the registry, not the credential
+		var rateLimitErr *RateLimitError
+		if errors.As(err, &rateLimitErr) {
+			return nil, err
+		}
+		log.Debug().
+			Str("ref", ref).
+			Str("location", location).
+			Int("credential", i).
 			AnErr("err", err).
+			Msg("Unable to get architectures using credential, trying next")
+	}
+	return nil, err
+}
+
+// getArchitectures gets the platforms supported by the given image from its registry.
+// See getArchitecturesFrom.
+func getArchitectures(ctx *context.Context, ref string, auth *registryAuth) ([]ocispec.Platform, error) {
+	return getArchitecturesFrom(ctx, ref, ref, auth)
+}
+
+// getArchitecturesFrom gets the platforms supported by the given image from
+// the registry at the given location, which is either the image reference
+// itself or a mirrored or rewritten reference of the image.
+// Returned platforms are normalized, see normalizePlatform.
+// Results are stored within the context's ImageCache under the image
+// reference, if available, which is used to skip fetching content for
+// already known digests. Answering lookups purely from the cache is left
+// to the cacheResolver.
+func getArchitecturesFrom(ctx *context.Context, ref string, location string, auth *registryAuth) ([]ocispec.Platform, error) {
+	cache := GetImageCache(ctx)
+
+	getCacheLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
 			Str("ref", ref).
-			Msg("Unable to resolve image reference")
+			Str("location", location)
+	}
+
+	// Failures are cached per location and credential, as a failure using
+	// one credential or mirror does not mean another would fail
+	lookupKey := location + " " + auth.cacheKey()
+	addFailure := func(err error) {
+		// Rate limits are backed off from separately, see RateLimitError.
+		// Lookups aren't cut short by their callers, see DoShared.
+		var rateLimitErr *RateLimitError
+		if !errors.As(err, &rateLimitErr) {
+			cache.AddFailure(lookupKey, err)
+		}
+	}
+	if err, ok := cache.GetFailure(lookupKey); ok {
+		getCacheLog(zerolog.DebugLevel).
+			AnErr("err", err).
+			Msg("Got failed lookup from cache")
 		return nil, err
 	}
 
+	registry := GetRegistryClient(ctx)
+	result, err, shared := registry.Do(ctx, lookupKey, func(ctx *context.Context) (interface{}, error) {
+		resolver := registry.Resolver(auth)
+
+		// A tag whose cache entry has expired is revalidated against the
+		// digest it last resolved to
+		staleDigest, fresh, cached := cache.GetStaleTag(ref)
+		revalidating := cached && !fresh
+
+		// desc determines the 'thing' that is fetched later on.
+		// if desc describes a manifest, a manifest will be fetched,
+		// if desc describes an index, an index will be fetched,
+		// if desc describes a blob, a blob will be fetched
+		// See https://github.com/containerd/containerd/blob/9b33526ef64d921375598e0d568e98468d1ab81b/remotes/docker/fetcher.go#L39=
+		// and https://github.com/containerd/containerd/blob/9b33526ef64d921375598e0d568e98468d1ab81b/remotes/docker/resolver.go
+		// Resolving uses a manifest HEAD request, which gives the digest
+		// without counting as a pull on Docker Hub. The manifest itself is
+		// only fetched with a GET below if the digest isn't already cached.
+		_, desc, err := resolver.Resolve(*ctx, location)
+
+		if err != nil {
+			// A rate-limited registry can still be answered using the
+			// digest the tag last resolved to
+			var rateLimitErr *RateLimitError
+			if revalidating && errors.As(err, &rateLimitErr) {
+				if architectures, ok := cache.GetDigest(staleDigest); ok {
+					getCacheLog(zerolog.WarnLevel).
+						AnErr("err", err).
+						Str("digest", staleDigest.String()).
+						Msg("Unable to revalidate tag, using digest tag last resolved to")
+					return architectures, nil
+				}
+			}
+			getCacheLog(zerolog.ErrorLevel).
+				AnErr("err", err).
+				Msg("Unable to resolve image reference")
+			addFailure(err)
+			return nil, err
+		}
+		cache.AddTag(ref, desc.Digest)
+
+		if revalidating {
+			result := "unchanged"
+			if desc.Digest != staleDigest {
+				result = "changed"
+			}
+			tagRevalidationsCounter.WithLabelValues(result).Inc()
+			getCacheLog(zerolog.DebugLevel).
+				Str("digest", desc.Digest.String()).
+				Str("previous-digest", staleDigest.String()).
+				Msg("Revalidated cached tag")
+		}
+
+		if architectures, ok := cache.GetDigest(desc.Digest); ok {
+			getCacheLog(zerolog.DebugLevel).
+				Str("digest", desc.Digest.String()).
+				Msg("Got architectures for resolved digest from cache")
+			return architectures, nil
+		}
+
+		fetcher, err := resolver.Fetcher(*ctx, location)
+		if err != nil {
+			getCacheLog(zerolog.ErrorLevel).
+				AnErr("err", err).
+				Msg("Unable to create fetcher for image")
+			addFailure(err)
+			return nil, err
+		}
+
+		architectures, err := fetchArchitectures(ctx, fetcher, location, desc)
+		if err != nil {
+			addFailure(err)
+			return nil, err
+		}
+		cache.AddDigest(desc.Digest, architectures)
+		return architectures, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if shared {
+		getCacheLog(zerolog.DebugLevel).
+			Msg("Shared result of concurrent lookup")
+	}
+	return result.([]ocispec.Platform), nil
+}
+
+// fetchArchitectures fetches the content described by the given descriptor
+// through the given fetcher, returning the platforms the content supports.
+// The fetcher can be backed by a registry or by a local content store.
+func fetchArchitectures(ctx *context.Context, fetcher remotes.Fetcher, ref string, desc ocispec.Descriptor) ([]ocispec.Platform, error) {
 	getLog := func(level zerolog.Level) *zerolog.Event {
 		return log.WithLevel(level).
 			Str("name", ref)
@@ -61,9 +272,17 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 		Interface("desc", desc).
 		Msg("Resolved image reference")
 
-	// fetchBytes uses the given Fetcher to get the given Descriptor.
-	// Essentially a wrapper around the given fetcher's Fetch method.
-	fetchBytes := func(fetcher remotes.Fetcher, desc ocispec.Descriptor) ([]byte, error) {
+	policy := GetRegistryPolicy(ctx)
+
+	// fetchBytes uses the fetcher to get the given Descriptor,
+	// reading no more than the given limit, if positive.
+	// Essentially a wrapper around the fetcher's Fetch method.
+	fetchBytes := func(desc ocispec.Descriptor, limit int64) ([]byte, error) {
+		// The descriptor's size can't be trusted, so the content
+		// is limited while reading as well
+		if limit > 0 && desc.Size > limit {
+			return nil, &ContentTooLargeError{MediaType: desc.MediaType, Size: desc.Size, Limit: limit}
+		}
 		fetchedContentReader, err := fetcher.Fetch(*ctx, desc)
 		if err != nil {
 			getLog(zerolog.ErrorLevel).
@@ -71,14 +290,22 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 				Msg("Unable to fetch content defined by descriptor")
 			return nil, err
 		}
+		defer fetchedContentReader.Close()
+		var contentReader io.Reader = fetchedContentReader
+		if limit > 0 {
+			contentReader = io.LimitReader(fetchedContentReader, limit+1)
+		}
 		fetchedContentBuffer := bytes.Buffer{}
-		_, err = fetchedContentBuffer.ReadFrom(fetchedContentReader)
+		_, err = fetchedContentBuffer.ReadFrom(contentReader)
 		if err != nil {
 			getLog(zerolog.ErrorLevel).
 				AnErr("err", err).
 				Msg("Unable to read remote content")
 			return nil, err
 		}
+		if limit > 0 && int64(fetchedContentBuffer.Len()) > limit {
+			return nil, &ContentTooLargeError{MediaType: desc.MediaType, Size: -1, Limit: limit}
+		}
 		fetchedContentBytes := fetchedContentBuffer.Bytes()
 		getLog(zerolog.DebugLevel).
 			Str("media-type", desc.MediaType).
@@ -99,23 +326,16 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 		return nil
 	}
 
-	imageFetcher, err := fetchCtx.Resolver.Fetcher(*ctx, ref)
-	if err != nil {
-		getLog(zerolog.ErrorLevel).
-			AnErr("err", err).
-			Msg("Unable to create fetcher for image")
-		return nil, err
-	}
-
-	fetchedManifestBytes, err := fetchBytes(imageFetcher, desc)
-	if err != nil {
-		return nil, err
-	}
+	// handleDescriptor fetches the content described by the given
+	// descriptor, returning the platforms it supports. depth counts
+	// the number of indexes the descriptor is nested within.
+	var handleDescriptor func(desc ocispec.Descriptor, depth int) ([]ocispec.Platform, error)
 
 	// handleIndex is called when the fetchedContentBytes represents an
 	// oci Index.
-	handleIndex := func() ([]string, error) {
+	handleIndex := func(fetchedManifestBytes []byte, depth int) ([]ocispec.Platform, error) {
 		getLog(zerolog.DebugLevel).
+			Int("depth", depth).
 			Msg("Got index for image")
 		var index ocispec.Index
 		if err := unmarshal(fetchedManifestBytes, &index); err != nil {
@@ -124,12 +344,33 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 		getLog(zerolog.DebugLevel).
 			Interface("index", index).
 			Msg("Unmarshalled index")
-		var architectures []string = make([]string, 0)
+		var architectures []ocispec.Platform = make([]ocispec.Platform, 0)
 		for _, manifest := range index.Manifests {
-			architectures = append(architectures, manifest.Platform.Architecture)
+			// Attestations (such as BuildKit's provenance and SBOMs)
+			// are stored alongside images, but aren't runnable
+			if isAttestation(manifest) {
+				getLog(zerolog.DebugLevel).
+					Str("digest", manifest.Digest.String()).
+					Msg("Skipping attestation within index")
+				continue
+			}
+			if images.IsIndexType(manifest.MediaType) || manifest.Platform == nil || manifest.Platform.Architecture == "" {
+				// Nested indexes and entries without a platform
+				// are resolved from their own content
+				childArchitectures, err := handleDescriptor(manifest, depth+1)
+				if err != nil {
+					return nil, err
+				}
+				architectures = append(architectures, childArchitectures...)
+				continue
+			}
+			architectures = append(architectures, normalizePlatform(*manifest.Platform))
+		}
+		if len(architectures) == 0 {
+			return nil, fmt.Errorf("index of %s has no runnable platforms", ref)
 		}
 		getLog(zerolog.DebugLevel).
-			Str("architectures", strings.Join(architectures, ", ")).
+			Str("architectures", formatPlatforms(architectures)).
 			Msg("Got architectures for image")
 		return architectures, nil
 	}
@@ -139,7 +380,7 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 	// Manifests may not contain an architecture, must pull
 	// from the manifest's blob.
 	// See https://github.com/docker/cli/blob/c59773f1551a8fd289538efc82274332f31f8c19/cli/registry/client/fetcher.go#L75=
-	handleManifest := func() ([]string, error) {
+	handleManifest := func(fetchedManifestBytes []byte) ([]ocispec.Platform, error) {
 		getLog(zerolog.DebugLevel).
 			Msg("Got manifest for image")
 		// First pull the manifest itself
@@ -151,8 +392,15 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 			Interface("manifest", manifest).
 			Msg("Unmarshalled manifest")
 
+		// Artifacts use the manifest format, but with their own config
+		switch manifest.Config.MediaType {
+		case "", images.MediaTypeDockerSchema2Config, ocispec.MediaTypeImageConfig:
+		default:
+			return nil, &UnsupportedMediaTypeError{Ref: ref, MediaType: manifest.Config.MediaType}
+		}
+
 		if manifest.Config.Platform != nil && manifest.Config.Platform.Architecture != "" {
-			return []string{manifest.Config.Platform.Architecture}, nil
+			return []ocispec.Platform{normalizePlatform(*manifest.Config.Platform)}, nil
 		}
 		// When we fetch the image's digest with a blank mediaType,
 		// containerd will use the blob endpoint on the registry.
@@ -164,18 +412,8 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 			Digest:    manifest.Config.Digest,
 			Size:      manifest.Config.Size,
 		}
-		manifestFetcher, err := docker.NewResolver(
-			docker.ResolverOptions{},
-		).Fetcher(*ctx, ref)
-		if err != nil {
-			getLog(zerolog.WarnLevel).
-				AnErr("err", err).
-				Msg("Unable to create new fetcher for docker v2 manifest")
-			return nil, err
-		}
-
 		// Get the response from the fetcher
-		imageConfigBytes, err := fetchBytes(manifestFetcher, manifestDesc)
+		imageConfigBytes, err := fetchBytes(manifestDesc, policy.MaxConfigSize)
 		if err != nil {
 			return nil, err
 		}
@@ -184,7 +422,7 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 		if err := unmarshal(imageConfigBytes, &myArchContainer); err != nil {
 			return nil, err
 		}
-		if myArchContainer.Architecture == "" {
+		if myArchContainer.Architecture == "" || myArchContainer.Architecture == "unknown" {
 			err = fmt.Errorf(
 				"unable to parse architecture from pulled image config for %s",
 				ref,
@@ -194,36 +432,213 @@ func getArchitectures(ctx *context.Context, ref string) ([]string, error) {
 				Msg(err.Error())
 			return nil, err
 		}
-		return []string{myArchContainer.Architecture}, nil
+		return []ocispec.Platform{
+			normalizePlatform(
+				ocispec.Platform{
+					OS:           myArchContainer.OS,
+					Architecture: myArchContainer.Architecture,
+					Variant:      myArchContainer.Variant,
+				},
+			),
+		}, nil
 	}
 
-	if images.IsIndexType(desc.MediaType) {
-		return handleIndex()
-	} else if images.IsManifestType(desc.MediaType) {
-		return handleManifest()
-	} else {
-		err := fmt.Errorf("unknown media type: %s", desc.MediaType)
-		getLog(zerolog.ErrorLevel).
-			AnErr("err", err)
-		return nil, err
+	// handleSchema1Manifest is called when the fetchedContentBytes
+	// represents a legacy Docker schema1 manifest, signed or unsigned.
+	handleSchema1Manifest := func(fetchedManifestBytes []byte) ([]ocispec.Platform, error) {
+		getLog(zerolog.DebugLevel).
+			Msg("Got schema1 manifest for image")
+		var manifest schema1Manifest
+		if err := unmarshal(fetchedManifestBytes, &manifest); err != nil {
+			return nil, err
+		}
+		if manifest.Architecture == "" {
+			return nil, fmt.Errorf("schema1 manifest of %s has no architecture", ref)
+		}
+
+		// The first history entry describes the image's top-most layer
+		platform := ocispec.Platform{
+			OS:           "linux",
+			Architecture: manifest.Architecture,
+		}
+		if len(manifest.History) > 0 {
+			var v1Compatibility architectureContainer
+			if err := json.Unmarshal([]byte(manifest.History[0].V1Compatibility), &v1Compatibility); err == nil && v1Compatibility.OS != "" {
+				platform.OS = v1Compatibility.OS
+			}
+		}
+		return []ocispec.Platform{normalizePlatform(platform)}, nil
 	}
 
+	handleDescriptor = func(desc ocispec.Descriptor, depth int) ([]ocispec.Platform, error) {
+		if depth > MAX_INDEX_DEPTH {
+			return nil, fmt.Errorf("indexes of %s are nested more than %d levels deep", ref, MAX_INDEX_DEPTH)
+		}
+
+		fetchedManifestBytes, err := fetchBytes(desc, policy.MaxManifestSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if images.IsIndexType(desc.MediaType) {
+			return handleIndex(fetchedManifestBytes, depth)
+		} else if images.IsManifestType(desc.MediaType) {
+			return handleManifest(fetchedManifestBytes)
+		} else if desc.MediaType == mediaTypeDockerSchema1Manifest || desc.MediaType == mediaTypeDockerSchema1ManifestSigned {
+			return handleSchema1Manifest(fetchedManifestBytes)
+		} else {
+			err := &UnsupportedMediaTypeError{Ref: ref, MediaType: desc.MediaType}
+			getLog(zerolog.ErrorLevel).
+				AnErr("err", err).
+				Msg("Unable to handle content with unknown media type")
+			return nil, err
+		}
+	}
+
+	return handleDescriptor(desc, 0)
 }
 
-func handlePod(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface) error {
-	name := pod.Name
-	podClient := clientset.CoreV1().Pods(pod.Namespace)
+// isAttestation determines if the given index entry describes an
+// attestation rather than an image, such as those created by BuildKit.
+func isAttestation(desc ocispec.Descriptor) bool {
+	if desc.Annotations["vnd.docker.reference.type"] == "attestation-manifest" {
+		return true
+	}
+	return desc.Platform != nil &&
+		desc.Platform.OS == "unknown" &&
+		desc.Platform.Architecture == "unknown"
+}
+
+// checkEphemeralContainers ensures the images of the given pod's ephemeral
+// containers can run on the node the pod is already scheduled onto.
+// As ephemeral containers are added after the pod is scheduled, they
+// cannot influence the pod's tolerations, so an event is recorded on
+// the pod for each incompatible ephemeral container instead.
+func checkEphemeralContainers(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface, keyring *RegistryKeyring) {
+	if len(pod.Spec.EphemeralContainers) == 0 || pod.Spec.NodeName == "" {
+		return
+	}
+
+	getPodLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("pod-name", pod.Name).
+			Str("node-name", pod.Spec.NodeName).
+			Int("num_ephemeral_containers", len(pod.Spec.EphemeralContainers))
+	}
+
+	node, err := clientset.CoreV1().Nodes().Get(
+		*ctx,
+		pod.Spec.NodeName,
+		metav1.GetOptions{},
+	)
+	if err != nil {
+		getPodLog(zerolog.WarnLevel).
+			AnErr("err", err).
+			Msg("Unable to get node of pod, skipping ephemeral container check")
+		return
+	}
+	nodeArch := getNodeTaintValue(ctx, node)
+
+	for _, container := range pod.Spec.EphemeralContainers {
+		getContainerLog := func(level zerolog.Level) *zerolog.Event {
+			return getPodLog(level).
+				Str("container-name", container.Name).
+				Str("container-image", container.Image)
+		}
+
+		architectures, err := GetResolverChain(ctx).Resolve(
+			ctx,
+			&ImageRequest{
+				Pod:       pod,
+				Container: container.Name,
+				Image:     container.Image,
+				Keyring:   keyring,
+			},
+		)
+		if err != nil {
+			getContainerLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to get architectures for ephemeral container")
+			continue
+		}
+
+		if len(Intersection(getTaintValues(architectures), []string{nodeArch})) > 0 {
+			continue
+		}
+
+		getContainerLog(zerolog.WarnLevel).
+			Str("architectures", formatPlatforms(architectures)).
+			Str("node-arch", nodeArch).
+			Msg("Ephemeral container is incompatible with the pod's node")
+		if recorder := GetEventRecorder(ctx); recorder != nil {
+			recorder.Eventf(
+				pod,
+				v1.EventTypeWarning,
+				"IncompatibleEphemeralContainer",
+				"Image %s of ephemeral container %s supports platforms [%s], but node %s is %s",
+				container.Image,
+				container.Name,
+				formatPlatforms(architectures),
+				pod.Spec.NodeName,
+				nodeArch,
+			)
+		}
+	}
+}
+
+// missingTolerations returns the tolerations within desired whose
+// key and value are not present within existing.
+func missingTolerations(existing []v1.Toleration, desired []v1.Toleration) []v1.Toleration {
+	missing := make([]v1.Toleration, 0)
+	for _, want := range desired {
+		found := false
+		for _, tol := range existing {
+			if tol.Key == want.Key && tol.Value == want.Value {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, want)
+		}
+	}
+	return missing
+}
+
+// getPodPlacement resolves the platforms supported by each of the pod's
+// containers, returning where the pod can be placed: onto nodes supporting
+// all of them.
+// No placement is returned for pods which should be left as-is, such as
+// those with images which will never resolve.
+func getPodPlacement(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface) (*podPlacement, error) {
+	// Init containers (including sidecars) run on the same node as the
+	// pod's regular containers, so they constrain the pod's architectures too.
+	containers := make([]v1.Container, 0, len(pod.Spec.InitContainers)+len(pod.Spec.Containers))
+	containers = append(containers, pod.Spec.InitContainers...)
+	containers = append(containers, pod.Spec.Containers...)
 
 	getPodLog := func(level zerolog.Level) *zerolog.Event {
 		return log.WithLevel(level).
-			Str("pod-name", name).
-			Int("num_containers", len(pod.Spec.Containers))
+			Str("pod-name", pod.Name).
+			Int("num_containers", len(containers))
 	}
 	getPodLog(zerolog.InfoLevel).
 		Msg("Got pod")
 
+	keyring, err := getPodKeyring(ctx, pod, clientset)
+	if err != nil {
+		getPodLog(zerolog.ErrorLevel).
+			AnErr("err", err).
+			Msg("Unable to get pull secrets for pod")
+		return nil, err
+	}
+
+	checkEphemeralContainers(ctx, pod, clientset, keyring)
+
+	taintValueLists := make([][]string, 0)
 	architectureLists := make([][]string, 0)
-	for _, container := range pod.Spec.Containers {
+	osLists := make([][]string, 0)
+	for _, container := range containers {
 		getContainerLog := func(level zerolog.Level) *zerolog.Event {
 			return log.WithLevel(level).
 				Str("container-name", container.Name).
@@ -232,40 +647,193 @@ func handlePod(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface
 		getContainerLog(zerolog.DebugLevel).
 			Msg("Got container")
 
-		architectures, err := getArchitectures(ctx, container.Image)
+		architectures, err := GetResolverChain(ctx).Resolve(
+			ctx,
+			&ImageRequest{
+				Pod:       pod,
+				Container: container.Name,
+				Image:     container.Image,
+				Keyring:   keyring,
+			},
+		)
+		// Content which isn't a container image will never resolve,
+		// so report it on the pod rather than retrying
+		var unsupportedErr *UnsupportedMediaTypeError
+		if errors.As(err, &unsupportedErr) {
+			getContainerLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Container image is not a runnable image, skipping pod")
+			if recorder := GetEventRecorder(ctx); recorder != nil {
+				recorder.Eventf(
+					pod,
+					v1.EventTypeWarning,
+					"UnsupportedImageMediaType",
+					"Image %s of container %s has media type %s, which is not a runnable container image",
+					container.Image,
+					container.Name,
+					unsupportedErr.MediaType,
+				)
+			}
+			return nil, nil
+		}
+		// Neither will images on registries the controller may not contact
+		var hostErr *HostNotAllowedError
+		if errors.As(err, &hostErr) {
+			getContainerLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Container image is on a registry which is not allowed, skipping pod")
+			if recorder := GetEventRecorder(ctx); recorder != nil {
+				recorder.Eventf(
+					pod,
+					v1.EventTypeWarning,
+					"RegistryNotAllowed",
+					"Image %s of container %s requires contacting %s, which the controller is not allowed to contact",
+					container.Image,
+					container.Name,
+					hostErr.Host,
+				)
+			}
+			return nil, nil
+		}
+		// Nor will images whose content is larger than the policy allows
+		var tooLargeErr *ContentTooLargeError
+		if errors.As(err, &tooLargeErr) {
+			getContainerLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Container image content is larger than allowed, skipping pod")
+			if recorder := GetEventRecorder(ctx); recorder != nil {
+				recorder.Eventf(
+					pod,
+					v1.EventTypeWarning,
+					"ImageContentTooLarge",
+					"Image %s of container %s could not be inspected: %s",
+					container.Image,
+					container.Name,
+					tooLargeErr.Error(),
+				)
+			}
+			return nil, nil
+		}
+		// Nor will invalid architecture annotations, until they're changed
+		var annotationErr *InvalidAnnotationError
+		if errors.As(err, &annotationErr) {
+			getContainerLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Container has an invalid architecture annotation, skipping pod")
+			if recorder := GetEventRecorder(ctx); recorder != nil {
+				recorder.Eventf(
+					pod,
+					v1.EventTypeWarning,
+					"InvalidArchitectureAnnotation",
+					"Annotation %s has invalid value %q for container %s: %v",
+					annotationErr.Annotation,
+					annotationErr.Value,
+					container.Name,
+					annotationErr.Err,
+				)
+			}
+			return nil, nil
+		}
 		if err != nil {
 			getContainerLog(zerolog.ErrorLevel).
 				AnErr("err", err).
 				Msg("Unable to get architectures for container")
-			return err
+			return nil, err
 		}
+		getContainerLog(zerolog.DebugLevel).
+			Str("architectures", formatPlatforms(architectures)).
+			Msg("Got architectures for container")
+		taintValueLists = append(
+			taintValueLists,
+			getTaintValues(architectures),
+		)
 		architectureLists = append(
 			architectureLists,
-			architectures,
+			getArchitectureNames(architectures),
+		)
+		osLists = append(
+			osLists,
+			getOperatingSystems(architectures, getPodOS(pod)),
 		)
 	}
-	architectures := Intersection(architectureLists...)
+	// taintValues holds the supported-arch taint values the pod tolerates
+	taintValues := Intersection(taintValueLists...)
+	operatingSystems := Intersection(osLists...)
 	getPodLog(zerolog.InfoLevel).
-		Str("architectures", strings.Join(architectures, ", ")).
+		Str("architectures", strings.Join(taintValues, ", ")).
+		Str("operating-systems", strings.Join(operatingSystems, ", ")).
 		Msg("Got intersection of architectures for pod")
 
-	missingArchMap := make(map[string]bool)
-	for _, arch := range architectures {
-		missingArchMap[arch] = true
+	// The scheduler does not use spec.os, so narrow the pod's operating
+	// systems down to the declared one, reporting when the two disagree.
+	if pod.Spec.OS != nil && pod.Spec.OS.Name != "" {
+		declaredOS := string(pod.Spec.OS.Name)
+		if len(Intersection(operatingSystems, []string{declaredOS})) == 0 {
+			getPodLog(zerolog.WarnLevel).
+				Str("declared-os", declaredOS).
+				Str("operating-systems", strings.Join(operatingSystems, ", ")).
+				Msg("Pod's declared operating system is not supported by its images")
+			if recorder := GetEventRecorder(ctx); recorder != nil {
+				recorder.Eventf(
+					pod,
+					v1.EventTypeWarning,
+					"OperatingSystemMismatch",
+					"Pod declares operating system %s, but its images support [%s]",
+					declaredOS,
+					strings.Join(operatingSystems, ", "),
+				)
+			}
+			operatingSystems = []string{}
+		} else {
+			operatingSystems = []string{declaredOS}
+		}
+	}
+
+	return &podPlacement{
+		taintValues:      taintValues,
+		architectures:    Intersection(architectureLists...),
+		operatingSystems: operatingSystems,
+	}, nil
+}
+
+func handlePod(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface) error {
+	name := pod.Name
+	podClient := clientset.CoreV1().Pods(pod.Namespace)
+
+	getPodLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("pod-name", name)
+	}
+
+	placement, err := getPodPlacement(ctx, pod, clientset)
+	if hasSchedulingGate(pod) {
+		return handleGatedPod(ctx, pod, clientset, placement, err)
+	}
+	if err != nil || placement == nil {
+		return err
 	}
 
-	missingArchs := len(architectures)
-	for _, tol := range pod.Spec.Tolerations {
-		if tol.Key == ARCH_TAINT_KEY_NAME {
-			if _, ok := missingArchMap[tol.Value]; ok {
-				// Mark this toleration as already present
-				missingArchMap[tol.Value] = false
-				missingArchs -= 1
+	// Node affinity can't be changed once a pod has been created, so
+	// pods created while the admission webhook was down are only reported
+	if GetPlacementMode(ctx) == PlacementModeAffinity {
+		if _, changed := mergeNodeAffinity(pod.Spec.Affinity, placement.nodeSelectorRequirements()); changed {
+			getPodLog(zerolog.WarnLevel).
+				Msg("Pod was created without node affinity for its architectures")
+			if recorder := GetEventRecorder(ctx); recorder != nil {
+				recorder.Eventf(
+					pod,
+					v1.EventTypeWarning,
+					"MissingNodeAffinity",
+					"Pod was created without node affinity for architectures [%s], which can only be added on creation",
+					strings.Join(placement.architectures, ", "),
+				)
 			}
 		}
+		return nil
 	}
 
-	if missingArchs == 0 {
+	desiredTolerations := placement.tolerations()
+	if len(missingTolerations(pod.Spec.Tolerations, desiredTolerations)) == 0 {
 		getPodLog(zerolog.InfoLevel).
 			Msg("Pod tolerations up to date, doing nothing")
 		return nil
@@ -290,34 +858,33 @@ func handlePod(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface
 			Msg("pod's current tolerations before update")
 
 		// Add missing tolerations
-		for arch, toAdd := range missingArchMap {
-			if !toAdd {
-				continue
-			}
-			result.Spec.Tolerations = append(
-				result.Spec.Tolerations,
-				v1.Toleration{
-					Key:    ARCH_TAINT_KEY_NAME,
-					Value:  arch,
-					Effect: v1.TaintEffectNoSchedule,
-				},
-			)
+		spec := placementPatch(ctx, &result.Spec, placement)
+		if spec == nil {
+			getPodLog(zerolog.InfoLevel).
+				Msg("Pod tolerations up to date, doing nothing")
+			return nil
 		}
 
 		getPodLog(zerolog.DebugLevel).
-			Interface("pod-tols", result.Spec.Tolerations).
+			Interface("pod-tols", spec["tolerations"]).
 			Msg("Applying the following tolerations")
 
-		_, updateErr := podClient.Update(
+		patch, encodeErr := podSpecPatch(result, spec)
+		if encodeErr != nil {
+			return encodeErr
+		}
+		_, patchErr := podClient.Patch(
 			*ctx,
-			result,
-			metav1.UpdateOptions{},
+			name,
+			types.StrategicMergePatchType,
+			patch,
+			metav1.PatchOptions{},
 		)
-		if updateErr != nil {
+		if patchErr != nil {
 			getPodLog(zerolog.WarnLevel).
-				AnErr("err", updateErr).
+				AnErr("err", patchErr).
 				Msg("Unable to update tolerations on pod")
-			return updateErr
+			return patchErr
 		}
 
 		getPodLog(zerolog.InfoLevel).
@@ -352,17 +919,25 @@ func EnsurePodTolerations(ctx *context.Context) {
 		return
 	}
 
-	handlePodWrapper := func(pod *v1.Pod, wg *sync.WaitGroup) {
+	var handlePodWrapper func(pod *v1.Pod, wg *sync.WaitGroup)
+	handlePodWrapper = func(pod *v1.Pod, wg *sync.WaitGroup) {
 		if wg != nil {
 			defer wg.Done()
 		}
 
-		RetryOnError(
+		_, err := RetryOnError(
 			ctx,
 			func() error {
 				return handlePod(ctx, pod, clientset)
 			},
 		)
+		// Gated pods whose images are still unresolved are handled again
+		// once their gate times out, rather than at the next reconciliation
+		if err != nil && hasSchedulingGate(pod) {
+			if wait := time.Until(schedulingGateDeadline(ctx, pod)); wait > 0 {
+				time.AfterFunc(wait, func() { handlePodWrapper(pod, nil) })
+			}
+		}
 	}
 
 	for {
@@ -1,15 +1,34 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
 	"testing"
+
+	"github.com/containerd/containerd/errdefs"
+	"github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
 )
 
-func contains(slice []string, target string) bool {
+func contains(slice []ocispec.Platform, target string) bool {
 	for _, value := range slice {
-		if value == target {
+		if value.Architecture == target {
 			return true
 		}
 	}
@@ -26,7 +45,7 @@ func ensureGetArchWorksForIndex(t *testing.T, registry string, ns_var string) {
 	index := fmt.Sprintf("%s/%s/archaware-testimg:index", registry, ns)
 
 	ctx := context.Background()
-	archs, err := getArchitectures(&ctx, index)
+	archs, err := getArchitectures(&ctx, index, nil)
 
 	if err != nil {
 		t.Error(err)
@@ -52,11 +71,11 @@ func ensureArchWorksForManifest(t *testing.T, registry string, ns_var string) {
 
 	ctx := context.Background()
 	var manifest string
-	var archs []string
+	var archs []ocispec.Platform
 	var err error
 	for _, arch := range manifestTests {
 		manifest = makeManifest(arch)
-		archs, err = getArchitectures(&ctx, manifest)
+		archs, err = getArchitectures(&ctx, manifest, nil)
 		if err != nil {
 			t.Error(err)
 			t.FailNow()
@@ -82,3 +101,353 @@ func TestEnsureGetArchWorksForDockerManifest(t *testing.T) {
 func TestEnsureGetArchWorksForOCIManifest(t *testing.T) {
 	ensureArchWorksForManifest(t, "quay.io", "QUAY_NS")
 }
+
+// memoryFetcher serves content from memory, keyed by digest.
+type memoryFetcher map[digest.Digest][]byte
+
+func (f memoryFetcher) Fetch(ctx context.Context, desc ocispec.Descriptor) (io.ReadCloser, error) {
+	data, ok := f[desc.Digest]
+	if !ok {
+		return nil, fmt.Errorf("%s: %w", desc.Digest, errdefs.ErrNotFound)
+	}
+	return io.NopCloser(bytes.NewReader(data)), nil
+}
+
+// add stores the given value as JSON, returning its descriptor.
+func (f memoryFetcher) add(t *testing.T, mediaType string, value interface{}) ocispec.Descriptor {
+	data, err := json.Marshal(value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(data)
+	f[dgst] = data
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(data))}
+}
+
+func TestFetchArchitecturesIndexEntries(t *testing.T) {
+	fetcher := make(memoryFetcher)
+
+	// An entry without a platform is resolved from its config
+	config := fetcher.add(t, ocispec.MediaTypeImageConfig, architectureContainer{OS: "linux", Architecture: "arm64"})
+	noPlatform := fetcher.add(t, ocispec.MediaTypeImageManifest, ocispec.Manifest{Config: config})
+
+	nested := fetcher.add(t, ocispec.MediaTypeImageIndex, ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("s390x"), Platform: &ocispec.Platform{OS: "linux", Architecture: "s390x"}},
+		},
+	})
+
+	index := fetcher.add(t, ocispec.MediaTypeImageIndex, ocispec.Index{
+		Manifests: []ocispec.Descriptor{
+			{MediaType: ocispec.MediaTypeImageManifest, Digest: digest.FromString("amd64"), Platform: &ocispec.Platform{OS: "linux", Architecture: "amd64"}},
+			{
+				MediaType:   ocispec.MediaTypeImageManifest,
+				Digest:      digest.FromString("attestation"),
+				Platform:    &ocispec.Platform{OS: "unknown", Architecture: "unknown"},
+				Annotations: map[string]string{"vnd.docker.reference.type": "attestation-manifest"},
+			},
+			noPlatform,
+			nested,
+		},
+	})
+
+	ctx := context.Background()
+	platforms, err := fetchArchitectures(&ctx, fetcher, "example.com/image:latest", index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(platforms) != 3 || !contains(platforms, "amd64") || !contains(platforms, "arm64") || !contains(platforms, "s390x") {
+		t.Errorf("unexpected platforms: %s", formatPlatforms(platforms))
+	}
+
+	// Indexes nested too deeply are rejected rather than followed forever
+	loop := index
+	for i := 0; i <= MAX_INDEX_DEPTH; i++ {
+		loop = fetcher.add(t, ocispec.MediaTypeImageIndex, ocispec.Index{Manifests: []ocispec.Descriptor{loop}})
+	}
+	if _, err := fetchArchitectures(&ctx, fetcher, "example.com/image:latest", loop); err == nil {
+		t.Errorf("expected deeply nested indexes to be rejected")
+	}
+}
+
+func TestFetchArchitecturesMediaTypes(t *testing.T) {
+	fetcher := make(memoryFetcher)
+	ctx := context.Background()
+
+	schema1 := fetcher.add(t, mediaTypeDockerSchema1ManifestSigned, map[string]interface{}{
+		"schemaVersion": 1,
+		"architecture":  "arm",
+		"history": []map[string]string{
+			{"v1Compatibility": `{"os":"linux","architecture":"arm"}`},
+		},
+	})
+	platforms, err := fetchArchitectures(&ctx, fetcher, "example.com/legacy:latest", schema1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(platforms) != 1 || platforms[0].OS != "linux" || platforms[0].Architecture != "arm" {
+		t.Errorf("unexpected platforms for schema1 manifest: %s", formatPlatforms(platforms))
+	}
+
+	chartConfig := fetcher.add(t, "application/vnd.cncf.helm.config.v1+json", map[string]string{"name": "chart"})
+	chart := fetcher.add(t, ocispec.MediaTypeImageManifest, ocispec.Manifest{Config: chartConfig})
+	var unsupportedErr *UnsupportedMediaTypeError
+	if _, err := fetchArchitectures(&ctx, fetcher, "example.com/chart:1.0", chart); !errors.As(err, &unsupportedErr) {
+		t.Errorf("expected helm chart to be unsupported, got %v", err)
+	}
+
+	unknown := fetcher.add(t, "application/vnd.example.unknown+json", map[string]string{})
+	if _, err := fetchArchitectures(&ctx, fetcher, "example.com/unknown:1.0", unknown); !errors.As(err, &unsupportedErr) {
+		t.Errorf("expected unknown media type to be unsupported, got %v", err)
+	}
+}
+
+func TestFetchArchitecturesSizeLimits(t *testing.T) {
+	fetcher := make(memoryFetcher)
+	config := fetcher.add(t, ocispec.MediaTypeImageConfig, architectureContainer{OS: "linux", Architecture: "arm64"})
+	manifest := fetcher.add(t, ocispec.MediaTypeImageManifest, ocispec.Manifest{Config: config})
+
+	policy, err := parseRegistryPolicy("", "", "allow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy.MaxManifestSize = manifest.Size
+	ctx := context.WithValue(context.Background(), REGISTRY_POLICY_KEY, policy)
+	if _, err := fetchArchitectures(&ctx, fetcher, "example.com/image:latest", manifest); err != nil {
+		t.Fatalf("expected manifest within the limit to be fetched: %v", err)
+	}
+
+	policy.MaxManifestSize = manifest.Size - 1
+	var tooLargeErr *ContentTooLargeError
+	if _, err := fetchArchitectures(&ctx, fetcher, "example.com/image:latest", manifest); !errors.As(err, &tooLargeErr) {
+		t.Errorf("expected manifest larger than the limit to be rejected, got %v", err)
+	}
+
+	// Content larger than its descriptor claims is rejected as well
+	understated := manifest
+	understated.Size = 1
+	if _, err := fetchArchitectures(&ctx, fetcher, "example.com/image:latest", understated); !errors.As(err, &tooLargeErr) {
+		t.Errorf("expected manifest with an understated size to be rejected, got %v", err)
+	}
+}
+
+// newTestRegistry serves an image index for each of the given images, listing
+// the given os/arch[/variant] platforms, returning the host of the registry.
+// The registry is on localhost, so it's reached over plain HTTP.
+func newTestRegistry(t *testing.T, images map[string][]string) string {
+	indexes := make(map[string][]byte)
+	for image, platforms := range images {
+		index := ocispec.Index{
+			Versioned: specs.Versioned{SchemaVersion: 2},
+			MediaType: ocispec.MediaTypeImageIndex,
+		}
+		for _, platform := range platforms {
+			parts := strings.Split(platform, "/")
+			descriptor := ocispec.Descriptor{
+				MediaType: ocispec.MediaTypeImageManifest,
+				Digest:    digest.FromString(image + platform),
+				Size:      1,
+				Platform:  &ocispec.Platform{OS: parts[0], Architecture: parts[1]},
+			}
+			if len(parts) > 2 {
+				descriptor.Platform.Variant = parts[2]
+			}
+			index.Manifests = append(index.Manifests, descriptor)
+		}
+		data, err := json.Marshal(index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		name, tag, _ := strings.Cut(image, ":")
+		indexes["/v2/"+name+"/manifests/"+tag] = data
+		indexes["/v2/"+name+"/manifests/"+digest.FromBytes(data).String()] = data
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		data, ok := indexes[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", ocispec.MediaTypeImageIndex)
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(data).String())
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method != http.MethodHead {
+			w.Write(data)
+		}
+	}))
+	t.Cleanup(server.Close)
+	return strings.TrimPrefix(server.URL, "http://")
+}
+
+// getTolerationValues returns the sorted values of the given tolerations with the given key.
+func getTolerationValues(tolerations []v1.Toleration, key string) []string {
+	values := make([]string, 0)
+	for _, toleration := range tolerations {
+		if toleration.Key == key {
+			values = append(values, toleration.Value)
+		}
+	}
+	sort.Strings(values)
+	return values
+}
+
+func TestHandlePodInitContainers(t *testing.T) {
+	registry := newTestRegistry(t, map[string][]string{
+		"app:1.0":     {"linux/amd64", "linux/arm64", "linux/s390x"},
+		"init:1.0":    {"linux/amd64", "linux/arm64"},
+		"sidecar:1.0": {"linux/arm64", "linux/amd64", "linux/ppc64le"},
+	})
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.PodSpec{
+			InitContainers: []v1.Container{
+				{Name: "init", Image: registry + "/init:1.0"},
+				{Name: "sidecar", Image: registry + "/sidecar:1.0"},
+			},
+			Containers: []v1.Container{{Name: "app", Image: registry + "/app:1.0"}},
+		},
+	}
+	clientset := fake.NewSimpleClientset(pod)
+
+	ctx := context.Background()
+	if err := handlePod(&ctx, pod, clientset); err != nil {
+		t.Fatal(err)
+	}
+	result, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The init containers constrain the pod's architectures too
+	expected := getTaintValues([]ocispec.Platform{
+		normalizePlatform(ocispec.Platform{OS: "linux", Architecture: "amd64"}),
+		normalizePlatform(ocispec.Platform{OS: "linux", Architecture: "arm64"}),
+	})
+	sort.Strings(expected)
+	if values := getTolerationValues(result.Spec.Tolerations, ARCH_TAINT_KEY_NAME); !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected architectures: %v, expected %v", values, expected)
+	}
+}
+
+func TestCheckEphemeralContainers(t *testing.T) {
+	registry := newTestRegistry(t, map[string][]string{
+		"debug:1.0": {"linux/arm64"},
+		"debug:2.0": {"linux/amd64", "linux/arm64"},
+	})
+	recorder := record.NewFakeRecorder(10)
+	ctx := context.WithValue(context.Background(), K8S_EVENT_RECORDER_KEY, recorder)
+	clientset := fake.NewSimpleClientset(&v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: "node"},
+		Status: v1.NodeStatus{
+			NodeInfo: v1.NodeSystemInfo{Architecture: "amd64", OperatingSystem: "linux"},
+		},
+	})
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.PodSpec{
+			NodeName: "node",
+			EphemeralContainers: []v1.EphemeralContainer{
+				{EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: "debug", Image: registry + "/debug:1.0"}},
+				{EphemeralContainerCommon: v1.EphemeralContainerCommon{Name: "compatible", Image: registry + "/debug:2.0"}},
+			},
+		},
+	}
+
+	checkEphemeralContainers(&ctx, pod, clientset, NewRegistryKeyring())
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected a single event, got %d", len(recorder.Events))
+	}
+	event := <-recorder.Events
+	if !strings.Contains(event, "IncompatibleEphemeralContainer") || !strings.Contains(event, "container debug ") {
+		t.Errorf("unexpected event: %s", event)
+	}
+
+	// Pods which aren't scheduled yet have no node to check against
+	pod.Spec.NodeName = ""
+	checkEphemeralContainers(&ctx, pod, clientset, NewRegistryKeyring())
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no events for an unscheduled pod, got %d", len(recorder.Events))
+	}
+}
+
+func TestHandlePodOperatingSystems(t *testing.T) {
+	registry := newTestRegistry(t, map[string][]string{
+		"app:1.0":   {"linux/s390x", "windows/s390x"},
+		"linux:1.0": {"linux/s390x"},
+	})
+	recorder := record.NewFakeRecorder(10)
+	ctx := context.WithValue(context.Background(), K8S_EVENT_RECORDER_KEY, recorder)
+	handle := func(pod *v1.Pod) *v1.Pod {
+		clientset := fake.NewSimpleClientset(pod)
+		if err := handlePod(&ctx, pod, clientset); err != nil {
+			t.Fatal(err)
+		}
+		result, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "app", Image: registry + "/app:1.0"}},
+		},
+	}
+
+	result := handle(pod)
+	if values, expected := getTolerationValues(result.Spec.Tolerations, ARCH_TAINT_KEY_NAME), []string{"s390x"}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected architectures: %v, expected %v", values, expected)
+	}
+	if values, expected := getTolerationValues(result.Spec.Tolerations, OS_TAINT_KEY_NAME), []string{"linux", "windows"}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected operating systems: %v, expected %v", values, expected)
+	}
+
+	// The declared operating system narrows the pod's tolerations down
+	pod.Spec.OS = &v1.PodOS{Name: v1.Windows}
+	result = handle(pod)
+	if values, expected := getTolerationValues(result.Spec.Tolerations, OS_TAINT_KEY_NAME), []string{"windows"}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("unexpected operating systems: %v, expected %v", values, expected)
+	}
+	if len(recorder.Events) != 0 {
+		t.Errorf("expected no events for a supported operating system, got %d", len(recorder.Events))
+	}
+
+	// While it's reported when none of the images support it
+	pod.Spec.Containers = append(pod.Spec.Containers, v1.Container{Name: "linux", Image: registry + "/linux:1.0"})
+	result = handle(pod)
+	if values := getTolerationValues(result.Spec.Tolerations, OS_TAINT_KEY_NAME); len(values) != 0 {
+		t.Errorf("expected no operating systems to be tolerated, got %v", values)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected a single event, got %d", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "OperatingSystemMismatch") {
+		t.Errorf("unexpected event: %s", event)
+	}
+}
+
+func TestHandlePodContentTooLarge(t *testing.T) {
+	recorder := record.NewFakeRecorder(10)
+	ctx := context.WithValue(context.Background(), RESOLVER_CHAIN_KEY, ResolverChain{
+		&stubResolver{name: "registry", err: &ContentTooLargeError{MediaType: ocispec.MediaTypeImageManifest, Size: 8192, Limit: 4096}},
+	})
+	ctx = context.WithValue(ctx, K8S_EVENT_RECORDER_KEY, recorder)
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "app", Image: "example.com/huge:1.0"}},
+		},
+	}
+
+	// Content which will never be fetched is reported rather than retried
+	if err := handlePod(&ctx, pod, fake.NewSimpleClientset(pod)); err != nil {
+		t.Fatalf("expected pod to be skipped, got %v", err)
+	}
+	if len(recorder.Events) != 1 {
+		t.Fatalf("expected a single event, got %d", len(recorder.Events))
+	}
+	if event := <-recorder.Events; !strings.Contains(event, "ImageContentTooLarge") {
+		t.Errorf("unexpected event: %s", event)
+	}
+}
@@ -0,0 +1,207 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// RateLimitError is returned when a registry rejects a request with HTTP 429,
+// or when a manifest pull is held back to stay within a registry's rate limit.
+// Callers should wait RetryAfter before trying again.
+type RateLimitError struct {
+	Host       string
+	RetryAfter time.Duration
+}
+
+func (e *RateLimitError) Error() string {
+	return fmt.Sprintf("registry %s is rate-limited, retry after %s", e.Host, e.RetryAfter)
+}
+
+// rateLimit is the state of a registry host's rate limit.
+type rateLimit struct {
+	limit       int
+	remaining   int
+	window      time.Duration
+	pausedUntil time.Time
+	nextPull    time.Time
+}
+
+// interval is the time it takes the registry to grant another pull.
+func (r *rateLimit) interval() time.Duration {
+	if r.limit <= 0 || r.window <= 0 {
+		return RATE_LIMIT_PAUSE
+	}
+	return r.window / time.Duration(r.limit)
+}
+
+// parseRateLimitHeader parses a RateLimit-Limit or RateLimit-Remaining
+// header, given as either "<count>" or "<count>;w=<window seconds>".
+func parseRateLimitHeader(value string) (int, time.Duration, bool) {
+	parts := strings.Split(value, ";")
+	count, err := strconv.Atoi(strings.TrimSpace(parts[0]))
+	if err != nil {
+		return 0, 0, false
+	}
+	var window time.Duration
+	for _, part := range parts[1:] {
+		key, windowValue, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || key != "w" {
+			continue
+		}
+		if seconds, err := strconv.Atoi(windowValue); err == nil {
+			window = time.Duration(seconds) * time.Second
+		}
+	}
+	return count, window, true
+}
+
+// parseRetryAfter parses a Retry-After header given in seconds or as a date.
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second, true
+	}
+	if date, err := http.ParseTime(value); err == nil && date.After(now) {
+		return date.Sub(now), true
+	}
+	return 0, false
+}
+
+// isManifestPull determines if the given request counts against a registry's
+// pull rate limit. Docker Hub only counts GET requests for manifests.
+func isManifestPull(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.URL.Path, "/manifests/")
+}
+
+// rateLimitTransport tracks the rate limits reported by registries through
+// the RateLimit-Limit and RateLimit-Remaining headers (as done by Docker Hub).
+// Once fewer than reserve pulls remain, manifest pulls are spaced out to the
+// rate the registry grants new pulls at, and are paused entirely when none
+// remain or the registry responds with HTTP 429. Held back requests
+// fail with a RateLimitError.
+type rateLimitTransport struct {
+	next    http.RoundTripper
+	reserve int
+	now     func() time.Time
+
+	mu    sync.Mutex
+	hosts map[string]*rateLimit
+}
+
+func newRateLimitTransport(next http.RoundTripper, reserve int) *rateLimitTransport {
+	return &rateLimitTransport{
+		next:    next,
+		reserve: reserve,
+		now:     time.Now,
+		hosts:   make(map[string]*rateLimit),
+	}
+}
+
+// acquire determines if a manifest pull can be sent to the given host now.
+func (t *rateLimitTransport) acquire(host string) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.hosts[host]
+	if !ok {
+		return nil
+	}
+	now := t.now()
+	if now.Before(state.pausedUntil) {
+		return &RateLimitError{Host: host, RetryAfter: state.pausedUntil.Sub(now)}
+	}
+	if state.limit <= 0 || state.remaining > t.reserve {
+		return nil
+	}
+	if state.remaining <= 0 {
+		state.pausedUntil = now.Add(state.interval())
+		return &RateLimitError{Host: host, RetryAfter: state.interval()}
+	}
+	if now.Before(state.nextPull) {
+		return &RateLimitError{Host: host, RetryAfter: state.nextPull.Sub(now)}
+	}
+	state.nextPull = now.Add(state.interval())
+	// Assume the pull is counted until the registry says otherwise
+	state.remaining -= 1
+	return nil
+}
+
+// update records the rate limit reported within the given response.
+func (t *rateLimitTransport) update(host string, resp *http.Response) {
+	limit, window, hasLimit := parseRateLimitHeader(resp.Header.Get("RateLimit-Limit"))
+	remaining, _, hasRemaining := parseRateLimitHeader(resp.Header.Get("RateLimit-Remaining"))
+	if !hasLimit || !hasRemaining {
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.hosts[host]
+	if !ok {
+		state = &rateLimit{}
+		t.hosts[host] = state
+	}
+	state.limit = limit
+	state.remaining = remaining
+	state.window = window
+	rateLimitLimitGauge.WithLabelValues(host).Set(float64(limit))
+	rateLimitRemainingGauge.WithLabelValues(host).Set(float64(remaining))
+}
+
+// pause holds back every manifest pull to the given host for the given duration.
+func (t *rateLimitTransport) pause(host string, duration time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state, ok := t.hosts[host]
+	if !ok {
+		state = &rateLimit{}
+		t.hosts[host] = state
+	}
+	if until := t.now().Add(duration); until.After(state.pausedUntil) {
+		state.pausedUntil = until
+	}
+}
+
+func (t *rateLimitTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	host := req.URL.Host
+
+	if isManifestPull(req) {
+		if err := t.acquire(host); err != nil {
+			rateLimitThrottledCounter.WithLabelValues(host).Inc()
+			log.Debug().
+				Str("host", host).
+				AnErr("err", err).
+				Msg("Holding back manifest pull to stay within rate limit")
+			return nil, err
+		}
+	}
+
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return nil, err
+	}
+	t.update(host, resp)
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		resp.Body.Close()
+		retryAfter, ok := parseRetryAfter(resp.Header.Get("Retry-After"), t.now())
+		if !ok {
+			retryAfter = RATE_LIMIT_PAUSE
+		}
+		t.pause(host, retryAfter)
+		rateLimitedCounter.WithLabelValues(host).Inc()
+		log.Warn().
+			Str("host", host).
+			Dur("retry-after", retryAfter).
+			Msg("Registry rate limit exceeded, pausing manifest pulls")
+		return nil, &RateLimitError{Host: host, RetryAfter: retryAfter}
+	}
+	return resp, nil
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimitTransport(t *testing.T) {
+	remaining := "3;w=600"
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("RateLimit-Limit", "10;w=600")
+		w.Header().Set("RateLimit-Remaining", remaining)
+		if status == http.StatusTooManyRequests {
+			w.Header().Set("Retry-After", "120")
+		}
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	now := time.Now()
+	transport := newRateLimitTransport(http.DefaultTransport, 5)
+	transport.now = func() time.Time { return now }
+	client := &http.Client{Transport: transport}
+
+	get := func(path string) error {
+		resp, err := client.Get(server.URL + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	head := func(path string) error {
+		resp, err := client.Head(server.URL + path)
+		if err == nil {
+			resp.Body.Close()
+		}
+		return err
+	}
+	expectRetryAfter := func(err error, expected time.Duration) {
+		var rateLimitErr *RateLimitError
+		if !errors.As(err, &rateLimitErr) {
+			t.Fatalf("expected a RateLimitError, got %v", err)
+		}
+		if rateLimitErr.RetryAfter != expected {
+			t.Errorf("expected to retry after %s, got %s", expected, rateLimitErr.RetryAfter)
+		}
+	}
+
+	// The first pull learns the rate limit, after which pulls are spaced
+	// out by the time it takes to be granted a pull (600s / 10)
+	if err := get("/v2/library/nginx/manifests/latest"); err != nil {
+		t.Fatal(err)
+	}
+	if err := get("/v2/library/nginx/manifests/latest"); err != nil {
+		t.Fatal(err)
+	}
+	expectRetryAfter(get("/v2/library/nginx/manifests/latest"), time.Minute)
+
+	// HEAD requests and blobs are not counted, so they are never held back
+	if err := head("/v2/library/nginx/manifests/latest"); err != nil {
+		t.Errorf("expected HEAD request to not be held back: %v", err)
+	}
+	if err := get("/v2/library/nginx/blobs/sha256:abc"); err != nil {
+		t.Errorf("expected blob request to not be held back: %v", err)
+	}
+
+	// 429 pauses pulls for as long as the registry asks
+	now = now.Add(time.Minute)
+	status = http.StatusTooManyRequests
+	expectRetryAfter(get("/v2/library/nginx/manifests/latest"), time.Minute*time.Duration(2))
+	status = http.StatusOK
+	now = now.Add(time.Minute)
+	expectRetryAfter(get("/v2/library/nginx/manifests/latest"), time.Minute)
+	now = now.Add(time.Minute)
+	if err := get("/v2/library/nginx/manifests/latest"); err != nil {
+		t.Errorf("expected pull to be allowed after pause: %v", err)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"strings"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+)
+
+// normalizeReference normalizes the given image reference into its
+// fully-qualified form, as used by the kubelet and container runtimes:
+//
+//   - nginx becomes docker.io/library/nginx:latest
+//   - myteam/app:1.0 becomes docker.io/myteam/app:1.0
+//   - nginx:1.23@sha256:... becomes docker.io/library/nginx@sha256:...,
+//     as the digest is what is pulled when both are given.
+func normalizeReference(ref string) (string, error) {
+	named, err := dockerref.ParseNormalizedNamed(ref)
+	if err != nil {
+		return "", err
+	}
+	if canonical, ok := named.(dockerref.Canonical); ok {
+		named, err = dockerref.WithDigest(dockerref.TrimNamed(named), canonical.Digest())
+		if err != nil {
+			return "", err
+		}
+	}
+	return dockerref.TagNameOnly(named).String(), nil
+}
+
+// isShortName determines if the given image reference does not name
+// its registry, such as nginx or myteam/app, following the same rules
+// as Docker: the first path component names a registry if it contains
+// a '.' or ':', or is localhost.
+func isShortName(ref string) bool {
+	first, _, ok := strings.Cut(ref, "/")
+	if !ok {
+		return true
+	}
+	return !strings.ContainsAny(first, ".:") && first != "localhost" && strings.ToLower(first) == first
+}
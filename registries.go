@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+	"sigs.k8s.io/yaml"
+)
+
+// registriesFile is the format of a registries configuration, modeled
+// after containers-registries.conf(5), which determines where images
+// are looked up.
+type registriesFile struct {
+	// UnqualifiedSearchRegistries are searched in order for images which
+	// don't name their registry, such as nginx. Defaults to docker.io.
+	UnqualifiedSearchRegistries []string             `json:"unqualifiedSearchRegistries"`
+	Registries                  []registryConfig     `json:"registries"`
+	Hosts                       []registryHostConfig `json:"hosts"`
+}
+
+// registryConfig configures lookups of images matching a prefix.
+type registryConfig struct {
+	// Prefix is matched against fully-qualified image repositories, either
+	// as host[/path] matching the repository or any repository beneath it,
+	// or as *.domain matching any host within the domain.
+	Prefix string `json:"prefix"`
+	// Location rewrites the matched prefix, such as to follow a registry
+	// which has moved. Defaults to the prefix itself.
+	Location string `json:"location,omitempty"`
+	// Mirrors are tried in order before the location.
+	Mirrors []registryMirror `json:"mirrors,omitempty"`
+}
+
+// registryMirror is a mirror of the images matching a prefix.
+type registryMirror struct {
+	// Location replaces the matched prefix to form the mirrored reference.
+	Location string `json:"location"`
+	// DigestOnly only uses the mirror for references pinned by digest,
+	// as tags within a mirror may be out-of-date.
+	DigestOnly bool `json:"digestOnly,omitempty"`
+}
+
+// registryHostConfig configures connections to a registry host.
+type registryHostConfig struct {
+	// Host is the registry's host, including its port if not the default.
+	Host string `json:"host"`
+	// CA is the path to a bundle of PEM-encoded certificates trusted
+	// in addition to the system's certificates.
+	CA string `json:"ca,omitempty"`
+	// ClientCert and ClientKey are paths to a PEM-encoded certificate
+	// and key presented to the registry.
+	ClientCert string `json:"clientCert,omitempty"`
+	ClientKey  string `json:"clientKey,omitempty"`
+	// InsecureSkipVerify disables verification of the registry's certificate.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+	// PlainHTTP contacts the registry over HTTP rather than HTTPS.
+	PlainHTTP bool `json:"plainHTTP,omitempty"`
+}
+
+// RegistriesConfig determines the locations an image is looked up from,
+// and how registry hosts are connected to.
+type RegistriesConfig struct {
+	searchRegistries []string
+	registries       []registryConfig
+	hosts            map[string]registryHostConfig
+}
+
+// parseRegistriesConfig parses the given registries configuration contents.
+func parseRegistriesConfig(data []byte) (*RegistriesConfig, error) {
+	var file registriesFile
+	if err := yaml.UnmarshalStrict(data, &file); err != nil {
+		return nil, err
+	}
+
+	for i, registry := range file.Registries {
+		if registry.Prefix == "" {
+			return nil, fmt.Errorf("registry entry %d has no prefix", i)
+		}
+		if strings.HasPrefix(registry.Prefix, "*.") && strings.Contains(registry.Prefix, "/") {
+			return nil, fmt.Errorf("registry entry %s: wildcard prefixes cannot contain a path", registry.Prefix)
+		}
+		if strings.HasPrefix(registry.Prefix, "*.") && registry.Location != "" {
+			return nil, fmt.Errorf("registry entry %s: wildcard prefixes cannot be rewritten", registry.Prefix)
+		}
+		file.Registries[i].Prefix = normalizeRegistryLocation(registry.Prefix)
+		if registry.Location != "" {
+			file.Registries[i].Location = normalizeRegistryLocation(registry.Location)
+		}
+		for j, mirror := range registry.Mirrors {
+			if mirror.Location == "" {
+				return nil, fmt.Errorf("registry entry %s: mirror %d has no location", registry.Prefix, j)
+			}
+			file.Registries[i].Mirrors[j].Location = normalizeRegistryLocation(mirror.Location)
+		}
+	}
+
+	hosts := make(map[string]registryHostConfig)
+	for i, host := range file.Hosts {
+		if host.Host == "" {
+			return nil, fmt.Errorf("host entry %d has no host", i)
+		}
+		host.Host = normalizeRegistryLocation(host.Host)
+		if strings.Contains(host.Host, "/") {
+			return nil, fmt.Errorf("host entry %s cannot contain a path", host.Host)
+		}
+		if (host.ClientCert == "") != (host.ClientKey == "") {
+			return nil, fmt.Errorf("host entry %s must give both clientCert and clientKey", host.Host)
+		}
+		if _, ok := hosts[host.Host]; ok {
+			return nil, fmt.Errorf("host entry %s is given more than once", host.Host)
+		}
+		hosts[host.Host] = host
+	}
+
+	searchRegistries := make([]string, 0, len(file.UnqualifiedSearchRegistries))
+	for _, registry := range file.UnqualifiedSearchRegistries {
+		registry = normalizeRegistryLocation(registry)
+		if registry == "" || strings.Contains(registry, "/") {
+			return nil, fmt.Errorf("invalid unqualified search registry: %s", registry)
+		}
+		searchRegistries = append(searchRegistries, registry)
+	}
+
+	return &RegistriesConfig{
+		searchRegistries: searchRegistries,
+		registries:       file.Registries,
+		hosts:            hosts,
+	}, nil
+}
+
+// References returns the normalized references the given image may refer
+// to, in the order they should be searched, see normalizeReference.
+// Images which don't name their registry are searched for within each
+// unqualified search registry, or only docker.io if none are configured.
+func (c *RegistriesConfig) References(image string) ([]string, error) {
+	if c == nil || len(c.searchRegistries) == 0 || !isShortName(image) {
+		ref, err := normalizeReference(image)
+		if err != nil {
+			return nil, err
+		}
+		return []string{ref}, nil
+	}
+
+	references := make([]string, 0, len(c.searchRegistries))
+	for _, registry := range c.searchRegistries {
+		ref, err := normalizeReference(registry + "/" + image)
+		if err != nil {
+			return nil, err
+		}
+		references = append(references, ref)
+	}
+	return references, nil
+}
+
+// matchPrefix returns the part of the given repository matched by the
+// given prefix, or an empty string if the prefix does not match.
+func matchPrefix(prefix string, repository string) string {
+	if strings.HasPrefix(prefix, "*.") {
+		host, _, _ := strings.Cut(repository, "/")
+		if strings.HasSuffix(host, prefix[1:]) {
+			return host
+		}
+		return ""
+	}
+	if repository == prefix || strings.HasPrefix(repository, prefix+"/") {
+		return prefix
+	}
+	return ""
+}
+
+// prefixMoreSpecific determines if prefix a is more specific than prefix b.
+// Exact prefixes are more specific than wildcards, otherwise longer
+// prefixes are more specific.
+func prefixMoreSpecific(a string, b string) bool {
+	aWildcard := strings.HasPrefix(a, "*.")
+	bWildcard := strings.HasPrefix(b, "*.")
+	if aWildcard != bWildcard {
+		return bWildcard
+	}
+	return len(a) > len(b)
+}
+
+// Candidates returns the references the given image is looked up from, in
+// order: each applicable mirror, followed by the image's (possibly rewritten)
+// location. The registry with the most specific matching prefix applies.
+// If no registry applies, the image is looked up from where it names.
+func (c *RegistriesConfig) Candidates(ref string) []string {
+	if c == nil || len(c.registries) == 0 {
+		return []string{ref}
+	}
+	named, err := dockerref.ParseNormalizedNamed(ref)
+	if err != nil {
+		return []string{ref}
+	}
+	named = dockerref.TagNameOnly(named)
+	_, isCanonical := named.(dockerref.Canonical)
+	repository := named.Name()
+	full := named.String()
+
+	var registry *registryConfig
+	matched := ""
+	for i := range c.registries {
+		match := matchPrefix(c.registries[i].Prefix, repository)
+		if match == "" || (registry != nil && !prefixMoreSpecific(c.registries[i].Prefix, registry.Prefix)) {
+			continue
+		}
+		registry = &c.registries[i]
+		matched = match
+	}
+	if registry == nil {
+		return []string{ref}
+	}
+
+	rewrite := func(location string) string {
+		return location + strings.TrimPrefix(full, matched)
+	}
+
+	candidates := make([]string, 0, len(registry.Mirrors)+1)
+	for _, mirror := range registry.Mirrors {
+		if mirror.DigestOnly && !isCanonical {
+			continue
+		}
+		candidates = append(candidates, rewrite(mirror.Location))
+	}
+	if registry.Location != "" {
+		candidates = append(candidates, rewrite(registry.Location))
+	} else {
+		candidates = append(candidates, full)
+	}
+	return candidates
+}
+
+// Hosts returns the configuration of each configured registry host.
+func (c *RegistriesConfig) Hosts() []registryHostConfig {
+	if c == nil {
+		return nil
+	}
+	hosts := make([]registryHostConfig, 0, len(c.hosts))
+	for _, host := range c.hosts {
+		hosts = append(hosts, host)
+	}
+	return hosts
+}
+
+// setupRegistriesConfig loads the registries configuration given on the
+// CLI, if any, and stores it in the given context.
+func setupRegistriesConfig(ctx *context.Context) error {
+	filePath := flag.Lookup("registries-config").Value.String()
+	if filePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(filePath)
+	if err != nil {
+		return err
+	}
+	config, err := parseRegistriesConfig(data)
+	if err != nil {
+		return fmt.Errorf("unable to parse registries config %s: %w", filePath, err)
+	}
+	*ctx = context.WithValue(*ctx, REGISTRIES_CONFIG_KEY, config)
+	return nil
+}
+
+// GetRegistriesConfig pulls the set RegistriesConfig from the given context.
+// Returns nil if no RegistriesConfig has been set, under which images are
+// looked up from where they name.
+func GetRegistriesConfig(ctx *context.Context) *RegistriesConfig {
+	result := (*ctx).Value(REGISTRIES_CONFIG_KEY)
+	if result == nil {
+		return nil
+	}
+	return result.(*RegistriesConfig)
+}
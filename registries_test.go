@@ -0,0 +1,102 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRegistriesConfigCandidates(t *testing.T) {
+	config, err := parseRegistriesConfig([]byte(`
+registries:
+- prefix: docker.io
+  mirrors:
+  - location: mirror.internal/dockerhub
+  - location: digests.internal/dockerhub
+    digestOnly: true
+- prefix: quay.io/oldteam
+  location: quay.io/newteam
+- prefix: "*.example.com"
+  mirrors:
+  - location: mirror.internal/example
+- prefix: registry.example.com
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest := "sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac"
+	cases := map[string][]string{
+		"nginx": {
+			"mirror.internal/dockerhub/library/nginx:latest",
+			"docker.io/library/nginx:latest",
+		},
+		"nginx@" + digest: {
+			"mirror.internal/dockerhub/library/nginx@" + digest,
+			"digests.internal/dockerhub/library/nginx@" + digest,
+			"docker.io/library/nginx@" + digest,
+		},
+		"quay.io/oldteam/app:1.0": {
+			"quay.io/newteam/app:1.0",
+		},
+		"quay.io/oldteamapp:1.0": {
+			"quay.io/oldteamapp:1.0",
+		},
+		"cdn.example.com/app:1.0": {
+			"mirror.internal/example/app:1.0",
+			"cdn.example.com/app:1.0",
+		},
+		"registry.example.com/app:1.0": {
+			"registry.example.com/app:1.0",
+		},
+	}
+	for ref, expected := range cases {
+		if candidates := config.Candidates(ref); !reflect.DeepEqual(candidates, expected) {
+			t.Errorf("unexpected candidates for %s: %v, expected %v", ref, candidates, expected)
+		}
+	}
+
+	var unset *RegistriesConfig
+	if candidates := unset.Candidates("nginx"); !reflect.DeepEqual(candidates, []string{"nginx"}) {
+		t.Errorf("expected unset config to keep reference, got %v", candidates)
+	}
+}
+
+func TestNormalizeReference(t *testing.T) {
+	digest := "sha256:4c0fdaa8b6341bfdeca5f18f7837462c80cff90527ee35ef185571e1c327beac"
+	cases := map[string]string{
+		"nginx":                         "docker.io/library/nginx:latest",
+		"myteam/app:1.0":                "docker.io/myteam/app:1.0",
+		"nginx:1.23@" + digest:          "docker.io/library/nginx@" + digest,
+		"quay.io/myteam/app":            "quay.io/myteam/app:latest",
+		"localhost:5000/app":            "localhost:5000/app:latest",
+		"index.docker.io/library/nginx": "docker.io/library/nginx:latest",
+	}
+	for ref, expected := range cases {
+		if normalized, err := normalizeReference(ref); err != nil || normalized != expected {
+			t.Errorf("unexpected normalized reference for %s: %s (%v), expected %s", ref, normalized, err, expected)
+		}
+	}
+	if _, err := normalizeReference("Invalid:Reference"); err == nil {
+		t.Errorf("expected invalid reference to fail to normalize")
+	}
+}
+
+func TestRegistriesConfigReferences(t *testing.T) {
+	config, err := parseRegistriesConfig([]byte(`
+unqualifiedSearchRegistries: [registry.internal, docker.io]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := map[string][]string{
+		"nginx":              {"registry.internal/nginx:latest", "docker.io/library/nginx:latest"},
+		"myteam/app:1.0":     {"registry.internal/myteam/app:1.0", "docker.io/myteam/app:1.0"},
+		"quay.io/myteam/app": {"quay.io/myteam/app:latest"},
+	}
+	for image, expected := range cases {
+		if references, err := config.References(image); err != nil || !reflect.DeepEqual(references, expected) {
+			t.Errorf("unexpected references for %s: %v (%v), expected %v", image, references, err, expected)
+		}
+	}
+}
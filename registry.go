@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/containerd/containerd/remotes"
+	"github.com/containerd/containerd/remotes/docker"
+	"golang.org/x/sync/singleflight"
+)
+
+// RegistryClient holds the long-lived state used to contact registries.
+// A single HTTP client is shared between every lookup, and a resolver is
+// created once per set of credentials, so that connections and auth tokens
+// are reused between lookups. Resolvers of credentials which are no longer
+// used are evicted once REGISTRY_RESOLVER_CACHE_SIZE is reached.
+// Concurrent lookups of the same image are collapsed into a single lookup.
+type RegistryClient struct {
+	client    *http.Client
+	plainHTTP map[string]bool
+	mu        sync.Mutex
+	resolvers *lruCache[remotes.Resolver]
+	lookups   singleflight.Group
+}
+
+// hostTransport sends requests to each registry host through
+// the transport configured for the host, or a default transport.
+type hostTransport struct {
+	base  http.RoundTripper
+	hosts map[string]http.RoundTripper
+}
+
+func (t *hostTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if transport, ok := t.hosts[req.URL.Host]; ok {
+		return transport.RoundTrip(req)
+	}
+	return t.base.RoundTrip(req)
+}
+
+// newTLSConfig creates the TLS configuration used to connect to the given host.
+func newTLSConfig(host registryHostConfig) (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: host.InsecureSkipVerify,
+	}
+
+	if host.CA != "" {
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		data, err := os.ReadFile(host.CA)
+		if err != nil {
+			return nil, err
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("no certificates found within %s", host.CA)
+		}
+		config.RootCAs = pool
+	}
+
+	if host.ClientCert != "" {
+		cert, err := tls.LoadX509KeyPair(host.ClientCert, host.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// NewRegistryClient creates a RegistryClient with its own HTTP transport,
+// connecting to the registry hosts within the given RegistriesConfig using
+// their configured TLS settings. The RegistriesConfig may be nil.
+// Requests are restricted to the hosts allowed by the given RegistryPolicy,
+// which may be nil to allow every host with the default limits.
+// Manifest pulls are slowed down once fewer than rateLimitReserve pulls
+// remain within a registry's rate limit, see rateLimitTransport.
+func NewRegistryClient(config *RegistriesConfig, policy *RegistryPolicy, rateLimitReserve int) (*RegistryClient, error) {
+	if policy == nil {
+		policy = defaultRegistryPolicy
+	}
+
+	base := http.DefaultTransport.(*http.Transport).Clone()
+	base.MaxIdleConnsPerHost = 10
+
+	transport := &hostTransport{
+		base:  base,
+		hosts: make(map[string]http.RoundTripper),
+	}
+	plainHTTP := make(map[string]bool)
+	for _, host := range config.Hosts() {
+		tlsConfig, err := newTLSConfig(host)
+		if err != nil {
+			return nil, fmt.Errorf("unable to configure TLS for registry %s: %w", host.Host, err)
+		}
+		tlsTransport := base.Clone()
+		tlsTransport.TLSClientConfig = tlsConfig
+		transport.hosts[host.Host] = tlsTransport
+		// Docker Hub is served from a different host than its name
+		if host.Host == "docker.io" {
+			transport.hosts["registry-1.docker.io"] = tlsTransport
+		}
+		plainHTTP[host.Host] = host.PlainHTTP
+	}
+
+	return &RegistryClient{
+		client: &http.Client{
+			Transport: &policyTransport{
+				next:   newRateLimitTransport(transport, rateLimitReserve),
+				policy: policy,
+			},
+			CheckRedirect: policy.checkRedirect,
+			Timeout:       policy.RequestTimeout,
+		},
+		plainHTTP: plainHTTP,
+		resolvers: newLRUCache[remotes.Resolver](REGISTRY_RESOLVER_CACHE_SIZE),
+	}, nil
+}
+
+// usePlainHTTP determines if the given registry host is contacted over HTTP.
+// Localhost is always contacted over HTTP, same as containerd.
+func (r *RegistryClient) usePlainHTTP(host string) (bool, error) {
+	if r.plainHTTP[host] {
+		return true, nil
+	}
+	return docker.MatchLocalhost(host)
+}
+
+// Resolver returns the resolver which authenticates using the given
+// credentials, creating it if needed. If auth is nil, requests are anonymous.
+func (r *RegistryClient) Resolver(auth *registryAuth) remotes.Resolver {
+	key := auth.cacheKey()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if resolver, ok := r.resolvers.Get(key); ok {
+		return resolver
+	}
+
+	authorizerOpts := []docker.AuthorizerOpt{
+		docker.WithAuthClient(r.client),
+	}
+	if auth != nil {
+		// Each resolver is only used with the credentials of a single
+		// image's registry, so the host can be ignored.
+		authorizerOpts = append(
+			authorizerOpts,
+			docker.WithAuthCreds(func(host string) (string, string, error) {
+				return auth.Credentials()
+			}),
+		)
+	}
+
+	resolver := docker.NewResolver(
+		docker.ResolverOptions{
+			Hosts: docker.ConfigureDefaultRegistries(
+				docker.WithClient(r.client),
+				docker.WithAuthorizer(
+					docker.NewDockerAuthorizer(authorizerOpts...),
+				),
+				docker.WithPlainHTTP(r.usePlainHTTP),
+			),
+		},
+	)
+	r.resolvers.Add(key, resolver, 0)
+	return resolver
+}
+
+// Do executes the given lookup, unless a lookup with the same key is already
+// in-flight, in which case the in-flight lookup's result is returned instead.
+// See DoShared for the context the lookup is given.
+func (r *RegistryClient) Do(ctx *context.Context, key string, lookup func(ctx *context.Context) (interface{}, error)) (interface{}, error, bool) {
+	return DoShared(ctx, &r.lookups, key, lookup)
+}
+
+// setupRegistryClient creates a RegistryClient using the context's
+// RegistriesConfig and RegistryPolicy and stores it in the given context.
+func setupRegistryClient(ctx *context.Context) error {
+	client, err := NewRegistryClient(
+		GetRegistriesConfig(ctx),
+		GetRegistryPolicy(ctx),
+		flag.Lookup("ratelimit-reserve").Value.(flag.Getter).Get().(int),
+	)
+	if err != nil {
+		return err
+	}
+	*ctx = context.WithValue(*ctx, REGISTRY_CLIENT_KEY, client)
+	return nil
+}
+
+// defaultRegistryClient is shared by every context without a RegistryClient,
+// so that their lookups are still deduplicated.
+var (
+	defaultRegistryClient     *RegistryClient
+	defaultRegistryClientOnce sync.Once
+)
+
+// GetRegistryClient pulls the set RegistryClient from the given context.
+// If no RegistryClient has been set, a default RegistryClient
+// without registry configuration is returned.
+func GetRegistryClient(ctx *context.Context) *RegistryClient {
+	result := (*ctx).Value(REGISTRY_CLIENT_KEY)
+	if result == nil {
+		defaultRegistryClientOnce.Do(func() {
+			defaultRegistryClient, _ = NewRegistryClient(nil, nil, 0)
+		})
+		return defaultRegistryClient
+	}
+	return result.(*RegistryClient)
+}
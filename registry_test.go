@@ -0,0 +1,298 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRegistryClientCustomCA(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	caPath := filepath.Join(t.TempDir(), "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := os.WriteFile(caPath, caPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config, err := parseRegistriesConfig([]byte(fmt.Sprintf(`
+hosts:
+- host: %s
+  ca: %s
+- host: dev.registry.internal:5000
+  plainHTTP: true
+`, serverURL.Host, caPath)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	client, err := NewRegistryClient(config, nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.client.Get(server.URL)
+	if err != nil {
+		t.Fatalf("expected configured CA to be trusted: %v", err)
+	}
+	resp.Body.Close()
+
+	defaultClient, _ := NewRegistryClient(nil, nil, 0)
+	if resp, err := defaultClient.client.Get(server.URL); err == nil {
+		resp.Body.Close()
+		t.Errorf("expected unconfigured client to reject the server's certificate")
+	}
+
+	for host, expected := range map[string]bool{
+		"dev.registry.internal:5000": true,
+		"localhost:5000":             true,
+		"registry.internal":          false,
+		"docker.io":                  false,
+	} {
+		if plainHTTP, _ := client.usePlainHTTP(host); plainHTTP != expected {
+			t.Errorf("expected plain HTTP to be %v for %s", expected, host)
+		}
+	}
+}
+
+func TestRegistryPolicy(t *testing.T) {
+	policy, err := parseRegistryPolicy("docker.io,*.internal,127.0.0.1:*", "secret.internal", "deny")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, expected := range map[string]bool{
+		"docker.io":            true,
+		"registry-1.docker.io": true,
+		"registry.internal":    true,
+		"secret.internal":      false,
+		"quay.io":              false,
+		"169.254.169.254":      false,
+	} {
+		if allowed := policy.Allows(host); allowed != expected {
+			t.Errorf("expected %s to be allowed: %v", host, expected)
+		}
+	}
+
+	// Redirects to hosts which are not allowed are refused
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/allowed" {
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		http.Redirect(w, r, "http://secret.internal/v2/", http.StatusTemporaryRedirect)
+	}))
+	defer server.Close()
+
+	client, err := NewRegistryClient(nil, policy, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.client.Get(server.URL + "/allowed")
+	if err != nil {
+		t.Fatalf("expected request to allowed host to succeed: %v", err)
+	}
+	resp.Body.Close()
+
+	var hostErr *HostNotAllowedError
+	if resp, err := client.client.Get(server.URL + "/redirect"); !errors.As(err, &hostErr) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		t.Errorf("expected redirect to secret.internal to be refused, got %v", err)
+	}
+	if resp, err := client.client.Get("https://quay.io/v2/"); !errors.As(err, &hostErr) {
+		if err == nil {
+			resp.Body.Close()
+		}
+		t.Errorf("expected request to unlisted host to be refused, got %v", err)
+	}
+
+	if _, err := parseRegistryPolicy("", "", "maybe"); err == nil {
+		t.Errorf("expected unknown policy for unlisted hosts to be rejected")
+	}
+}
+
+func TestRegistryClientConcurrentLookups(t *testing.T) {
+	config, err := json.Marshal(architectureContainer{OS: "linux", Architecture: "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest := digest.FromBytes(config)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDigest, Size: int64(len(config))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(manifest)
+	content := map[string]struct {
+		mediaType string
+		data      []byte
+	}{
+		"/v2/app/manifests/1.0":                        {ocispec.MediaTypeImageManifest, manifest},
+		"/v2/app/manifests/" + manifestDigest.String(): {ocispec.MediaTypeImageManifest, manifest},
+		"/v2/app/blobs/" + configDigest.String():       {ocispec.MediaTypeImageConfig, config},
+	}
+
+	// The first lookup is held up until every other lookup has started
+	var resolves int32
+	started := make(chan struct{})
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead && r.URL.Path == "/v2/app/manifests/1.0" {
+			if atomic.AddInt32(&resolves, 1) == 1 {
+				close(started)
+			}
+			<-release
+		}
+		entry, ok := content[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", entry.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(entry.data)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(entry.data).String())
+		if r.Method == http.MethodGet {
+			w.Write(entry.data)
+		}
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := serverURL.Host + "/app:1.0"
+
+	// Contexts without a RegistryClient share the default one
+	ctx := context.Background()
+	if GetRegistryClient(&ctx) != GetRegistryClient(&ctx) {
+		t.Fatalf("expected the default RegistryClient to be reused")
+	}
+
+	const lookups = 5
+	var wg sync.WaitGroup
+	errs := make(chan error, lookups)
+	lookup := func() {
+		defer wg.Done()
+		platforms, err := getArchitectures(&ctx, ref, nil)
+		if err == nil && (len(platforms) != 1 || platforms[0].Architecture != "arm64") {
+			err = fmt.Errorf("unexpected platforms: %s", formatPlatforms(platforms))
+		}
+		errs <- err
+	}
+	wg.Add(1)
+	go lookup()
+	<-started
+	for i := 1; i < lookups; i++ {
+		wg.Add(1)
+		go lookup()
+	}
+	time.Sleep(100 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if resolves != 1 {
+		t.Errorf("expected concurrent lookups to be collapsed into one, got %d", resolves)
+	}
+}
+
+func TestGetArchitecturesTagRevalidation(t *testing.T) {
+	config, err := json.Marshal(architectureContainer{OS: "linux", Architecture: "arm64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	configDigest := digest.FromBytes(config)
+	manifest, err := json.Marshal(ocispec.Manifest{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    ocispec.Descriptor{MediaType: ocispec.MediaTypeImageConfig, Digest: configDigest, Size: int64(len(config))},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	manifestDigest := digest.FromBytes(manifest)
+	content := map[string]struct {
+		mediaType string
+		data      []byte
+	}{
+		"/v2/app/manifests/1.0":                        {ocispec.MediaTypeImageManifest, manifest},
+		"/v2/app/manifests/" + manifestDigest.String(): {ocispec.MediaTypeImageManifest, manifest},
+		"/v2/app/blobs/" + configDigest.String():       {ocispec.MediaTypeImageConfig, config},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry, ok := content[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", entry.mediaType)
+		w.Header().Set("Content-Length", strconv.Itoa(len(entry.data)))
+		w.Header().Set("Docker-Content-Digest", digest.FromBytes(entry.data).String())
+		if r.Method == http.MethodGet {
+			w.Write(entry.data)
+		}
+	}))
+	defer server.Close()
+	serverURL, err := url.Parse(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref := serverURL.Host + "/app:1.0"
+
+	now := time.Now()
+	cache := NewImageCache(10, time.Minute, time.Minute)
+	cache.tags.now = func() time.Time { return now }
+	ctx := context.WithValue(context.Background(), IMAGE_CACHE_KEY, cache)
+	revalidations := func() float64 {
+		return testutil.ToFloat64(tagRevalidationsCounter.WithLabelValues("unchanged"))
+	}
+
+	// A tag which is still fresh, whose digest isn't known, is looked
+	// up without being counted as revalidated
+	cache.AddTag(ref, manifestDigest)
+	before := revalidations()
+	if _, err := getArchitectures(&ctx, ref, nil); err != nil {
+		t.Fatal(err)
+	}
+	if revalidations() != before {
+		t.Errorf("expected fresh tag not to be revalidated")
+	}
+
+	// Expired tags are
+	now = now.Add(time.Minute * time.Duration(2))
+	if _, err := getArchitectures(&ctx, ref, nil); err != nil {
+		t.Fatal(err)
+	}
+	if revalidations() != before+1 {
+		t.Errorf("expected expired tag to be revalidated")
+	}
+}
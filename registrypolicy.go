@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// HostNotAllowedError is returned for requests to registry hosts which
+// are not allowed by the RegistryPolicy. Retrying does not help, as the
+// policy only changes on restart.
+type HostNotAllowedError struct {
+	Host string
+}
+
+func (e *HostNotAllowedError) Error() string {
+	return fmt.Sprintf("registry host %s is not allowed", e.Host)
+}
+
+// ContentTooLargeError is returned for manifests and image configs which
+// are larger than the RegistryPolicy allows.
+type ContentTooLargeError struct {
+	MediaType string
+	Size      int64
+	Limit     int64
+}
+
+func (e *ContentTooLargeError) Error() string {
+	if e.Size < 0 {
+		return fmt.Sprintf("content of media type %s is larger than the limit of %d bytes", e.MediaType, e.Limit)
+	}
+	return fmt.Sprintf("content of media type %s has size %d, larger than the limit of %d bytes", e.MediaType, e.Size, e.Limit)
+}
+
+// RegistryPolicy restricts which registry hosts the controller contacts
+// and how much it fetches from them, as image references within pods
+// are otherwise free to point anywhere.
+type RegistryPolicy struct {
+	// allow and deny are host globs, such as *.example.com.
+	allow []string
+	deny  []string
+	// allowUnlisted allows hosts matching neither allow nor deny.
+	allowUnlisted bool
+
+	MaxManifestSize int64
+	MaxConfigSize   int64
+	RequestTimeout  time.Duration
+}
+
+// defaultRegistryPolicy allows every host, with the default limits.
+var defaultRegistryPolicy = &RegistryPolicy{
+	allowUnlisted:   true,
+	MaxManifestSize: DEFAULT_MAX_MANIFEST_SIZE,
+	MaxConfigSize:   DEFAULT_MAX_CONFIG_SIZE,
+	RequestTimeout:  DEFAULT_REGISTRY_REQUEST_TIMEOUT,
+}
+
+// parseHostList parses a comma-separated list of host globs.
+func parseHostList(list string) ([]string, error) {
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(list, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if _, err := path.Match(host, ""); err != nil {
+			return nil, fmt.Errorf("invalid registry host glob %s: %w", host, err)
+		}
+		hosts = append(hosts, normalizeRegistryLocation(host))
+	}
+	return hosts, nil
+}
+
+// parseRegistryPolicy parses the given comma-separated allowlist and
+// denylist of host globs, and the policy for hosts within neither
+// (either allow or deny).
+func parseRegistryPolicy(allowList string, denyList string, unlisted string) (*RegistryPolicy, error) {
+	policy := *defaultRegistryPolicy
+
+	var err error
+	if policy.allow, err = parseHostList(allowList); err != nil {
+		return nil, err
+	}
+	if policy.deny, err = parseHostList(denyList); err != nil {
+		return nil, err
+	}
+	switch unlisted {
+	case "allow":
+		policy.allowUnlisted = true
+	case "deny":
+		policy.allowUnlisted = false
+	default:
+		return nil, fmt.Errorf("unknown policy for unlisted registries: %s, expected allow or deny", unlisted)
+	}
+	return &policy, nil
+}
+
+// hostMatches determines if the given host matches any of the given globs.
+func hostMatches(globs []string, host string) bool {
+	for _, glob := range globs {
+		if matched, _ := path.Match(glob, host); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// Allows determines if the given registry host may be contacted.
+// The denylist takes precedence over the allowlist. Docker Hub's
+// hosts (registry-1.docker.io, index.docker.io) are matched as docker.io.
+func (p *RegistryPolicy) Allows(host string) bool {
+	if p == nil {
+		return true
+	}
+	host = normalizeRegistryLocation(host)
+	if hostMatches(p.deny, host) {
+		return false
+	}
+	if hostMatches(p.allow, host) {
+		return true
+	}
+	return p.allowUnlisted
+}
+
+// checkRedirect refuses redirects to hosts which are not allowed, such
+// as a registry redirecting blob downloads to an internal address.
+func (p *RegistryPolicy) checkRedirect(req *http.Request, via []*http.Request) error {
+	if len(via) >= MAX_REGISTRY_REDIRECTS {
+		return fmt.Errorf("stopped after %d redirects", len(via))
+	}
+	if !p.Allows(req.URL.Host) {
+		return &HostNotAllowedError{Host: req.URL.Host}
+	}
+	return nil
+}
+
+// policyTransport refuses requests to hosts which are not allowed,
+// including those to auth token services.
+type policyTransport struct {
+	next   http.RoundTripper
+	policy *RegistryPolicy
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !t.policy.Allows(req.URL.Host) {
+		return nil, &HostNotAllowedError{Host: req.URL.Host}
+	}
+	return t.next.RoundTrip(req)
+}
+
+// setupRegistryPolicy creates a RegistryPolicy from the CLI and
+// stores it in the given context.
+func setupRegistryPolicy(ctx *context.Context) error {
+	policy, err := parseRegistryPolicy(
+		flag.Lookup("registry-allowlist").Value.String(),
+		flag.Lookup("registry-denylist").Value.String(),
+		flag.Lookup("registry-unlisted-policy").Value.String(),
+	)
+	if err != nil {
+		return err
+	}
+	policy.MaxManifestSize = flag.Lookup("max-manifest-size").Value.(flag.Getter).Get().(int64)
+	policy.MaxConfigSize = flag.Lookup("max-config-size").Value.(flag.Getter).Get().(int64)
+	policy.RequestTimeout = flag.Lookup("registry-request-timeout").Value.(flag.Getter).Get().(time.Duration)
+	*ctx = context.WithValue(*ctx, REGISTRY_POLICY_KEY, policy)
+	return nil
+}
+
+// GetRegistryPolicy pulls the set RegistryPolicy from the given context.
+// If no RegistryPolicy has been set, a policy allowing every host with
+// the default limits is returned.
+func GetRegistryPolicy(ctx *context.Context) *RegistryPolicy {
+	result := (*ctx).Value(REGISTRY_POLICY_KEY)
+	if result == nil {
+		return defaultRegistryPolicy
+	}
+	return result.(*RegistryPolicy)
+}
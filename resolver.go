@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+
+	dockerref "github.com/containerd/containerd/reference/docker"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+)
+
+// ErrResolverDeclined is returned by an ArchitectureResolver which
+// does not have an answer for an image, passing it to the next resolver.
+var ErrResolverDeclined = errors.New("resolver declined to resolve image")
+
+// ImageRequest describes an image whose platforms are being resolved.
+type ImageRequest struct {
+	// Pod is the pod the image belongs to. May be nil.
+	Pod *v1.Pod
+	// Container is the name of the container the image belongs to.
+	Container string
+	// Image is the image reference, as given within the pod.
+	Image string
+	// References are the normalized references Image may refer to, in
+	// the order they should be searched, see RegistriesConfig.References.
+	// Set by the ResolverChain.
+	References []string
+	// Keyring holds the credentials which can be used to pull the image.
+	Keyring *RegistryKeyring
+	// Allowed narrows the answer of the chain down to the platforms allowed
+	// by at least one of the given specifiers, see platformAllows.
+	// Resolvers may set this before declining. Nil means no narrowing.
+	Allowed []ocispec.Platform
+}
+
+// references returns the normalized references of the requested image.
+// If References is not set, Image is normalized on its own.
+func (r *ImageRequest) references() []string {
+	if r.References != nil {
+		return r.References
+	}
+	if ref, err := normalizeReference(r.Image); err == nil {
+		return []string{ref}
+	}
+	return []string{r.Image}
+}
+
+// narrow filters the given platforms down to those allowed by the request.
+func (r *ImageRequest) narrow(platforms []ocispec.Platform) []ocispec.Platform {
+	if r.Allowed == nil {
+		return platforms
+	}
+	narrowed := make([]ocispec.Platform, 0)
+	for _, platform := range platforms {
+		for _, allowed := range r.Allowed {
+			if platformAllows(allowed, platform) {
+				narrowed = append(narrowed, platform)
+				break
+			}
+		}
+	}
+	return narrowed
+}
+
+// ArchitectureResolver finds the platforms supported by an image.
+// A resolver can answer with the image's platforms, decline by returning
+// ErrResolverDeclined, or fail by returning any other error.
+type ArchitectureResolver interface {
+	// Name identifies the resolver within logs and configuration.
+	Name() string
+	// Resolve returns the normalized platforms supported by the requested image.
+	Resolve(ctx *context.Context, request *ImageRequest) ([]ocispec.Platform, error)
+}
+
+// resolverFactories creates each ArchitectureResolver which can be
+// configured within a ResolverChain, keyed by the resolver's name.
+var resolverFactories = map[string]func(ctx *context.Context) (ArchitectureResolver, error){
+	"annotation": func(ctx *context.Context) (ArchitectureResolver, error) {
+		return newAnnotationResolver(), nil
+	},
+	"catalog": func(ctx *context.Context) (ArchitectureResolver, error) {
+		return newCatalogResolver(ctx)
+	},
+	"local": func(ctx *context.Context) (ArchitectureResolver, error) {
+		return newLocalResolver()
+	},
+	"cache": func(ctx *context.Context) (ArchitectureResolver, error) {
+		return &cacheResolver{}, nil
+	},
+	"registry": func(ctx *context.Context) (ArchitectureResolver, error) {
+		return &registryResolver{}, nil
+	},
+}
+
+// ResolverChain consults each of its resolvers in order, returning the
+// answer of the first resolver which does not decline.
+type ResolverChain []ArchitectureResolver
+
+// NewResolverChain creates a ResolverChain from the given
+// comma-separated list of resolver names.
+func NewResolverChain(ctx *context.Context, names string) (ResolverChain, error) {
+	chain := make(ResolverChain, 0)
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		factory, ok := resolverFactories[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown architecture resolver: %s", name)
+		}
+		resolver, err := factory(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("unable to create architecture resolver %s: %w", name, err)
+		}
+		chain = append(chain, resolver)
+	}
+	if len(chain) == 0 {
+		return nil, fmt.Errorf("no architecture resolvers given")
+	}
+	return chain, nil
+}
+
+// Resolve consults each resolver in the chain for the requested image.
+func (c ResolverChain) Resolve(ctx *context.Context, request *ImageRequest) ([]ocispec.Platform, error) {
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("container-name", request.Container).
+			Str("container-image", request.Image)
+	}
+
+	if request.References == nil {
+		references, err := GetRegistriesConfig(ctx).References(request.Image)
+		if err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Invalid image reference")
+			return nil, err
+		}
+		request.References = references
+	}
+	getLog = func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("container-name", request.Container).
+			Str("container-image", request.Image).
+			Strs("references", request.References)
+	}
+
+	for _, resolver := range c {
+		platforms, err := resolver.Resolve(ctx, request)
+		if errors.Is(err, ErrResolverDeclined) {
+			getLog(zerolog.DebugLevel).
+				Str("resolver", resolver.Name()).
+				Msg("Resolver declined image, trying next")
+			continue
+		}
+		if err != nil {
+			getLog(zerolog.DebugLevel).
+				Str("resolver", resolver.Name()).
+				AnErr("err", err).
+				Msg("Resolver failed to resolve image")
+			return nil, err
+		}
+		getLog(zerolog.DebugLevel).
+			Str("resolver", resolver.Name()).
+			Str("architectures", formatPlatforms(platforms)).
+			Msg("Resolver resolved image")
+		return request.narrow(platforms), nil
+	}
+	return nil, fmt.Errorf("no architecture resolver was able to resolve %s", request.Image)
+}
+
+// setupResolverChain creates a ResolverChain from the CLI
+// and stores it in the given context.
+func setupResolverChain(ctx *context.Context) error {
+	chain, err := NewResolverChain(ctx, flag.Lookup("resolvers").Value.String())
+	if err != nil {
+		return err
+	}
+	*ctx = context.WithValue(*ctx, RESOLVER_CHAIN_KEY, chain)
+	return nil
+}
+
+// GetResolverChain pulls the set ResolverChain from the given context.
+// If no ResolverChain has been set, a chain consisting of only the
+// registry resolver is returned.
+func GetResolverChain(ctx *context.Context) ResolverChain {
+	result := (*ctx).Value(RESOLVER_CHAIN_KEY)
+	if result == nil {
+		return ResolverChain{&registryResolver{}}
+	}
+	return result.(ResolverChain)
+}
+
+// cacheResolver answers using the context's ImageCache, without
+// contacting any registry. Declines images which are not cached.
+type cacheResolver struct{}
+
+func (r *cacheResolver) Name() string {
+	return "cache"
+}
+
+func (r *cacheResolver) Resolve(ctx *context.Context, request *ImageRequest) ([]ocispec.Platform, error) {
+	cache := GetImageCache(ctx)
+
+	for _, ref := range request.references() {
+		if named, err := dockerref.ParseNormalizedNamed(ref); err == nil {
+			if canonical, ok := named.(dockerref.Canonical); ok {
+				if platforms, ok := cache.GetDigest(canonical.Digest()); ok {
+					return platforms, nil
+				}
+			}
+		}
+		if platforms, ok := cache.Get(ref); ok {
+			return platforms, nil
+		}
+	}
+	return nil, ErrResolverDeclined
+}
+
+// registryResolver answers by inspecting the image's manifest within
+// its registry, using the credentials within the request's keyring.
+type registryResolver struct{}
+
+func (r *registryResolver) Name() string {
+	return "registry"
+}
+
+func (r *registryResolver) Resolve(ctx *context.Context, request *ImageRequest) ([]ocispec.Platform, error) {
+	var err error
+	var platforms []ocispec.Platform
+	for _, ref := range request.references() {
+		platforms, err = getArchitecturesWithKeyring(ctx, ref, request.Keyring)
+		if err == nil {
+			return platforms, nil
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// stubResolver answers every request with its platforms and error,
+// recording the references of the requests it was consulted for.
+type stubResolver struct {
+	name      string
+	platforms []ocispec.Platform
+	err       error
+	// allowed is set onto requests before answering
+	allowed    []ocispec.Platform
+	references [][]string
+}
+
+func (r *stubResolver) Name() string {
+	return r.name
+}
+
+func (r *stubResolver) Resolve(ctx *context.Context, request *ImageRequest) ([]ocispec.Platform, error) {
+	r.references = append(r.references, request.References)
+	if r.allowed != nil {
+		request.Allowed = r.allowed
+	}
+	return r.platforms, r.err
+}
+
+func TestResolverChainOrder(t *testing.T) {
+	arm64 := []ocispec.Platform{{OS: "linux", Architecture: "arm64"}}
+	amd64 := []ocispec.Platform{{OS: "linux", Architecture: "amd64"}}
+	failure := errors.New("registry unavailable")
+
+	tests := []struct {
+		name      string
+		resolvers []*stubResolver
+		expected  []ocispec.Platform
+		err       error
+		// consulted is the number of resolvers expected to be consulted
+		consulted int
+	}{
+		{
+			name: "first answer wins",
+			resolvers: []*stubResolver{
+				{name: "first", platforms: arm64},
+				{name: "second", platforms: amd64},
+			},
+			expected:  arm64,
+			consulted: 1,
+		},
+		{
+			name: "declined images are passed on",
+			resolvers: []*stubResolver{
+				{name: "first", err: ErrResolverDeclined},
+				{name: "second", platforms: amd64},
+			},
+			expected:  amd64,
+			consulted: 2,
+		},
+		{
+			name: "failures stop the chain",
+			resolvers: []*stubResolver{
+				{name: "first", err: failure},
+				{name: "second", platforms: amd64},
+			},
+			err:       failure,
+			consulted: 1,
+		},
+		{
+			name: "every resolver declining fails",
+			resolvers: []*stubResolver{
+				{name: "first", err: ErrResolverDeclined},
+				{name: "second", err: ErrResolverDeclined},
+			},
+			err:       ErrResolverDeclined,
+			consulted: 2,
+		},
+	}
+	for _, test := range tests {
+		chain := make(ResolverChain, 0, len(test.resolvers))
+		for _, resolver := range test.resolvers {
+			chain = append(chain, resolver)
+		}
+
+		ctx := context.Background()
+		platforms, err := chain.Resolve(&ctx, &ImageRequest{Container: "app", Image: "example.com/app:1.0"})
+		switch {
+		case test.err == ErrResolverDeclined:
+			// The chain reports that nothing could resolve the image,
+			// rather than passing on a resolver's decline
+			if err == nil || errors.Is(err, ErrResolverDeclined) {
+				t.Errorf("%s: expected chain to fail, got %v", test.name, err)
+			}
+		case test.err != nil:
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: expected error %v, got %v", test.name, test.err, err)
+			}
+		case err != nil:
+			t.Errorf("%s: unexpected error: %v", test.name, err)
+		case !reflect.DeepEqual(platforms, test.expected):
+			t.Errorf("%s: expected platforms %s, got %s", test.name, formatPlatforms(test.expected), formatPlatforms(platforms))
+		}
+
+		for i, resolver := range test.resolvers {
+			if consulted := len(resolver.references) > 0; consulted != (i < test.consulted) {
+				t.Errorf("%s: expected resolver %s to be consulted: %v", test.name, resolver.name, i < test.consulted)
+			}
+		}
+	}
+}
+
+func TestResolverChainReferences(t *testing.T) {
+	config, err := parseRegistriesConfig([]byte(`
+unqualifiedSearchRegistries: [registry.internal, docker.io]
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), REGISTRIES_CONFIG_KEY, config)
+
+	first := &stubResolver{name: "first", err: ErrResolverDeclined}
+	second := &stubResolver{name: "second", platforms: []ocispec.Platform{{OS: "linux", Architecture: "arm64"}}}
+	chain := ResolverChain{first, second}
+
+	// Short names are searched for within each search registry, and every
+	// resolver is given the same references
+	if _, err := chain.Resolve(&ctx, &ImageRequest{Container: "app", Image: "app:1.0"}); err != nil {
+		t.Fatal(err)
+	}
+	expected := []string{"registry.internal/app:1.0", "docker.io/library/app:1.0"}
+	for _, resolver := range []*stubResolver{first, second} {
+		if len(resolver.references) != 1 || !reflect.DeepEqual(resolver.references[0], expected) {
+			t.Errorf("expected resolver %s to be given references %v, got %v", resolver.name, expected, resolver.references)
+		}
+	}
+
+	// References already set on the request are kept
+	first.references, second.references = nil, nil
+	references := []string{"mirror.internal/app:1.0"}
+	if _, err := chain.Resolve(&ctx, &ImageRequest{Container: "app", Image: "app:1.0", References: references}); err != nil {
+		t.Fatal(err)
+	}
+	if len(second.references) != 1 || !reflect.DeepEqual(second.references[0], references) {
+		t.Errorf("expected references set on the request to be kept, got %v", second.references)
+	}
+
+	// Invalid references fail before any resolver is consulted
+	first.references = nil
+	if _, err := chain.Resolve(&ctx, &ImageRequest{Container: "app", Image: "Invalid:Reference"}); err == nil {
+		t.Errorf("expected invalid reference to fail")
+	}
+	if len(first.references) != 0 {
+		t.Errorf("expected no resolver to be consulted for an invalid reference")
+	}
+}
+
+func TestResolverChainNarrow(t *testing.T) {
+	platforms := []ocispec.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+		{OS: "linux", Architecture: "arm", Variant: "v7"},
+		{OS: "windows", Architecture: "amd64"},
+	}
+	tests := []struct {
+		name     string
+		allowed  []ocispec.Platform
+		expected []ocispec.Platform
+	}{
+		{
+			name:     "nil allows everything",
+			expected: platforms,
+		},
+		{
+			name:     "empty allows nothing",
+			allowed:  []ocispec.Platform{},
+			expected: []ocispec.Platform{},
+		},
+		{
+			name:    "architectures",
+			allowed: []ocispec.Platform{{Architecture: "arm64"}, {Architecture: "arm"}},
+			expected: []ocispec.Platform{
+				{OS: "linux", Architecture: "arm64"},
+				{OS: "linux", Architecture: "arm", Variant: "v7"},
+			},
+		},
+		{
+			name:     "operating systems and variants",
+			allowed:  []ocispec.Platform{{OS: "windows", Architecture: "amd64"}, {OS: "linux", Architecture: "arm", Variant: "v6"}},
+			expected: []ocispec.Platform{{OS: "windows", Architecture: "amd64"}},
+		},
+	}
+	for _, test := range tests {
+		// A resolver narrowing the request before declining
+		// limits the answer of the resolvers after it
+		narrowing := &stubResolver{name: "narrowing", err: ErrResolverDeclined, allowed: test.allowed}
+		answering := &stubResolver{name: "answering", platforms: platforms}
+
+		ctx := context.Background()
+		result, err := ResolverChain{narrowing, answering}.Resolve(&ctx, &ImageRequest{Container: "app", Image: "example.com/app:1.0"})
+		if err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("%s: expected platforms %s, got %s", test.name, formatPlatforms(test.expected), formatPlatforms(result))
+		}
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// SchedulingGateFallback determines what happens to gated pods whose
+// images are still unresolved once their scheduling gate times out.
+type SchedulingGateFallback string
+
+const (
+	// SchedulingGateFallbackRelease removes the gate, letting the
+	// pod be scheduled without tolerations or node affinity.
+	SchedulingGateFallbackRelease SchedulingGateFallback = "release"
+	// SchedulingGateFallbackKeep leaves the pod gated, for it to be
+	// released by hand or once its images resolve.
+	SchedulingGateFallbackKeep SchedulingGateFallback = "keep"
+)
+
+// SchedulingGatePolicy configures holding pods back from being scheduled,
+// through a scheduling gate the admission webhook adds onto every pod, until
+// the pod watch has resolved the architectures of their images. This closes the
+// window in which a pod can land on a node before its tolerations or node
+// affinity are added, without resolving images within the webhook's deadline.
+type SchedulingGatePolicy struct {
+	Enabled bool
+	// Timeout is how long after its creation a pod may stay gated
+	// while its images are unresolved.
+	Timeout  time.Duration
+	Fallback SchedulingGateFallback
+}
+
+// defaultSchedulingGatePolicy doesn't gate pods.
+var defaultSchedulingGatePolicy = &SchedulingGatePolicy{
+	Timeout:  DEFAULT_SCHEDULING_GATE_TIMEOUT,
+	Fallback: SchedulingGateFallbackRelease,
+}
+
+// schedulingGatePatch returns the JSON patch adding the controller's
+// scheduling gate onto the given pod, or nil if the pod already has it.
+func schedulingGatePatch(pod *v1.Pod) []jsonPatchOperation {
+	if hasSchedulingGate(pod) {
+		return nil
+	}
+	gate := v1.PodSchedulingGate{Name: SCHEDULING_GATE_NAME}
+	if len(pod.Spec.SchedulingGates) == 0 {
+		return []jsonPatchOperation{
+			{Op: "add", Path: "/spec/schedulingGates", Value: []v1.PodSchedulingGate{gate}},
+		}
+	}
+	return []jsonPatchOperation{
+		{Op: "add", Path: "/spec/schedulingGates/-", Value: gate},
+	}
+}
+
+// hasSchedulingGate determines if the given pod was gated by
+// the controller on admission and is still waiting to be released.
+func hasSchedulingGate(pod *v1.Pod) bool {
+	for _, gate := range pod.Spec.SchedulingGates {
+		if gate.Name == SCHEDULING_GATE_NAME {
+			return true
+		}
+	}
+	return false
+}
+
+// schedulingGateReleasePatch returns the strategic merge patch removing the
+// controller's scheduling gate from the given pod, along with adding the
+// tolerations or node affinity of the given placement, if any. The pod's
+// resourceVersion is included, so the patch fails on conflict.
+func schedulingGateReleasePatch(ctx *context.Context, pod *v1.Pod, placement *podPlacement) ([]byte, error) {
+	// Gated pods are the exception to node affinity being immutable,
+	// as long as it's only made more restrictive (Kubernetes 1.27+)
+	spec := placementPatch(ctx, &pod.Spec, placement)
+	if spec == nil {
+		spec = make(map[string]interface{})
+	}
+	// Gates are merged by name, leaving the gates of others be
+	spec["schedulingGates"] = []map[string]interface{}{
+		{"name": SCHEDULING_GATE_NAME, "$patch": "delete"},
+	}
+	return podSpecPatch(pod, spec)
+}
+
+// releaseSchedulingGate removes the controller's scheduling gate from the
+// given pod, adding the tolerations or node affinity of the given placement.
+func releaseSchedulingGate(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface, placement *podPlacement) error {
+	podClient := clientset.CoreV1().Pods(pod.Namespace)
+	getPodLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("pod-name", pod.Name)
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, err := podClient.Get(*ctx, pod.Name, metav1.GetOptions{})
+		if err != nil {
+			getPodLog(zerolog.WarnLevel).
+				Msg("Unable to get latest information on pod")
+			return err
+		}
+		if !hasSchedulingGate(result) {
+			return nil
+		}
+
+		patch, err := schedulingGateReleasePatch(ctx, result, placement)
+		if err != nil {
+			return err
+		}
+		_, err = podClient.Patch(*ctx, pod.Name, types.StrategicMergePatchType, patch, metav1.PatchOptions{})
+		if err != nil {
+			getPodLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to remove scheduling gate from pod")
+			return err
+		}
+		getPodLog(zerolog.InfoLevel).
+			Bool("placed", placement != nil).
+			Msg("Removed scheduling gate from pod")
+		return nil
+	})
+}
+
+// schedulingGateDeadline returns when the scheduling gate of the given pod times out.
+func schedulingGateDeadline(ctx *context.Context, pod *v1.Pod) time.Time {
+	return pod.CreationTimestamp.Add(GetSchedulingGatePolicy(ctx).Timeout)
+}
+
+// handleGatedPod releases the given pod gated by the controller, given the
+// result of resolving its placement. Pods whose images are unresolved stay
+// gated until their gate times out, after which the fallback policy applies.
+func handleGatedPod(ctx *context.Context, pod *v1.Pod, clientset kubernetes.Interface, placement *podPlacement, resolveErr error) error {
+	if resolveErr != nil {
+		if (*ctx).Err() != nil || time.Now().Before(schedulingGateDeadline(ctx, pod)) {
+			return resolveErr
+		}
+
+		policy := GetSchedulingGatePolicy(ctx)
+		log.WithLevel(zerolog.WarnLevel).
+			Str("pod-name", pod.Name).
+			Str("fallback", string(policy.Fallback)).
+			AnErr("err", resolveErr).
+			Msg("Scheduling gate of pod timed out")
+		if recorder := GetEventRecorder(ctx); recorder != nil {
+			recorder.Eventf(
+				pod,
+				v1.EventTypeWarning,
+				"SchedulingGateTimeout",
+				"Unable to determine the architectures of the pod's images within %s, applying fallback policy %s: %v",
+				policy.Timeout, policy.Fallback, resolveErr,
+			)
+		}
+		if policy.Fallback == SchedulingGateFallbackKeep {
+			return nil
+		}
+		placement = nil
+	}
+	return releaseSchedulingGate(ctx, pod, clientset, placement)
+}
+
+// setupSchedulingGatePolicy creates a SchedulingGatePolicy from
+// the CLI and stores it in the given context.
+func setupSchedulingGatePolicy(ctx *context.Context) error {
+	fallback := SchedulingGateFallback(flag.Lookup("scheduling-gate-fallback").Value.String())
+	if fallback != SchedulingGateFallbackRelease && fallback != SchedulingGateFallbackKeep {
+		return fmt.Errorf(
+			"unknown scheduling gate fallback: %s, expected %s or %s",
+			fallback, SchedulingGateFallbackRelease, SchedulingGateFallbackKeep,
+		)
+	}
+	policy := &SchedulingGatePolicy{
+		Enabled:  flag.Lookup("scheduling-gates").Value.(flag.Getter).Get().(bool),
+		Timeout:  flag.Lookup("scheduling-gate-timeout").Value.(flag.Getter).Get().(time.Duration),
+		Fallback: fallback,
+	}
+	*ctx = context.WithValue(*ctx, SCHEDULING_GATE_POLICY_KEY, policy)
+	return nil
+}
+
+// GetSchedulingGatePolicy pulls the set SchedulingGatePolicy from the given
+// context. If no SchedulingGatePolicy has been set, pods aren't gated.
+func GetSchedulingGatePolicy(ctx *context.Context) *SchedulingGatePolicy {
+	result := (*ctx).Value(SCHEDULING_GATE_POLICY_KEY)
+	if result == nil {
+		return defaultSchedulingGatePolicy
+	}
+	return result.(*SchedulingGatePolicy)
+}
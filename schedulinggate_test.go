@@ -0,0 +1,210 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestSchedulingGatePatch(t *testing.T) {
+	other := v1.PodSchedulingGate{Name: "example.com/other"}
+	gate := v1.PodSchedulingGate{Name: SCHEDULING_GATE_NAME}
+
+	pod := &v1.Pod{}
+	expected := []jsonPatchOperation{
+		{Op: "add", Path: "/spec/schedulingGates", Value: []v1.PodSchedulingGate{gate}},
+	}
+	if patch := schedulingGatePatch(pod); !reflect.DeepEqual(patch, expected) {
+		t.Errorf("unexpected patch: %+v, expected %+v", patch, expected)
+	}
+
+	// The gates of others are kept
+	pod.Spec.SchedulingGates = []v1.PodSchedulingGate{other}
+	expected = []jsonPatchOperation{
+		{Op: "add", Path: "/spec/schedulingGates/-", Value: gate},
+	}
+	if patch := schedulingGatePatch(pod); !reflect.DeepEqual(patch, expected) {
+		t.Errorf("unexpected patch: %+v, expected %+v", patch, expected)
+	}
+
+	pod.Spec.SchedulingGates = []v1.PodSchedulingGate{other, gate}
+	if patch := schedulingGatePatch(pod); patch != nil {
+		t.Errorf("expected gated pod not to be patched: %+v", patch)
+	}
+}
+
+func TestAdmissionWebhookSchedulingGate(t *testing.T) {
+	catalog := NewCatalog()
+	if err := catalog.Load("test", []byte(`
+images:
+- match: example.com/app:1.0
+  platforms: [linux/s390x]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), RESOLVER_CHAIN_KEY, ResolverChain{&catalogResolver{catalog: catalog}})
+	ctx = context.WithValue(ctx, SCHEDULING_GATE_POLICY_KEY, &SchedulingGatePolicy{Enabled: true, Timeout: time.Minute})
+	webhook := &admissionWebhook{
+		ctx:        &ctx,
+		clientset:  fake.NewSimpleClientset(),
+		timeout:    time.Second,
+		failClosed: true,
+	}
+
+	// Every pod is gated without being resolved, whether its
+	// images are resolvable or not, leaving them to the pod watch
+	for _, image := range []string{"example.com/app:1.0", "example.com/unknown:1.0"} {
+		pod := &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "app"},
+			Spec: v1.PodSpec{
+				Containers: []v1.Container{{Name: "app", Image: image}},
+			},
+		}
+		response := reviewPod(t, webhook, pod)
+		if !response.Allowed || response.PatchType == nil {
+			t.Fatalf("expected pod with image %s to be allowed with a JSON patch: %+v", image, response)
+		}
+		var patch []jsonPatchOperation
+		if err := json.Unmarshal(response.Patch, &patch); err != nil {
+			t.Fatal(err)
+		}
+		expected := []jsonPatchOperation{
+			{Op: "add", Path: "/spec/schedulingGates", Value: []interface{}{map[string]interface{}{"name": SCHEDULING_GATE_NAME}}},
+		}
+		if !reflect.DeepEqual(patch, expected) {
+			t.Errorf("unexpected patch for image %s: %+v, expected %+v", image, patch, expected)
+		}
+	}
+}
+
+// gatedPodPatches handles the given gated pod with the given scheduling gate
+// policy, returning the strategic merge patches made onto the pod along with
+// the pod once patched.
+func gatedPodPatches(t *testing.T, pod *v1.Pod, policy *SchedulingGatePolicy) ([]map[string]interface{}, *v1.Pod) {
+	catalog := NewCatalog()
+	if err := catalog.Load("test", []byte(`
+images:
+- match: example.com/app:1.0
+  platforms: [linux/s390x]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), RESOLVER_CHAIN_KEY, ResolverChain{&catalogResolver{catalog: catalog}})
+	ctx = context.WithValue(ctx, SCHEDULING_GATE_POLICY_KEY, policy)
+
+	// Patches are recorded, then applied by the fake clientset
+	patches := make([]map[string]interface{}, 0)
+	clientset := fake.NewSimpleClientset(pod)
+	clientset.PrependReactor("patch", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		patchAction := action.(k8stesting.PatchAction)
+		if patchAction.GetPatchType() != types.StrategicMergePatchType {
+			t.Errorf("unexpected patch type: %s", patchAction.GetPatchType())
+		}
+		var patch map[string]interface{}
+		if err := json.Unmarshal(patchAction.GetPatch(), &patch); err != nil {
+			t.Fatal(err)
+		}
+		patches = append(patches, patch)
+		return false, nil, nil
+	})
+
+	handlePod(&ctx, pod, clientset)
+	result, err := clientset.CoreV1().Pods(pod.Namespace).Get(ctx, pod.Name, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return patches, result
+}
+
+func TestHandleGatedPod(t *testing.T) {
+	other := v1.PodSchedulingGate{Name: "example.com/other"}
+	newPod := func(image string, created time.Time) *v1.Pod {
+		return &v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:              "app",
+				Namespace:         "default",
+				ResourceVersion:   "1",
+				CreationTimestamp: metav1.NewTime(created),
+			},
+			Spec: v1.PodSpec{
+				Containers:      []v1.Container{{Name: "app", Image: image}},
+				SchedulingGates: []v1.PodSchedulingGate{other, {Name: SCHEDULING_GATE_NAME}},
+			},
+		}
+	}
+	policy := &SchedulingGatePolicy{Enabled: true, Timeout: time.Minute, Fallback: SchedulingGateFallbackRelease}
+	releaseMetadata := map[string]interface{}{"resourceVersion": "1"}
+	releaseGates := []interface{}{map[string]interface{}{"name": SCHEDULING_GATE_NAME, "$patch": "delete"}}
+	tolerations := []v1.Toleration{
+		{Key: ARCH_TAINT_KEY_NAME, Value: "s390x", Effect: v1.TaintEffectNoSchedule},
+		{Key: OS_TAINT_KEY_NAME, Value: "linux", Effect: v1.TaintEffectNoSchedule},
+	}
+
+	// Resolved pods are released along with their tolerations,
+	// keeping the gates of others
+	patches, pod := gatedPodPatches(t, newPod("example.com/app:1.0", time.Now()), policy)
+	expected := []map[string]interface{}{{
+		"metadata": releaseMetadata,
+		"spec": map[string]interface{}{
+			"schedulingGates": releaseGates,
+			"tolerations": []interface{}{
+				map[string]interface{}{"key": ARCH_TAINT_KEY_NAME, "value": "s390x", "effect": "NoSchedule"},
+				map[string]interface{}{"key": OS_TAINT_KEY_NAME, "value": "linux", "effect": "NoSchedule"},
+			},
+		},
+	}}
+	if !reflect.DeepEqual(patches, expected) {
+		t.Errorf("unexpected patches: %+v, expected %+v", patches, expected)
+	}
+	if !reflect.DeepEqual(pod.Spec.SchedulingGates, []v1.PodSchedulingGate{other}) {
+		t.Errorf("unexpected scheduling gates once released: %+v", pod.Spec.SchedulingGates)
+	}
+	if !reflect.DeepEqual(pod.Spec.Tolerations, tolerations) {
+		t.Errorf("unexpected tolerations once released: %+v", pod.Spec.Tolerations)
+	}
+
+	// Unresolved pods stay gated until their gate times out
+	if patches, _ := gatedPodPatches(t, newPod("example.com/unknown:1.0", time.Now()), policy); len(patches) != 0 {
+		t.Errorf("expected pod to stay gated: %+v", patches)
+	}
+	expected = []map[string]interface{}{{
+		"metadata": releaseMetadata,
+		"spec":     map[string]interface{}{"schedulingGates": releaseGates},
+	}}
+	patches, pod = gatedPodPatches(t, newPod("example.com/unknown:1.0", time.Now().Add(-time.Hour)), policy)
+	if !reflect.DeepEqual(patches, expected) {
+		t.Errorf("unexpected patches: %+v, expected %+v", patches, expected)
+	}
+	if !reflect.DeepEqual(pod.Spec.SchedulingGates, []v1.PodSchedulingGate{other}) {
+		t.Errorf("unexpected scheduling gates once released: %+v", pod.Spec.SchedulingGates)
+	}
+
+	keep := &SchedulingGatePolicy{Enabled: true, Timeout: time.Minute, Fallback: SchedulingGateFallbackKeep}
+	if patches, _ := gatedPodPatches(t, newPod("example.com/unknown:1.0", time.Now().Add(-time.Hour)), keep); len(patches) != 0 {
+		t.Errorf("expected pod to stay gated: %+v", patches)
+	}
+
+	// Pods gated by others only are patched with their tolerations,
+	// rather than updated, keeping the gates
+	pod = newPod("example.com/app:1.0", time.Now())
+	pod.Spec.SchedulingGates = []v1.PodSchedulingGate{other}
+	patches, pod = gatedPodPatches(t, pod, policy)
+	if len(patches) != 1 {
+		t.Errorf("expected pod to be patched once: %+v", patches)
+	}
+	if !reflect.DeepEqual(pod.Spec.SchedulingGates, []v1.PodSchedulingGate{other}) {
+		t.Errorf("unexpected scheduling gates once patched: %+v", pod.Spec.SchedulingGates)
+	}
+	if !reflect.DeepEqual(pod.Spec.Tolerations, tolerations) {
+		t.Errorf("unexpected tolerations once patched: %+v", pod.Spec.Tolerations)
+	}
+}
@@ -12,9 +12,13 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/sirupsen/logrus"
+	v1 "k8s.io/api/core/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedv1 "k8s.io/client-go/kubernetes/typed/core/v1"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
+	"k8s.io/client-go/tools/record"
 	"k8s.io/client-go/util/homedir"
 )
 
@@ -107,6 +111,23 @@ func setupK8sClient(ctx *context.Context) error {
 	return nil
 }
 
+// setupEventRecorder creates an event recorder which publishes
+// events using the Kubernetes client within the given context.
+func setupEventRecorder(ctx *context.Context) {
+	clientset := GetK8sInterface(ctx)
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(
+		&typedv1.EventSinkImpl{
+			Interface: clientset.CoreV1().Events(""),
+		},
+	)
+	recorder := broadcaster.NewRecorder(
+		scheme.Scheme,
+		v1.EventSource{Component: OPERATOR_NAME},
+	)
+	*ctx = context.WithValue(*ctx, K8S_EVENT_RECORDER_KEY, recorder)
+}
+
 // GetK8sInterface pulls the set interface from the given context.
 func GetK8sInterface(ctx *context.Context) kubernetes.Interface {
 	result := (*ctx).Value(K8S_INTERFACE_KEY)
@@ -116,20 +137,80 @@ func GetK8sInterface(ctx *context.Context) kubernetes.Interface {
 	return result.(kubernetes.Interface)
 }
 
+// GetEventRecorder pulls the set event recorder from the given context.
+func GetEventRecorder(ctx *context.Context) record.EventRecorder {
+	result := (*ctx).Value(K8S_EVENT_RECORDER_KEY)
+	if result == nil {
+		return nil
+	}
+	return result.(record.EventRecorder)
+}
+
 // Setup performs setup functions required before execution,
 // returning a context object populated with variables needed
 // by other functions consuming the context
 func Setup() (context.Context, context.CancelFunc) {
 	setupLogging()
-	ctx := context.Background()
+	ctx, stop := signal.NotifyContext(
+		context.Background(),
+		syscall.SIGINT, syscall.SIGTERM,
+	)
 
 	err := setupK8sClient(&ctx)
 	if err != nil {
 		panic(err)
 	}
-	ctx, stop := signal.NotifyContext(
-		ctx,
-		syscall.SIGINT, syscall.SIGTERM,
-	)
+	setupEventRecorder(&ctx)
+	setupMetrics(&ctx)
+
+	err = setupPlacementMode(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = setupSchedulingGatePolicy(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = setupWorkloadTemplates(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = setupPlatformConfig(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	setupImageCache(&ctx)
+	err = setupRegistriesConfig(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = setupRegistryPolicy(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = setupRegistryClient(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = setupControllerCredentials(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = setupCredentialProviders(&ctx)
+	if err != nil {
+		panic(err)
+	}
+
+	// Resolvers may start background work tied to the context,
+	// so the chain is setup last, followed by the webhook using it
+	err = setupResolverChain(&ctx)
+	if err != nil {
+		panic(err)
+	}
+	err = setupAdmissionWebhook(&ctx)
+	if err != nil {
+		panic(err)
+	}
+
 	return ctx, stop
 }
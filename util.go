@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"math"
 	"reflect"
 	"runtime"
 	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/singleflight"
 )
 
 // RetryOnError attempts to execute the given function, retrying when it returns an error.
@@ -47,37 +49,56 @@ func RetryOnError(ctx *context.Context, callable func() error) (int, error) {
 				return attempts, err
 			}
 			backoff = get_backoff()
+			// Rate-limited registries tell us how long to back off for
+			var rateLimitErr *RateLimitError
+			if errors.As(err, &rateLimitErr) && rateLimitErr.RetryAfter > backoff {
+				backoff = rateLimitErr.RetryAfter
+			}
 			attempt_log.
 				AnErr("err", err).
 				Int("backoff_seconds", int(backoff.Seconds())).
 				Msg("Retrying after sleeping.")
-			time.Sleep(backoff)
+			select {
+			case <-(*ctx).Done():
+				return attempts, (*ctx).Err()
+			case <-time.After(backoff):
+			}
 		}
 	}
 }
 
 // Intersection finds the intersection between slices.
-// Based on: https://siongui.github.io/2018/03/09/go-match-common-element-in-two-array/
+// Each item appears at most once within the result, in the order
+// it first appears within the first slice.
 func Intersection[T comparable](slices ...[]T) (intersection []T) {
 	num_input_slices := len(slices)
 	if num_input_slices == 0 {
 		return make([]T, 0)
-	} else if num_input_slices == 1 {
-		return slices[0]
 	}
 
-	intersection_map := make(map[T]bool)
+	// intersection_map tracks the number of slices each item has
+	// been seen in so far
+	intersection_map := make(map[T]int)
 	for _, item := range slices[0] {
-		intersection_map[item] = true
+		intersection_map[item] = 1
 	}
 
-	for _, slice := range slices[1:] {
+	for i, slice := range slices[1:] {
 		for _, item := range slice {
-			if _, ok := intersection_map[item]; ok {
-				intersection = append(intersection, item)
+			if count, ok := intersection_map[item]; ok && count == i+1 {
+				intersection_map[item] = i + 2
 			}
 		}
 	}
+
+	intersection = make([]T, 0)
+	for _, item := range slices[0] {
+		if intersection_map[item] == num_input_slices {
+			intersection = append(intersection, item)
+			// Prevent duplicates from being added twice
+			intersection_map[item] = 0
+		}
+	}
 	return
 }
 
@@ -89,3 +110,44 @@ func RemoveFromSlice[T interface{}](slice *[]T, target int) {
 	(*slice)[target] = (*slice)[sliceLen-1]
 	*slice = (*slice)[:sliceLen-1]
 }
+
+// detachedContext carries the values of its parent,
+// without its deadline or cancellation.
+type detachedContext struct {
+	parent context.Context
+}
+
+func (c detachedContext) Deadline() (time.Time, bool) {
+	return time.Time{}, false
+}
+
+func (c detachedContext) Done() <-chan struct{} {
+	return nil
+}
+
+func (c detachedContext) Err() error {
+	return nil
+}
+
+func (c detachedContext) Value(key interface{}) interface{} {
+	return c.parent.Value(key)
+}
+
+// DoShared executes the given function through the given singleflight.Group,
+// sharing its result with concurrent callers using the same key.
+// The function is shared, so it's given a context detached from the deadline
+// and cancellation of whichever caller happened to start it, such as the
+// admission webhook's timeout. Each caller instead stops waiting on the
+// function once its own context is done.
+func DoShared(ctx *context.Context, group *singleflight.Group, key string, fn func(ctx *context.Context) (interface{}, error)) (interface{}, error, bool) {
+	var detached context.Context = detachedContext{parent: *ctx}
+	results := group.DoChan(key, func() (interface{}, error) {
+		return fn(&detached)
+	})
+	select {
+	case <-(*ctx).Done():
+		return nil, (*ctx).Err(), false
+	case result := <-results:
+		return result.Val, result.Err, result.Shared
+	}
+}
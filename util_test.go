@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+func TestIntersection(t *testing.T) {
+	tests := []struct {
+		slices   [][]string
+		expected []string
+	}{
+		{[][]string{}, []string{}},
+		{[][]string{{"amd64", "arm"}}, []string{"amd64", "arm"}},
+		{[][]string{{"amd64", "arm"}, {"arm", "amd64"}}, []string{"amd64", "arm"}},
+		{[][]string{{"amd64", "arm"}, {"amd64"}, {"arm"}}, []string{}},
+		{[][]string{{"amd64", "arm", "arm64"}, {"arm", "arm64"}, {"arm64", "arm"}}, []string{"arm", "arm64"}},
+		{[][]string{{"amd64", "amd64"}, {"amd64", "amd64"}}, []string{"amd64"}},
+		{[][]string{{"amd64"}, {}}, []string{}},
+	}
+	for _, test := range tests {
+		result := Intersection(test.slices...)
+		if !reflect.DeepEqual(result, test.expected) {
+			t.Errorf("expected intersection of %v to be %v, got %v", test.slices, test.expected, result)
+		}
+	}
+}
+
+func TestDoShared(t *testing.T) {
+	var group singleflight.Group
+	release := make(chan struct{})
+	lookupErr := make(chan error, 1)
+	lookup := func(ctx *context.Context) (interface{}, error) {
+		<-release
+		lookupErr <- (*ctx).Err()
+		return "result", nil
+	}
+
+	// The caller starting the lookup gives up once its deadline passes
+	shortCtx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err, _ := DoShared(&shortCtx, &group, "key", lookup); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected caller to stop waiting at its deadline, got %v", err)
+	}
+
+	// While other callers still get the lookup's result
+	results := make(chan interface{}, 1)
+	go func() {
+		ctx := context.Background()
+		result, err, _ := DoShared(&ctx, &group, "key", lookup)
+		if err != nil {
+			t.Error(err)
+		}
+		results <- result
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	if result := <-results; result != "result" {
+		t.Errorf("unexpected result of shared lookup: %v", result)
+	}
+	if err := <-lookupErr; err != nil {
+		t.Errorf("expected lookup not to be cancelled with its first caller, got %v", err)
+	}
+}
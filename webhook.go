@@ -0,0 +1,303 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	admissionv1 "k8s.io/api/admission/v1"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+// jsonPatchOperation is a single operation within a JSON patch (RFC 6902),
+// as returned by mutating admission webhooks.
+type jsonPatchOperation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path"`
+	Value interface{} `json:"value,omitempty"`
+}
+
+// tolerationsPatch returns the JSON patch adding the given
+// tolerations onto the given pod.
+func tolerationsPatch(pod *v1.Pod, tolerations []v1.Toleration) []jsonPatchOperation {
+	if len(pod.Spec.Tolerations) == 0 {
+		return []jsonPatchOperation{
+			{Op: "add", Path: "/spec/tolerations", Value: tolerations},
+		}
+	}
+	patch := make([]jsonPatchOperation, 0, len(tolerations))
+	for _, toleration := range tolerations {
+		patch = append(patch, jsonPatchOperation{Op: "add", Path: "/spec/tolerations/-", Value: toleration})
+	}
+	return patch
+}
+
+// admissionWebhook adds the tolerations or node affinity a pod needs onto
+// the pod while it is being admitted, so that pods are schedulable as soon as
+// they're created rather than once the pod watch catches up with them. With
+// tolerations, the pod watch remains as a backstop for pods admitted while the
+// webhook is unavailable. Node affinity can only be set on creation, or while
+// the pod is gated. With scheduling gates enabled, every pod is gated instead,
+// leaving the pod watch to add its placement and release it.
+type admissionWebhook struct {
+	ctx       *context.Context
+	clientset kubernetes.Interface
+	// timeout bounds the time spent resolving a pod's images, which should
+	// be less than the timeout given to the API server for the webhook.
+	timeout time.Duration
+	// failClosed rejects pods whose images can't be resolved in time,
+	// rather than admitting them unchanged.
+	failClosed bool
+}
+
+// admit computes the admission response for the given admission request.
+func (w *admissionWebhook) admit(request *admissionv1.AdmissionRequest) *admissionv1.AdmissionResponse {
+	response := &admissionv1.AdmissionResponse{
+		UID:     request.UID,
+		Allowed: true,
+	}
+	if request.Kind.Kind != "Pod" || request.Operation != admissionv1.Create {
+		return response
+	}
+
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("admission-uid", string(request.UID)).
+			Str("namespace", request.Namespace)
+	}
+
+	var pod v1.Pod
+	if err := json.Unmarshal(request.Object.Raw, &pod); err != nil {
+		getLog(zerolog.WarnLevel).
+			AnErr("err", err).
+			Msg("Unable to decode pod under admission")
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusBadRequest,
+			Message: fmt.Sprintf("unable to decode pod: %v", err),
+		}
+		return response
+	}
+	// Pods created through a generateName (such as those of a ReplicaSet)
+	// have no name yet, and the namespace may be left to the request
+	if pod.Namespace == "" {
+		pod.Namespace = request.Namespace
+	}
+
+	if GetSchedulingGatePolicy(w.ctx).Enabled {
+		// Rather than resolving its images within the webhook's deadline,
+		// the pod is held back from scheduling until the pod watch has done so
+		patch := schedulingGatePatch(&pod)
+		if patch == nil {
+			return response
+		}
+		getLog(zerolog.DebugLevel).
+			Msg("Adding scheduling gate onto pod under admission")
+		return w.patch(response, patch)
+	}
+
+	ctx, cancel := context.WithTimeout(*w.ctx, w.timeout)
+	defer cancel()
+	// The pod doesn't exist yet, so events can't be recorded against it.
+	// The pod watch records them once the pod has been created.
+	ctx = context.WithValue(ctx, K8S_EVENT_RECORDER_KEY, nil)
+
+	placement, err := getPodPlacement(&ctx, &pod, w.clientset)
+	if err != nil {
+		if !w.failClosed {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to get placement of pod under admission, admitting unchanged")
+			return response
+		}
+		getLog(zerolog.WarnLevel).
+			AnErr("err", err).
+			Msg("Unable to get placement of pod under admission, rejecting")
+		response.Allowed = false
+		response.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusServiceUnavailable,
+			Message: fmt.Sprintf("%s unable to determine the architectures of the pod's images: %v", OPERATOR_NAME, err),
+		}
+		return response
+	}
+	if placement == nil {
+		return response
+	}
+
+	var patch []jsonPatchOperation
+	if GetPlacementMode(w.ctx) == PlacementModeAffinity {
+		affinity, changed := mergeNodeAffinity(pod.Spec.Affinity, placement.nodeSelectorRequirements())
+		if !changed {
+			return response
+		}
+		// Adding onto an existing member replaces it
+		patch = []jsonPatchOperation{{Op: "add", Path: "/spec/affinity", Value: affinity}}
+		getLog(zerolog.InfoLevel).
+			Interface("node-affinity", affinity.NodeAffinity).
+			Msg("Adding node affinity onto pod under admission")
+	} else {
+		missing := missingTolerations(pod.Spec.Tolerations, placement.tolerations())
+		if len(missing) == 0 {
+			return response
+		}
+		patch = tolerationsPatch(&pod, missing)
+		getLog(zerolog.InfoLevel).
+			Interface("tolerations", missing).
+			Msg("Adding tolerations onto pod under admission")
+	}
+
+	return w.patch(response, patch)
+}
+
+// patch sets the given JSON patch onto the given admission response.
+func (w *admissionWebhook) patch(response *admissionv1.AdmissionResponse, patch []jsonPatchOperation) *admissionv1.AdmissionResponse {
+	data, err := json.Marshal(patch)
+	if err != nil {
+		log.WithLevel(zerolog.ErrorLevel).
+			Str("admission-uid", string(response.UID)).
+			AnErr("err", err).
+			Msg("Unable to encode patch")
+		return response
+	}
+	patchType := admissionv1.PatchTypeJSONPatch
+	response.Patch = data
+	response.PatchType = &patchType
+	return response
+}
+
+func (w *admissionWebhook) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	if req.Method != http.MethodPost {
+		http.Error(rw, "expected a POST request", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(rw, req.Body, MAX_ADMISSION_REVIEW_SIZE))
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("unable to read request: %v", err), http.StatusBadRequest)
+		return
+	}
+
+	var review admissionv1.AdmissionReview
+	if err := json.Unmarshal(body, &review); err != nil || review.Request == nil {
+		http.Error(rw, "expected an admission.k8s.io/v1 AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	review.Response = w.admit(review.Request)
+	review.Request = nil
+	data, err := json.Marshal(review)
+	if err != nil {
+		http.Error(rw, fmt.Sprintf("unable to encode response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	rw.Write(data)
+}
+
+// setupAdmissionWebhook creates the HTTPS server of the mutating admission
+// webhook from the CLI, if an address is given, and stores it in the given
+// context. Without a certificate given on the CLI, the controller's own
+// certificates are issued before the server is stored.
+func setupAdmissionWebhook(ctx *context.Context) error {
+	address := flag.Lookup("webhook-address").Value.String()
+	if address == "" {
+		return nil
+	}
+
+	failurePolicy := flag.Lookup("webhook-failure-policy").Value.String()
+	if failurePolicy != string(admissionregistrationv1.Ignore) && failurePolicy != string(admissionregistrationv1.Fail) {
+		return fmt.Errorf("unknown webhook failure policy: %s, expected Ignore or Fail", failurePolicy)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(
+		"/mutate-pods",
+		&admissionWebhook{
+			ctx:        ctx,
+			clientset:  GetK8sInterface(ctx),
+			timeout:    flag.Lookup("webhook-timeout").Value.(flag.Getter).Get().(time.Duration),
+			failClosed: failurePolicy == string(admissionregistrationv1.Fail),
+		},
+	)
+	server := &http.Server{
+		Addr:              address,
+		Handler:           mux,
+		ReadHeaderTimeout: time.Second * time.Duration(10),
+		TLSConfig: &tls.Config{
+			MinVersion: tls.VersionTLS12,
+		},
+	}
+
+	certFile := flag.Lookup("webhook-cert-file").Value.String()
+	keyFile := flag.Lookup("webhook-key-file").Value.String()
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return fmt.Errorf("unable to load webhook certificate: %w", err)
+		}
+		server.TLSConfig.Certificates = []tls.Certificate{cert}
+	} else {
+		certs, err := newWebhookCertificates(ctx)
+		if err != nil {
+			return fmt.Errorf("unable to setup webhook certificates: %w", err)
+		}
+		if err := certs.Start(ctx); err != nil {
+			return fmt.Errorf("unable to issue webhook certificates: %w", err)
+		}
+		server.TLSConfig.GetCertificate = certs.GetCertificate
+	}
+
+	*ctx = context.WithValue(*ctx, ADMISSION_WEBHOOK_KEY, server)
+	return nil
+}
+
+// GetAdmissionWebhookServer pulls the set admission webhook server from
+// the given context. If no server has been set, nil is returned.
+func GetAdmissionWebhookServer(ctx *context.Context) *http.Server {
+	result := (*ctx).Value(ADMISSION_WEBHOOK_KEY)
+	if result == nil {
+		return nil
+	}
+	return result.(*http.Server)
+}
+
+// ServeAdmissionWebhook serves the mutating admission webhook over HTTPS,
+// if enabled on the CLI, until the given context is done.
+func ServeAdmissionWebhook(ctx *context.Context) {
+	server := GetAdmissionWebhookServer(ctx)
+	if server == nil {
+		return
+	}
+
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("webhook-address", server.Addr)
+	}
+
+	go func() {
+		<-(*ctx).Done()
+		server.Close()
+	}()
+
+	getLog(zerolog.InfoLevel).
+		Msg("Serving admission webhook")
+	// Certificates are given through the server's TLS config
+	err := server.ListenAndServeTLS("", "")
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		getLog(zerolog.ErrorLevel).
+			AnErr("err", err).
+			Msg("Unable to serve admission webhook")
+	}
+}
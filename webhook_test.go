@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	admissionv1 "k8s.io/api/admission/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// reviewPod sends an AdmissionReview for the creation of the given pod
+// through the given webhook, returning the webhook's response.
+func reviewPod(t *testing.T, webhook *admissionWebhook, pod *v1.Pod) *admissionv1.AdmissionResponse {
+	raw, err := json.Marshal(pod)
+	if err != nil {
+		t.Fatal(err)
+	}
+	review, err := json.Marshal(admissionv1.AdmissionReview{
+		TypeMeta: metav1.TypeMeta{APIVersion: "admission.k8s.io/v1", Kind: "AdmissionReview"},
+		Request: &admissionv1.AdmissionRequest{
+			UID:       "review",
+			Kind:      metav1.GroupVersionKind{Version: "v1", Kind: "Pod"},
+			Namespace: "default",
+			Operation: admissionv1.Create,
+			Object:    runtime.RawExtension{Raw: raw},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	recorder := httptest.NewRecorder()
+	webhook.ServeHTTP(recorder, httptest.NewRequest(http.MethodPost, "/mutate-pods", bytes.NewReader(review)))
+	if recorder.Code != http.StatusOK {
+		t.Fatalf("unexpected status from webhook: %d %s", recorder.Code, recorder.Body.String())
+	}
+	var result admissionv1.AdmissionReview
+	if err := json.Unmarshal(recorder.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.Response == nil || result.Response.UID != "review" {
+		t.Fatalf("unexpected response from webhook: %s", recorder.Body.String())
+	}
+	return result.Response
+}
+
+func TestAdmissionWebhook(t *testing.T) {
+	catalog := NewCatalog()
+	if err := catalog.Load("test", []byte(`
+images:
+- match: example.com/app:1.0
+  platforms: [linux/s390x, linux/ppc64le]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), RESOLVER_CHAIN_KEY, ResolverChain{&catalogResolver{catalog: catalog}})
+	webhook := &admissionWebhook{
+		ctx:       &ctx,
+		clientset: fake.NewSimpleClientset(),
+		timeout:   time.Second,
+	}
+
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "app-"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "app", Image: "example.com/app:1.0"}},
+			Tolerations: []v1.Toleration{
+				{Key: ARCH_TAINT_KEY_NAME, Value: "s390x", Effect: v1.TaintEffectNoSchedule},
+			},
+		},
+	}
+	response := reviewPod(t, webhook, pod)
+	if !response.Allowed || response.PatchType == nil || *response.PatchType != admissionv1.PatchTypeJSONPatch {
+		t.Fatalf("expected pod to be allowed with a JSON patch: %+v", response)
+	}
+	var patch []jsonPatchOperation
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	expected := []jsonPatchOperation{
+		{Op: "add", Path: "/spec/tolerations/-", Value: map[string]interface{}{"key": ARCH_TAINT_KEY_NAME, "value": "ppc64le", "effect": "NoSchedule"}},
+		{Op: "add", Path: "/spec/tolerations/-", Value: map[string]interface{}{"key": OS_TAINT_KEY_NAME, "value": "linux", "effect": "NoSchedule"}},
+	}
+	if !reflect.DeepEqual(patch, expected) {
+		t.Errorf("unexpected patch: %+v, expected %+v", patch, expected)
+	}
+
+	// Pods whose images can't be resolved are admitted unchanged,
+	// unless the webhook fails closed
+	unknown := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: "unknown"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "app", Image: "example.com/unknown:1.0"}},
+		},
+	}
+	if response := reviewPod(t, webhook, unknown); !response.Allowed || response.Patch != nil {
+		t.Errorf("expected unresolvable pod to be admitted unchanged: %+v", response)
+	}
+	webhook.failClosed = true
+	if response := reviewPod(t, webhook, unknown); response.Allowed {
+		t.Errorf("expected unresolvable pod to be rejected when failing closed")
+	}
+}
+
+func TestAdmissionWebhookNodeAffinity(t *testing.T) {
+	catalog := NewCatalog()
+	if err := catalog.Load("test", []byte(`
+images:
+- match: example.com/app:1.0
+  platforms: [linux/s390x, linux/ppc64le]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.WithValue(context.Background(), RESOLVER_CHAIN_KEY, ResolverChain{&catalogResolver{catalog: catalog}})
+	ctx = context.WithValue(ctx, PLACEMENT_MODE_KEY, PlacementModeAffinity)
+	webhook := &admissionWebhook{
+		ctx:       &ctx,
+		clientset: fake.NewSimpleClientset(),
+		timeout:   time.Second,
+	}
+
+	zone := v1.NodeSelectorRequirement{Key: v1.LabelTopologyZone, Operator: v1.NodeSelectorOpIn, Values: []string{"a"}}
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{GenerateName: "app-"},
+		Spec: v1.PodSpec{
+			Containers: []v1.Container{{Name: "app", Image: "example.com/app:1.0"}},
+			Affinity: &v1.Affinity{
+				NodeAffinity: &v1.NodeAffinity{
+					RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+						NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{zone}}},
+					},
+				},
+			},
+		},
+	}
+	response := reviewPod(t, webhook, pod)
+	if !response.Allowed || response.PatchType == nil {
+		t.Fatalf("expected pod to be allowed with a JSON patch: %+v", response)
+	}
+	var patch []struct {
+		Op    string      `json:"op"`
+		Path  string      `json:"path"`
+		Value v1.Affinity `json:"value"`
+	}
+	if err := json.Unmarshal(response.Patch, &patch); err != nil {
+		t.Fatal(err)
+	}
+	if len(patch) != 1 || patch[0].Op != "add" || patch[0].Path != "/spec/affinity" {
+		t.Fatalf("unexpected patch: %s", response.Patch)
+	}
+	expected := []v1.NodeSelectorTerm{{
+		MatchExpressions: []v1.NodeSelectorRequirement{
+			zone,
+			{Key: v1.LabelArchStable, Operator: v1.NodeSelectorOpIn, Values: []string{"ppc64le", "s390x"}},
+			{Key: v1.LabelOSStable, Operator: v1.NodeSelectorOpIn, Values: []string{"linux"}},
+		},
+	}}
+	terms := patch[0].Value.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+	if !reflect.DeepEqual(terms, expected) {
+		t.Errorf("unexpected node selector terms: %+v, expected %+v", terms, expected)
+	}
+
+	// Pods which already require the architectures are left unchanged
+	pod.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms = expected
+	if response := reviewPod(t, webhook, pod); !response.Allowed || response.Patch != nil {
+		t.Errorf("expected pod with node affinity to be admitted unchanged: %+v", response)
+	}
+}
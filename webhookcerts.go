@@ -0,0 +1,455 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"math/big"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// webhookCAKeyKey holds the CA's private key within the webhook's
+// certificate Secret, next to the standard tls.crt, tls.key and ca.crt keys.
+const webhookCAKeyKey = "ca.key"
+
+// webhookCertificates manages the CA and serving certificate of the
+// admission webhook without relying on cert-manager. Both are stored
+// within a Secret, so that they're shared between replicas and survive
+// restarts, and the CA bundle is injected into the webhook's
+// MutatingWebhookConfiguration and ValidatingWebhookConfiguration objects.
+// Certificates are rotated once two thirds of their lifetime has passed.
+type webhookCertificates struct {
+	clientset kubernetes.Interface
+	namespace string
+	name      string
+	// dnsNames are the names the webhook is reached on,
+	// such as archaware-controller.kube-system.svc.
+	dnsNames []string
+	// configurations are the names of the webhook configurations
+	// the CA bundle is injected into.
+	configurations []string
+	now            func() time.Time
+
+	mu      sync.RWMutex
+	current *tls.Certificate
+}
+
+// newWebhookCertificates creates a webhookCertificates from the CLI.
+func newWebhookCertificates(ctx *context.Context) (*webhookCertificates, error) {
+	secretName := flag.Lookup("webhook-cert-secret").Value.String()
+	namespace, name, ok := strings.Cut(secretName, "/")
+	if !ok || namespace == "" || name == "" {
+		return nil, fmt.Errorf("webhook certificate secret must be given as namespace/name: %q", secretName)
+	}
+	dnsNames := make([]string, 0)
+	for _, dnsName := range strings.Split(flag.Lookup("webhook-dns-names").Value.String(), ",") {
+		if dnsName = strings.TrimSpace(dnsName); dnsName != "" {
+			dnsNames = append(dnsNames, dnsName)
+		}
+	}
+	if len(dnsNames) == 0 {
+		return nil, fmt.Errorf("webhook certificates require at least one DNS name")
+	}
+	configurations := make([]string, 0)
+	for _, configuration := range strings.Split(flag.Lookup("webhook-configurations").Value.String(), ",") {
+		if configuration = strings.TrimSpace(configuration); configuration != "" {
+			configurations = append(configurations, configuration)
+		}
+	}
+
+	return &webhookCertificates{
+		clientset:      GetK8sInterface(ctx),
+		namespace:      namespace,
+		name:           name,
+		dnsNames:       dnsNames,
+		configurations: configurations,
+		now:            time.Now,
+	}, nil
+}
+
+// needsRenewal determines if the given certificate is within
+// the last third of its lifetime.
+func needsRenewal(cert *x509.Certificate, now time.Time) bool {
+	lifetime := cert.NotAfter.Sub(cert.NotBefore)
+	return now.After(cert.NotBefore.Add(lifetime * 2 / 3))
+}
+
+// generateCertificate creates a certificate with a new key, signed by the
+// given parent and its key. The certificate is self-signed if parent is nil.
+func generateCertificate(template *x509.Certificate, parent *x509.Certificate, parentKey crypto.Signer) ([]byte, []byte, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, err
+	}
+	template.SerialNumber = serial
+	if parent == nil {
+		parent = template
+		parentKey = key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, key.Public(), parentKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, err
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}),
+		nil
+}
+
+// parseCertificates parses each PEM-encoded certificate within the given data.
+func parseCertificates(data []byte) ([]*x509.Certificate, error) {
+	certs := make([]*x509.Certificate, 0)
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no certificates found")
+	}
+	return certs, nil
+}
+
+// parsePrivateKey parses the given PEM-encoded PKCS8 private key.
+func parsePrivateKey(data []byte) (crypto.Signer, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no private key found")
+	}
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return nil, fmt.Errorf("unsupported private key type %T", key)
+	}
+	return signer, nil
+}
+
+// coversDNSNames determines if the given certificate is valid for each of the given names.
+func coversDNSNames(cert *x509.Certificate, dnsNames []string) bool {
+	for _, name := range dnsNames {
+		if cert.VerifyHostname(name) != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// issue fills in the given Secret's data with certificates valid at the given
+// time, keeping the existing certificates which don't need renewal yet.
+// Returns whether the Secret's data changed.
+func (w *webhookCertificates) issue(secret *v1.Secret, now time.Time) (bool, error) {
+	if secret.Data == nil {
+		secret.Data = make(map[string][]byte)
+	}
+
+	// ca.crt holds the CA bundle: the current CA, followed by the
+	// previous CA while it's still valid, so that certificates served
+	// by other replicas are trusted during rotation.
+	var ca *x509.Certificate
+	var caKey crypto.Signer
+	var previousCA []byte
+	if bundle, err := parseCertificates(secret.Data[v1.ServiceAccountRootCAKey]); err == nil {
+		if key, err := parsePrivateKey(secret.Data[webhookCAKeyKey]); err == nil {
+			ca, caKey = bundle[0], key
+		}
+	}
+	rotateCA := ca == nil || needsRenewal(ca, now)
+	if rotateCA {
+		if ca != nil && now.Before(ca.NotAfter) {
+			previousCA = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Raw})
+		}
+		caPEM, caKeyPEM, err := generateCertificate(
+			&x509.Certificate{
+				Subject:               pkix.Name{CommonName: OPERATOR_NAME + "-webhook-ca"},
+				NotBefore:             now.Add(-WEBHOOK_CERT_BACKDATE),
+				NotAfter:              now.Add(WEBHOOK_CA_VALIDITY),
+				KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+				BasicConstraintsValid: true,
+				IsCA:                  true,
+			},
+			nil,
+			nil,
+		)
+		if err != nil {
+			return false, fmt.Errorf("unable to generate webhook CA: %w", err)
+		}
+		if ca, caKey, err = parseGeneratedCertificate(caPEM, caKeyPEM); err != nil {
+			return false, err
+		}
+		secret.Data[v1.ServiceAccountRootCAKey] = append(caPEM, previousCA...)
+		secret.Data[webhookCAKeyKey] = caKeyPEM
+	}
+
+	if !rotateCA {
+		if certs, err := parseCertificates(secret.Data[v1.TLSCertKey]); err == nil {
+			_, keyErr := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+			if keyErr == nil &&
+				certs[0].CheckSignatureFrom(ca) == nil &&
+				coversDNSNames(certs[0], w.dnsNames) &&
+				!needsRenewal(certs[0], now) {
+				return false, nil
+			}
+		}
+	}
+
+	certPEM, keyPEM, err := generateCertificate(
+		&x509.Certificate{
+			Subject:     pkix.Name{CommonName: w.dnsNames[0]},
+			DNSNames:    w.dnsNames,
+			NotBefore:   now.Add(-WEBHOOK_CERT_BACKDATE),
+			NotAfter:    now.Add(WEBHOOK_CERT_VALIDITY),
+			KeyUsage:    x509.KeyUsageDigitalSignature,
+			ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		},
+		ca,
+		caKey,
+	)
+	if err != nil {
+		return false, fmt.Errorf("unable to generate webhook serving certificate: %w", err)
+	}
+	secret.Data[v1.TLSCertKey] = certPEM
+	secret.Data[v1.TLSPrivateKeyKey] = keyPEM
+	return true, nil
+}
+
+// parseGeneratedCertificate parses a certificate and key created by generateCertificate.
+func parseGeneratedCertificate(certPEM []byte, keyPEM []byte) (*x509.Certificate, crypto.Signer, error) {
+	certs, err := parseCertificates(certPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	key, err := parsePrivateKey(keyPEM)
+	if err != nil {
+		return nil, nil, err
+	}
+	return certs[0], key, nil
+}
+
+// setCABundle sets the caBundle of each of the given client configs,
+// returning whether any of them changed.
+func setCABundle(clientConfigs []*admissionregistrationv1.WebhookClientConfig, bundle []byte) bool {
+	changed := false
+	for _, clientConfig := range clientConfigs {
+		if !bytes.Equal(clientConfig.CABundle, bundle) {
+			clientConfig.CABundle = bundle
+			changed = true
+		}
+	}
+	return changed
+}
+
+// injectCABundleInto sets the caBundle of each webhook within the named
+// webhook configuration, got and updated through the given functions, which
+// are those of either the mutating or the validating configuration client.
+// A missing configuration is skipped, as not every webhook has to be registered.
+func injectCABundleInto[T any](
+	ctx *context.Context,
+	kind string,
+	name string,
+	bundle []byte,
+	get func(ctx context.Context, name string, options metav1.GetOptions) (T, error),
+	update func(ctx context.Context, config T, options metav1.UpdateOptions) (T, error),
+	clientConfigs func(config T) []*admissionregistrationv1.WebhookClientConfig,
+) error {
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		config, err := get(*ctx, name, metav1.GetOptions{})
+		if k8serrors.IsNotFound(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if !setCABundle(clientConfigs(config), bundle) {
+			return nil
+		}
+		if _, err := update(*ctx, config, metav1.UpdateOptions{}); err != nil {
+			return err
+		}
+		log.WithLevel(zerolog.InfoLevel).
+			Str("webhook-configuration", name).
+			Msgf("Injected CA bundle into %s", kind)
+		return nil
+	})
+}
+
+// injectCABundle sets the caBundle of each webhook within the webhook
+// configurations, whether mutating or validating.
+func (w *webhookCertificates) injectCABundle(ctx *context.Context, bundle []byte) error {
+	mutatingClient := w.clientset.AdmissionregistrationV1().MutatingWebhookConfigurations()
+	validatingClient := w.clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations()
+	for _, name := range w.configurations {
+		err := injectCABundleInto(
+			ctx, "MutatingWebhookConfiguration", name, bundle,
+			mutatingClient.Get, mutatingClient.Update,
+			func(config *admissionregistrationv1.MutatingWebhookConfiguration) []*admissionregistrationv1.WebhookClientConfig {
+				clientConfigs := make([]*admissionregistrationv1.WebhookClientConfig, 0, len(config.Webhooks))
+				for i := range config.Webhooks {
+					clientConfigs = append(clientConfigs, &config.Webhooks[i].ClientConfig)
+				}
+				return clientConfigs
+			},
+		)
+		if err != nil {
+			return err
+		}
+
+		err = injectCABundleInto(
+			ctx, "ValidatingWebhookConfiguration", name, bundle,
+			validatingClient.Get, validatingClient.Update,
+			func(config *admissionregistrationv1.ValidatingWebhookConfiguration) []*admissionregistrationv1.WebhookClientConfig {
+				clientConfigs := make([]*admissionregistrationv1.WebhookClientConfig, 0, len(config.Webhooks))
+				for i := range config.Webhooks {
+					clientConfigs = append(clientConfigs, &config.Webhooks[i].ClientConfig)
+				}
+				return clientConfigs
+			},
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reconcile loads the certificates within the Secret, issuing new ones
+// if missing or due for renewal, injects the CA bundle and starts serving
+// the current serving certificate. Safe to run from multiple replicas, as
+// conflicting writes to the Secret are retried against the winner's write.
+func (w *webhookCertificates) reconcile(ctx *context.Context) error {
+	secretClient := w.clientset.CoreV1().Secrets(w.namespace)
+
+	var secret *v1.Secret
+	isConflict := func(err error) bool {
+		return k8serrors.IsConflict(err) || k8serrors.IsAlreadyExists(err)
+	}
+	err := retry.OnError(retry.DefaultRetry, isConflict, func() error {
+		existing, err := secretClient.Get(*ctx, w.name, metav1.GetOptions{})
+		found := err == nil
+		if k8serrors.IsNotFound(err) {
+			existing = &v1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: w.name, Namespace: w.namespace},
+				Type:       v1.SecretTypeTLS,
+			}
+		} else if err != nil {
+			return err
+		}
+
+		changed, err := w.issue(existing, w.now())
+		if err != nil {
+			return err
+		}
+		secret = existing
+		if !changed {
+			return nil
+		}
+		if !found {
+			secret, err = secretClient.Create(*ctx, existing, metav1.CreateOptions{})
+		} else {
+			secret, err = secretClient.Update(*ctx, existing, metav1.UpdateOptions{})
+		}
+		if err == nil {
+			log.Info().
+				Str("secret", w.namespace+"/"+w.name).
+				Msg("Issued webhook certificates")
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// The CA bundle is injected first, so that the API server
+	// trusts the serving certificate before it's served
+	if err := w.injectCABundle(ctx, secret.Data[v1.ServiceAccountRootCAKey]); err != nil {
+		return fmt.Errorf("unable to inject webhook CA bundle: %w", err)
+	}
+	cert, err := tls.X509KeyPair(secret.Data[v1.TLSCertKey], secret.Data[v1.TLSPrivateKeyKey])
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.current = &cert
+	return nil
+}
+
+// GetCertificate returns the current serving certificate, for use within a tls.Config.
+func (w *webhookCertificates) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.current == nil {
+		return nil, fmt.Errorf("webhook serving certificate has not been issued")
+	}
+	return w.current, nil
+}
+
+// Start issues the webhook's certificates, then keeps them up to date until
+// the given context is done. Certificates are checked periodically, which
+// also picks up certificates rotated by other replicas and re-injects the
+// CA bundle into webhook configurations which have been re-applied.
+func (w *webhookCertificates) Start(ctx *context.Context) error {
+	if err := w.reconcile(ctx); err != nil {
+		return err
+	}
+
+	go func() {
+		ticker := time.NewTicker(WEBHOOK_CERT_CHECK_INTERVAL)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-(*ctx).Done():
+				return
+			case <-ticker.C:
+				if err := w.reconcile(ctx); err != nil {
+					log.Warn().
+						AnErr("err", err).
+						Str("secret", w.namespace+"/"+w.name).
+						Msg("Unable to reconcile webhook certificates, retrying later")
+				}
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/x509"
+	"testing"
+	"time"
+
+	admissionregistrationv1 "k8s.io/api/admissionregistration/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestWebhookCertificates(t *testing.T) {
+	clientset := fake.NewSimpleClientset(
+		&admissionregistrationv1.MutatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "archaware-controller"},
+			Webhooks:   []admissionregistrationv1.MutatingWebhook{{Name: "pods.archaware.io"}},
+		},
+		&admissionregistrationv1.ValidatingWebhookConfiguration{
+			ObjectMeta: metav1.ObjectMeta{Name: "archaware-controller"},
+			Webhooks:   []admissionregistrationv1.ValidatingWebhook{{Name: "pods.archaware.io"}},
+		},
+	)
+	now := time.Date(2024, time.January, 1, 0, 0, 0, 0, time.UTC)
+	certs := &webhookCertificates{
+		clientset:      clientset,
+		namespace:      "kube-system",
+		name:           "archaware-controller-webhook-tls",
+		dnsNames:       []string{"archaware-controller.kube-system.svc"},
+		configurations: []string{"archaware-controller", "missing"},
+		now:            func() time.Time { return now },
+	}
+	ctx := context.Background()
+
+	// verify checks that the served certificate is trusted by the injected CA bundle
+	verify := func() (*x509.Certificate, []byte) {
+		t.Helper()
+		if err := certs.reconcile(&ctx); err != nil {
+			t.Fatal(err)
+		}
+		config, err := clientset.AdmissionregistrationV1().MutatingWebhookConfigurations().Get(ctx, "archaware-controller", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bundle := config.Webhooks[0].ClientConfig.CABundle
+		validating, err := clientset.AdmissionregistrationV1().ValidatingWebhookConfigurations().Get(ctx, "archaware-controller", metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(validating.Webhooks[0].ClientConfig.CABundle, bundle) {
+			t.Fatalf("expected the same CA bundle to be injected into both webhook configurations")
+		}
+		roots := x509.NewCertPool()
+		if !roots.AppendCertsFromPEM(bundle) {
+			t.Fatalf("expected CA bundle to be injected, got %q", bundle)
+		}
+		served, err := certs.GetCertificate(nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leaf, err := x509.ParseCertificate(served.Certificate[0])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := leaf.Verify(x509.VerifyOptions{
+			DNSName:     "archaware-controller.kube-system.svc",
+			Roots:       roots,
+			CurrentTime: now,
+		}); err != nil {
+			t.Fatalf("expected served certificate to be trusted by the CA bundle: %v", err)
+		}
+		return leaf, bundle
+	}
+
+	leaf, bundle := verify()
+	secret, err := clientset.CoreV1().Secrets("kube-system").Get(ctx, "archaware-controller-webhook-tls", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if secret.Type != v1.SecretTypeTLS || len(secret.Data[webhookCAKeyKey]) == 0 {
+		t.Errorf("unexpected certificate secret: %s", secret.Type)
+	}
+
+	// Certificates are kept until they're due for renewal
+	if kept, keptBundle := verify(); !kept.Equal(leaf) || !bytes.Equal(keptBundle, bundle) {
+		t.Errorf("expected certificates to be kept before renewal")
+	}
+
+	// The serving certificate is renewed before it expires, under the same CA
+	now = now.Add(WEBHOOK_CERT_VALIDITY * 3 / 4)
+	if renewed, renewedBundle := verify(); renewed.Equal(leaf) || !bytes.Equal(renewedBundle, bundle) {
+		t.Errorf("expected only the serving certificate to be renewed")
+	}
+
+	// The CA is renewed before it expires, keeping the previous CA within the bundle
+	now = now.Add(WEBHOOK_CA_VALIDITY * 3 / 4)
+	_, rotatedBundle := verify()
+	if !bytes.HasSuffix(rotatedBundle, bundle) || len(rotatedBundle) <= len(bundle) {
+		t.Errorf("expected rotated CA bundle to hold the new and previous CA")
+	}
+}
@@ -0,0 +1,547 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/equality"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+)
+
+// workloadKind exposes the pod template of a kind of workload,
+// along with how to list, watch, get and patch it.
+type workloadKind struct {
+	Kind       string
+	APIVersion string
+	// resource is the plural name of the workload's API resource.
+	resource string
+	// templatePath is the path of the pod template within the workload.
+	templatePath []string
+	// template returns the pod template of the given workload, or nil
+	// if the template can't be changed.
+	template func(obj runtime.Object) *v1.PodTemplateSpec
+	list     func(ctx *context.Context, clientset kubernetes.Interface) (runtime.Object, error)
+	watch    func(ctx *context.Context, clientset kubernetes.Interface) (watch.Interface, error)
+	get      func(ctx *context.Context, clientset kubernetes.Interface, namespace string, name string) (runtime.Object, error)
+	patch    func(ctx *context.Context, clientset kubernetes.Interface, namespace string, name string, data []byte) error
+}
+
+// workloadClient is the typed client of a kind of workload T, whose lists are L,
+// such as the one returned by clientset.AppsV1().Deployments(namespace).
+type workloadClient[T runtime.Object, L runtime.Object] interface {
+	List(ctx context.Context, opts metav1.ListOptions) (L, error)
+	Watch(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+	Get(ctx context.Context, name string, opts metav1.GetOptions) (T, error)
+	Patch(ctx context.Context, name string, pt types.PatchType, data []byte, opts metav1.PatchOptions, subresources ...string) (T, error)
+}
+
+// newWorkloadKind returns the workloadKind of the workloads of type T, going
+// through the typed client returned by the given function for a namespace.
+func newWorkloadKind[T runtime.Object, L runtime.Object](
+	kind string,
+	apiVersion string,
+	resource string,
+	templatePath []string,
+	template func(obj T) *v1.PodTemplateSpec,
+	client func(clientset kubernetes.Interface, namespace string) workloadClient[T, L],
+) *workloadKind {
+	return &workloadKind{
+		Kind:         kind,
+		APIVersion:   apiVersion,
+		resource:     resource,
+		templatePath: templatePath,
+		template: func(obj runtime.Object) *v1.PodTemplateSpec {
+			return template(obj.(T))
+		},
+		list: func(ctx *context.Context, clientset kubernetes.Interface) (runtime.Object, error) {
+			return client(clientset, "").List(*ctx, metav1.ListOptions{})
+		},
+		watch: func(ctx *context.Context, clientset kubernetes.Interface) (watch.Interface, error) {
+			return client(clientset, "").Watch(*ctx, metav1.ListOptions{})
+		},
+		get: func(ctx *context.Context, clientset kubernetes.Interface, namespace string, name string) (runtime.Object, error) {
+			return client(clientset, namespace).Get(*ctx, name, metav1.GetOptions{})
+		},
+		patch: func(ctx *context.Context, clientset kubernetes.Interface, namespace string, name string, data []byte) error {
+			_, err := client(clientset, namespace).Patch(*ctx, name, types.StrategicMergePatchType, data, metav1.PatchOptions{})
+			return err
+		},
+	}
+}
+
+// podTemplatePath is the path of the pod template within most workloads.
+var podTemplatePath = []string{"spec", "template"}
+
+var workloadKinds = []*workloadKind{
+	newWorkloadKind(
+		"Deployment", "apps/v1", "deployments", podTemplatePath,
+		func(obj *appsv1.Deployment) *v1.PodTemplateSpec {
+			return &obj.Spec.Template
+		},
+		func(clientset kubernetes.Interface, namespace string) workloadClient[*appsv1.Deployment, *appsv1.DeploymentList] {
+			return clientset.AppsV1().Deployments(namespace)
+		},
+	),
+	newWorkloadKind(
+		"StatefulSet", "apps/v1", "statefulsets", podTemplatePath,
+		func(obj *appsv1.StatefulSet) *v1.PodTemplateSpec {
+			return &obj.Spec.Template
+		},
+		func(clientset kubernetes.Interface, namespace string) workloadClient[*appsv1.StatefulSet, *appsv1.StatefulSetList] {
+			return clientset.AppsV1().StatefulSets(namespace)
+		},
+	),
+	newWorkloadKind(
+		"DaemonSet", "apps/v1", "daemonsets", podTemplatePath,
+		func(obj *appsv1.DaemonSet) *v1.PodTemplateSpec {
+			return &obj.Spec.Template
+		},
+		func(clientset kubernetes.Interface, namespace string) workloadClient[*appsv1.DaemonSet, *appsv1.DaemonSetList] {
+			return clientset.AppsV1().DaemonSets(namespace)
+		},
+	),
+	newWorkloadKind(
+		"ReplicaSet", "apps/v1", "replicasets", podTemplatePath,
+		func(obj *appsv1.ReplicaSet) *v1.PodTemplateSpec {
+			return &obj.Spec.Template
+		},
+		func(clientset kubernetes.Interface, namespace string) workloadClient[*appsv1.ReplicaSet, *appsv1.ReplicaSetList] {
+			return clientset.AppsV1().ReplicaSets(namespace)
+		},
+	),
+	newWorkloadKind(
+		"Job", "batch/v1", "jobs", podTemplatePath,
+		func(obj *batchv1.Job) *v1.PodTemplateSpec {
+			// A Job's template can only have its scheduling directives
+			// changed while the Job is suspended and has never started
+			if obj.Spec.Suspend == nil || !*obj.Spec.Suspend || obj.Status.StartTime != nil {
+				return nil
+			}
+			return &obj.Spec.Template
+		},
+		func(clientset kubernetes.Interface, namespace string) workloadClient[*batchv1.Job, *batchv1.JobList] {
+			return clientset.BatchV1().Jobs(namespace)
+		},
+	),
+	newWorkloadKind(
+		"CronJob", "batch/v1", "cronjobs", []string{"spec", "jobTemplate", "spec", "template"},
+		func(obj *batchv1.CronJob) *v1.PodTemplateSpec {
+			return &obj.Spec.JobTemplate.Spec.Template
+		},
+		func(clientset kubernetes.Interface, namespace string) workloadClient[*batchv1.CronJob, *batchv1.CronJobList] {
+			return clientset.BatchV1().CronJobs(namespace)
+		},
+	),
+}
+
+// workloadVerbs are the verbs needed on every kind of workload
+// for its templates to be patched.
+var workloadVerbs = []string{"get", "list", "watch", "patch"}
+
+// checkWorkloadAccess determines if the controller may get, list, watch and
+// patch every kind of workload cluster-wide, returning an error naming the
+// missing permissions otherwise.
+func checkWorkloadAccess(ctx *context.Context, clientset kubernetes.Interface) error {
+	missing := make([]string, 0)
+	for _, kind := range workloadKinds {
+		groupVersion, err := schema.ParseGroupVersion(kind.APIVersion)
+		if err != nil {
+			return err
+		}
+		resource := schema.GroupResource{Group: groupVersion.Group, Resource: kind.resource}
+		for _, verb := range workloadVerbs {
+			review, err := clientset.AuthorizationV1().SelfSubjectAccessReviews().Create(
+				*ctx,
+				&authorizationv1.SelfSubjectAccessReview{
+					Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+						ResourceAttributes: &authorizationv1.ResourceAttributes{
+							Verb:     verb,
+							Group:    resource.Group,
+							Resource: resource.Resource,
+						},
+					},
+				},
+				metav1.CreateOptions{},
+			)
+			if err != nil {
+				return fmt.Errorf("unable to check access to %s: %w", resource, err)
+			}
+			if !review.Status.Allowed {
+				missing = append(missing, verb+" "+resource.String())
+			}
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing permissions on workloads needed by -workload-templates: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// setupWorkloadTemplates checks that the controller may patch workloads if
+// -workload-templates is given on the CLI, so that missing permissions fail
+// the controller on startup, rather than failing every watch.
+func setupWorkloadTemplates(ctx *context.Context) error {
+	if !flag.Lookup("workload-templates").Value.(flag.Getter).Get().(bool) {
+		return nil
+	}
+	return checkWorkloadAccess(ctx, GetK8sInterface(ctx))
+}
+
+// templatePlacementPatch returns the fields of a strategic merge patch of the
+// given template spec replacing the tolerations or node affinity of its previous
+// images with those of the given placement, or nil if nothing needs changing,
+// along with the node selector requirements added. Unlike those of pods, the
+// tolerations and node affinity of templates can be removed, so templates whose
+// images now support fewer platforms stop tolerating nodes they can't run on.
+// Every toleration of the controller's taints is replaced, but only the given
+// requirements added for the previous images, leaving those of others be.
+func templatePlacementPatch(ctx *context.Context, spec *v1.PodSpec, placement *podPlacement, owned []v1.NodeSelectorRequirement) (map[string]interface{}, []v1.NodeSelectorRequirement) {
+	if placement == nil {
+		return nil, owned
+	}
+	if GetPlacementMode(ctx) == PlacementModeAffinity {
+		requirements := placement.nodeSelectorRequirements()
+		affinity, _ := mergeNodeAffinity(removeNodeSelectorRequirements(spec.Affinity, owned), requirements)
+		if equality.Semantic.DeepEqual(affinity, spec.Affinity) {
+			return nil, requirements
+		}
+		return map[string]interface{}{"affinity": affinity}, requirements
+	}
+
+	tolerations := make([]v1.Toleration, 0, len(spec.Tolerations))
+	for _, toleration := range spec.Tolerations {
+		if toleration.Key != ARCH_TAINT_KEY_NAME && toleration.Key != OS_TAINT_KEY_NAME {
+			tolerations = append(tolerations, toleration)
+		}
+	}
+	tolerations = append(tolerations, placement.tolerations()...)
+	if equality.Semantic.DeepEqual(tolerations, spec.Tolerations) {
+		return nil, nil
+	}
+	// Tolerations are replaced as a whole by strategic merge patches
+	return map[string]interface{}{"tolerations": tolerations}, nil
+}
+
+// getOwnedRequirements returns the node selector requirements recorded
+// within the given workload annotations as added by the controller.
+func getOwnedRequirements(annotations map[string]string) []v1.NodeSelectorRequirement {
+	var owned []v1.NodeSelectorRequirement
+	if err := json.Unmarshal([]byte(annotations[WORKLOAD_AFFINITY_ANNOTATION]), &owned); err != nil {
+		return nil
+	}
+	return owned
+}
+
+// templateImages returns the images of every container within the given template.
+func templateImages(template *v1.PodTemplateSpec) []string {
+	images := make([]string, 0, len(template.Spec.InitContainers)+len(template.Spec.Containers))
+	for _, container := range template.Spec.InitContainers {
+		images = append(images, container.Image)
+	}
+	for _, container := range template.Spec.Containers {
+		images = append(images, container.Image)
+	}
+	return images
+}
+
+// getImageDigest returns the digest the given image is known to refer to,
+// either from the image reference itself or from the image cache, without
+// contacting its registry. Returns an empty string if the digest is unknown,
+// such as for images answered from annotations or the catalog.
+func getImageDigest(ctx *context.Context, image string) string {
+	references, err := GetRegistriesConfig(ctx).References(image)
+	if err != nil {
+		return ""
+	}
+	for _, ref := range references {
+		if _, dgst, ok := strings.Cut(ref, "@"); ok {
+			return dgst
+		}
+		if dgst, _, ok := GetImageCache(ctx).GetStaleTag(ref); ok {
+			return dgst.String()
+		}
+	}
+	return ""
+}
+
+// templateUpToDate determines if the given images are those recorded within
+// the given workload annotations, still referring to the recorded digests.
+func templateUpToDate(ctx *context.Context, annotations map[string]string, images []string) bool {
+	recorded := make(map[string]string)
+	if err := json.Unmarshal([]byte(annotations[WORKLOAD_DIGESTS_ANNOTATION]), &recorded); err != nil {
+		return false
+	}
+	current := make(map[string]bool)
+	for _, image := range images {
+		dgst, ok := recorded[image]
+		if !ok {
+			return false
+		}
+		// Tags whose digest isn't known anymore, such as once evicted
+		// from the cache, are assumed not to have moved
+		if known := getImageDigest(ctx, image); known != "" && known != dgst {
+			return false
+		}
+		current[image] = true
+	}
+	return len(current) == len(recorded)
+}
+
+// handleWorkload resolves the platforms supported by the images of the given
+// workload's pod template, writing the tolerations or node affinity they need
+// into the template, so that the workload's pods are created with them.
+// The digests the images resolved to are recorded on the workload, so
+// templates are only resolved again once their images change.
+func handleWorkload(ctx *context.Context, kind *workloadKind, obj runtime.Object, clientset kubernetes.Interface) error {
+	object := obj.(metav1.Object)
+	namespace, name := object.GetNamespace(), object.GetName()
+
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("workload-kind", kind.Kind).
+			Str("namespace", namespace).
+			Str("workload-name", name)
+	}
+
+	// Templates managed by another workload, such as the ReplicaSets of a
+	// Deployment or the Jobs of a CronJob, are patched through their owner
+	if getControllerRef(object.GetOwnerReferences()) != nil {
+		return nil
+	}
+	template := kind.template(obj)
+	if template == nil {
+		return nil
+	}
+	images := templateImages(template)
+	if templateUpToDate(ctx, object.GetAnnotations(), images) {
+		getLog(zerolog.DebugLevel).
+			Msg("Workload template up to date, doing nothing")
+		return nil
+	}
+
+	// The template is resolved as a pod owned by the workload, so the
+	// workload's architecture annotations apply. The pod doesn't exist,
+	// so events can't be recorded against it, and are left to the pod watch.
+	isController := true
+	pod := &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   namespace,
+			Labels:      template.Labels,
+			Annotations: template.Annotations,
+			OwnerReferences: []metav1.OwnerReference{
+				{
+					APIVersion: kind.APIVersion,
+					Kind:       kind.Kind,
+					Name:       name,
+					UID:        object.GetUID(),
+					Controller: &isController,
+				},
+			},
+		},
+		Spec: *template.Spec.DeepCopy(),
+	}
+	resolveCtx := context.WithValue(*ctx, K8S_EVENT_RECORDER_KEY, nil)
+	placement, err := getPodPlacement(&resolveCtx, pod, clientset)
+	if err != nil {
+		return err
+	}
+
+	digests := make(map[string]string)
+	for _, image := range images {
+		digests[image] = getImageDigest(ctx, image)
+	}
+	recorded, err := json.Marshal(digests)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		result, err := kind.get(ctx, clientset, namespace, name)
+		if err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to get latest information on workload")
+			return err
+		}
+		latest := result.(metav1.Object)
+		latestTemplate := kind.template(result)
+		// Templates changed since they were resolved are
+		// handled through the event of their change
+		if latestTemplate == nil || !reflect.DeepEqual(templateImages(latestTemplate), images) {
+			return nil
+		}
+
+		annotations := latest.GetAnnotations()
+		spec, requirements := templatePlacementPatch(ctx, &latestTemplate.Spec, placement, getOwnedRequirements(annotations))
+		patchAnnotations := map[string]interface{}{
+			WORKLOAD_DIGESTS_ANNOTATION: string(recorded),
+		}
+		upToDate := annotations[WORKLOAD_DIGESTS_ANNOTATION] == string(recorded)
+		if requirements != nil {
+			// The requirements added are recorded, so that they can be
+			// told apart from those of others once the images change
+			owned, err := json.Marshal(requirements)
+			if err != nil {
+				return err
+			}
+			patchAnnotations[WORKLOAD_AFFINITY_ANNOTATION] = string(owned)
+			upToDate = upToDate && annotations[WORKLOAD_AFFINITY_ANNOTATION] == string(owned)
+		}
+		if spec == nil && upToDate {
+			return nil
+		}
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": latest.GetResourceVersion(),
+				"annotations":     patchAnnotations,
+			},
+		}
+		if spec != nil {
+			// Nest the pod spec patch within the workload, such as
+			// spec.jobTemplate.spec.template.spec for CronJobs
+			var nested interface{} = map[string]interface{}{"spec": spec}
+			for i := len(kind.templatePath) - 1; i > 0; i-- {
+				nested = map[string]interface{}{kind.templatePath[i]: nested}
+			}
+			patch[kind.templatePath[0]] = nested
+		}
+		data, err := json.Marshal(patch)
+		if err != nil {
+			return err
+		}
+
+		if err := kind.patch(ctx, clientset, namespace, name, data); err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to patch workload template")
+			return err
+		}
+		getLog(zerolog.InfoLevel).
+			Bool("template-changed", spec != nil).
+			Msg("Patched workload template")
+		return nil
+	})
+}
+
+// ensureWorkloadTemplates watches every workload of the given kind,
+// handling each of them on change and on every reconciliation.
+func ensureWorkloadTemplates(ctx *context.Context, kind *workloadKind) {
+	clientset := GetK8sInterface(ctx)
+	getLog := func(level zerolog.Level) *zerolog.Event {
+		return log.WithLevel(level).
+			Str("workload-kind", kind.Kind)
+	}
+
+	handleWorkloadWrapper := func(obj runtime.Object, wg *sync.WaitGroup) {
+		if wg != nil {
+			defer wg.Done()
+		}
+
+		RetryOnError(
+			ctx,
+			func() error {
+				return handleWorkload(ctx, kind, obj, clientset)
+			},
+		)
+	}
+
+	reconcile := func() {
+		list, err := kind.list(ctx, clientset)
+		if err == nil {
+			var objs []runtime.Object
+			objs, err = meta.ExtractList(list)
+			if err == nil {
+				var wg sync.WaitGroup
+				for _, obj := range objs {
+					wg.Add(1)
+					go handleWorkloadWrapper(obj, &wg)
+				}
+				wg.Wait()
+			}
+		}
+		if err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Error while listing workloads")
+		}
+	}
+
+	ticker := time.NewTicker(RECONCILIATION_INTERVAL)
+	defer ticker.Stop()
+	for {
+		workloadWatch, err := kind.watch(ctx, clientset)
+		if err != nil {
+			getLog(zerolog.WarnLevel).
+				AnErr("err", err).
+				Msg("Unable to watch workloads, retrying")
+		} else {
+		watchLoop:
+			for {
+				select {
+				case <-(*ctx).Done():
+					workloadWatch.Stop()
+					return
+				case event, ok := <-workloadWatch.ResultChan():
+					if !ok {
+						break watchLoop
+					}
+					if event.Type == watch.Error {
+						getLog(zerolog.ErrorLevel).
+							Interface("api-err", event.Object).
+							Msg("Received error while watching workloads")
+						continue
+					}
+					if event.Type == watch.Deleted {
+						continue
+					}
+					go handleWorkloadWrapper(event.Object, nil)
+				case <-ticker.C:
+					getLog(zerolog.InfoLevel).
+						Msg("Reconciling workload templates...")
+					reconcile()
+				}
+			}
+		}
+
+		select {
+		case <-(*ctx).Done():
+			return
+		case <-time.After(WORKLOAD_WATCH_RETRY_INTERVAL):
+		}
+	}
+}
+
+// EnsureWorkloadTemplates writes the tolerations or node affinity needed by
+// the pods of every Deployment, StatefulSet, DaemonSet, ReplicaSet, suspended
+// Job and CronJob into their pod templates, until the given context is done.
+func EnsureWorkloadTemplates(ctx *context.Context) {
+	var wg sync.WaitGroup
+	for _, kind := range workloadKinds {
+		wg.Add(1)
+		go func(kind *workloadKind) {
+			defer wg.Done()
+			ensureWorkloadTemplates(ctx, kind)
+		}(kind)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/opencontainers/go-digest"
+	appsv1 "k8s.io/api/apps/v1"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newWorkloadContext returns a context resolving images from a catalog,
+// with app:1.0 known to refer to a digest through the image cache.
+func newWorkloadContext(t *testing.T, mode PlacementMode) context.Context {
+	catalog := NewCatalog()
+	if err := catalog.Load("test", []byte(`
+images:
+- match: example.com/app:1.0
+  platforms: [linux/s390x]
+- match: example.com/app:2.0
+  platforms: [linux/ppc64le]
+- match: example.com/multi:1.0
+  platforms: [linux/amd64, linux/arm64]
+- match: example.com/multi:2.0
+  platforms: [linux/amd64]
+`)); err != nil {
+		t.Fatal(err)
+	}
+	cache := NewImageCache(10, time.Minute, time.Minute)
+	cache.AddTag("example.com/app:1.0", digest.FromString("1.0"))
+	ctx := context.WithValue(context.Background(), RESOLVER_CHAIN_KEY, ResolverChain{&catalogResolver{catalog: catalog}})
+	ctx = context.WithValue(ctx, IMAGE_CACHE_KEY, cache)
+	return context.WithValue(ctx, PLACEMENT_MODE_KEY, mode)
+}
+
+// getWorkloadKind returns the workloadKind of the given kind.
+func getWorkloadKind(t *testing.T, kind string) *workloadKind {
+	for _, workloadKind := range workloadKinds {
+		if workloadKind.Kind == kind {
+			return workloadKind
+		}
+	}
+	t.Fatalf("unknown workload kind %s", kind)
+	return nil
+}
+
+func countPatches(clientset *fake.Clientset) int {
+	patches := 0
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "patch" {
+			patches++
+		}
+	}
+	return patches
+}
+
+func TestHandleWorkload(t *testing.T) {
+	ctx := newWorkloadContext(t, PlacementModeTaints)
+	deployment := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: appsv1.DeploymentSpec{
+			Template: v1.PodTemplateSpec{
+				Spec: v1.PodSpec{
+					Containers: []v1.Container{{Name: "app", Image: "example.com/app:1.0"}},
+					Tolerations: []v1.Toleration{
+						{Key: "dedicated", Operator: v1.TolerationOpExists},
+					},
+				},
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(deployment)
+	kind := getWorkloadKind(t, "Deployment")
+
+	if err := handleWorkload(&ctx, kind, deployment, clientset); err != nil {
+		t.Fatal(err)
+	}
+	result, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []v1.Toleration{
+		{Key: "dedicated", Operator: v1.TolerationOpExists},
+		{Key: ARCH_TAINT_KEY_NAME, Value: "s390x", Effect: v1.TaintEffectNoSchedule},
+		{Key: OS_TAINT_KEY_NAME, Value: "linux", Effect: v1.TaintEffectNoSchedule},
+	}
+	if !reflect.DeepEqual(result.Spec.Template.Spec.Tolerations, expected) {
+		t.Errorf("unexpected tolerations: %+v, expected %+v", result.Spec.Template.Spec.Tolerations, expected)
+	}
+	var recorded map[string]string
+	if err := json.Unmarshal([]byte(result.Annotations[WORKLOAD_DIGESTS_ANNOTATION]), &recorded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(recorded, map[string]string{"example.com/app:1.0": digest.FromString("1.0").String()}) {
+		t.Errorf("unexpected recorded digests: %+v", recorded)
+	}
+
+	// Unchanged templates are skipped
+	patches := countPatches(clientset)
+	if err := handleWorkload(&ctx, kind, result, clientset); err != nil {
+		t.Fatal(err)
+	}
+	if countPatches(clientset) != patches {
+		t.Errorf("expected unchanged template to be skipped")
+	}
+
+	// As are templates whose tag moved once the cache knows of it
+	GetImageCache(&ctx).AddTag("example.com/app:1.0", digest.FromString("1.0.1"))
+	if templateUpToDate(&ctx, result.Annotations, templateImages(&result.Spec.Template)) {
+		t.Errorf("expected template whose tag moved to be out of date")
+	}
+
+	// Templates managed by another workload are left to their owner
+	isController := true
+	owned := deployment.DeepCopy()
+	owned.OwnerReferences = []metav1.OwnerReference{{Kind: "Rollout", Name: "app", Controller: &isController}}
+	owned.Annotations = nil
+	patches = countPatches(clientset)
+	if err := handleWorkload(&ctx, kind, owned, clientset); err != nil {
+		t.Fatal(err)
+	}
+	if countPatches(clientset) != patches {
+		t.Errorf("expected owned workload to be skipped")
+	}
+}
+
+func TestHandleWorkloadCronJob(t *testing.T) {
+	ctx := newWorkloadContext(t, PlacementModeAffinity)
+	cronJob := &batchv1.CronJob{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+		Spec: batchv1.CronJobSpec{
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					Template: v1.PodTemplateSpec{
+						Spec: v1.PodSpec{
+							Containers: []v1.Container{{Name: "app", Image: "example.com/app:2.0"}},
+						},
+					},
+				},
+			},
+		},
+	}
+	clientset := fake.NewSimpleClientset(cronJob)
+	kind := getWorkloadKind(t, "CronJob")
+
+	if err := handleWorkload(&ctx, kind, cronJob, clientset); err != nil {
+		t.Fatal(err)
+	}
+	result, err := clientset.BatchV1().CronJobs("default").Get(ctx, "app", metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	affinity := result.Spec.JobTemplate.Spec.Template.Spec.Affinity
+	expected := []v1.NodeSelectorTerm{{
+		MatchExpressions: []v1.NodeSelectorRequirement{
+			{Key: v1.LabelArchStable, Operator: v1.NodeSelectorOpIn, Values: []string{"ppc64le"}},
+			{Key: v1.LabelOSStable, Operator: v1.NodeSelectorOpIn, Values: []string{"linux"}},
+		},
+	}}
+	if affinity == nil || !reflect.DeepEqual(affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms, expected) {
+		t.Errorf("unexpected affinity: %+v", affinity)
+	}
+	if result.Annotations[WORKLOAD_DIGESTS_ANNOTATION] != `{"example.com/app:2.0":""}` {
+		t.Errorf("unexpected recorded digests: %s", result.Annotations[WORKLOAD_DIGESTS_ANNOTATION])
+	}
+
+	// Jobs can only be patched while suspended and never started
+	jobKind := getWorkloadKind(t, "Job")
+	job := &batchv1.Job{Spec: cronJob.Spec.JobTemplate.Spec}
+	if jobKind.template(job) != nil {
+		t.Errorf("expected running job's template to be immutable")
+	}
+	suspend := true
+	job.Spec.Suspend = &suspend
+	if jobKind.template(job) == nil {
+		t.Errorf("expected suspended job's template to be mutable")
+	}
+}
+
+func TestHandleWorkloadFewerPlatforms(t *testing.T) {
+	for _, mode := range []PlacementMode{PlacementModeTaints, PlacementModeAffinity} {
+		ctx := newWorkloadContext(t, mode)
+		other := v1.NodeSelectorRequirement{Key: v1.LabelArchStable, Operator: v1.NodeSelectorOpNotIn, Values: []string{"s390x"}}
+		deployment := &appsv1.Deployment{
+			ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "default"},
+			Spec: appsv1.DeploymentSpec{
+				Template: v1.PodTemplateSpec{
+					Spec: v1.PodSpec{
+						Containers: []v1.Container{{Name: "app", Image: "example.com/multi:1.0"}},
+						Tolerations: []v1.Toleration{
+							{Key: "dedicated", Operator: v1.TolerationOpExists},
+						},
+						Affinity: &v1.Affinity{NodeAffinity: &v1.NodeAffinity{
+							RequiredDuringSchedulingIgnoredDuringExecution: &v1.NodeSelector{
+								NodeSelectorTerms: []v1.NodeSelectorTerm{{MatchExpressions: []v1.NodeSelectorRequirement{other}}},
+							},
+						}},
+					},
+				},
+			},
+		}
+		clientset := fake.NewSimpleClientset(deployment)
+		kind := getWorkloadKind(t, "Deployment")
+		handle := func(deployment *appsv1.Deployment) *appsv1.Deployment {
+			t.Helper()
+			if err := handleWorkload(&ctx, kind, deployment, clientset); err != nil {
+				t.Fatal(err)
+			}
+			result, err := clientset.AppsV1().Deployments("default").Get(ctx, "app", metav1.GetOptions{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return result
+		}
+		result := handle(deployment)
+
+		// Moving onto an image supporting fewer platforms
+		// drops what was added for the previous image
+		result.Spec.Template.Spec.Containers[0].Image = "example.com/multi:2.0"
+		result, err := clientset.AppsV1().Deployments("default").Update(ctx, result, metav1.UpdateOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		spec := handle(result).Spec.Template.Spec
+
+		if mode == PlacementModeAffinity {
+			expected := []v1.NodeSelectorRequirement{
+				other,
+				{Key: v1.LabelArchStable, Operator: v1.NodeSelectorOpIn, Values: []string{"amd64"}},
+				{Key: v1.LabelOSStable, Operator: v1.NodeSelectorOpIn, Values: []string{"linux"}},
+			}
+			terms := spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms
+			if len(terms) != 1 || !reflect.DeepEqual(terms[0].MatchExpressions, expected) {
+				t.Errorf("%s: unexpected node selector terms: %+v, expected %+v", mode, terms, expected)
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(spec.Tolerations[0], v1.Toleration{Key: "dedicated", Operator: v1.TolerationOpExists}) {
+			t.Errorf("%s: expected tolerations of others to be kept: %+v", mode, spec.Tolerations)
+		}
+		for _, toleration := range spec.Tolerations {
+			if strings.HasPrefix(toleration.Value, "arm64") {
+				t.Errorf("%s: expected arm64 toleration to be removed: %+v", mode, spec.Tolerations)
+				break
+			}
+		}
+		if missing := missingTolerations(spec.Tolerations, (&podPlacement{taintValues: []string{"amd64"}}).tolerations()); len(missing) != 0 {
+			t.Errorf("%s: expected amd64 toleration to be kept: %+v", mode, spec.Tolerations)
+		}
+	}
+}
+
+func TestCheckWorkloadAccess(t *testing.T) {
+	// checkAccess checks access with every permission
+	// granted, except for the given ones
+	checkAccess := func(denied ...string) error {
+		clientset := fake.NewSimpleClientset()
+		clientset.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+			review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview)
+			attributes := review.Spec.ResourceAttributes
+			review.Status.Allowed = true
+			for _, permission := range denied {
+				if permission == attributes.Verb+" "+attributes.Resource+"."+attributes.Group {
+					review.Status.Allowed = false
+				}
+			}
+			return true, review, nil
+		})
+		ctx := context.Background()
+		return checkWorkloadAccess(&ctx, clientset)
+	}
+
+	if err := checkAccess(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// Every missing permission is named within the error
+	err := checkAccess("list deployments.apps", "patch cronjobs.batch")
+	if err == nil {
+		t.Fatal("expected missing permissions to fail")
+	}
+	for _, permission := range []string{"list deployments.apps", "patch cronjobs.batch"} {
+		if !strings.Contains(err.Error(), permission) {
+			t.Errorf("expected error to name %q: %v", permission, err)
+		}
+	}
+	if strings.Contains(err.Error(), "watch") {
+		t.Errorf("expected error to only name missing permissions: %v", err)
+	}
+}